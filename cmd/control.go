@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/throttle"
+	"go_tools/units"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// startControl 在 unix socket 上接收运行时调整限速的命令，每行一条命令：
+//
+//	bwlimit 20M   同时调整读写带宽，0 表示不限制
+//	read 20M      只调整读带宽
+//	write 20M     只调整写带宽
+//	fps 100       调整每秒文件数
+//	status        查看当前限制
+//
+// 例如 echo "bwlimit 20M" | nc -U /tmp/co_copy.sock，返回的函数关闭 socket
+func startControl(path string, limiter *throttle.Throttle) (func(), error) {
+	// 上次异常退出留下的 socket 文件
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "remove control socket %v error", path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen control socket %v error", path)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(conn, limiter)
+		}
+	}()
+	log.Info("listen control socket %v, current limit: %v", path, limiter)
+	return func() {
+		if err := listener.Close(); err != nil {
+			log.Debug("close control socket %v error: %v", path, err)
+		}
+	}, nil
+}
+
+func serveControl(conn net.Conn, limiter *throttle.Throttle) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Debug("close control connection error: %v", err)
+		}
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		reply := "ok"
+		if err := doControl(line, limiter); err != nil {
+			reply = fmt.Sprintf("error: %v", err)
+		} else {
+			log.Info("control command %q, current limit: %v", line, limiter)
+		}
+		if _, err := fmt.Fprintf(conn, "%v, %v\n", reply, limiter); err != nil {
+			return
+		}
+	}
+}
+
+func doControl(line string, limiter *throttle.Throttle) error {
+	fields := strings.Fields(line)
+	if fields[0] == "status" {
+		return nil
+	}
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid command: %v", line)
+	}
+	switch fields[0] {
+	case "bwlimit", "read", "write":
+		rate, err := units.ParseSize(fields[1])
+		if err != nil {
+			return err
+		}
+		if fields[0] != "write" {
+			limiter.SetRead(rate)
+		}
+		if fields[0] != "read" {
+			limiter.SetWrite(rate)
+		}
+	case "fps":
+		rate, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid files per second %v", fields[1])
+		}
+		limiter.SetFiles(rate)
+	default:
+		return fmt.Errorf("unknown command: %v", fields[0])
+	}
+	return nil
+}
@@ -1,12 +1,22 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"go_tools/files/compress"
 	"go_tools/files/compress/gzip"
 	copy2 "go_tools/files/copy"
 	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/report"
+	"go_tools/retry"
+	"go_tools/throttle"
+	"go_tools/units"
+	"os"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -15,25 +25,250 @@ var copyCmd = &cobra.Command{
 	Aliases: []string{fmt.Sprintf(CUT_OFF_COMMAND_PREFIX, "copy")},
 	Short:   "copy files command, speed up copy process by multiple parallelism",
 	Long:    "copy files command, speed up copy process by multiple parallelism",
-	Example: "co_copy ./aa/ ./bb/ -parallelism 4",
+	Example: "co_copy ./aa/ ./bb/ -parallelism 4\nco_copy local:/data s3://bucket/prefix?endpoint=http://127.0.0.1:9000",
 	//Args:                       cobra.ExactArgs(),
 	ArgAliases: nil,
 	Run: func(cmd *cobra.Command, args []string) {
 		sourcePath := cmd.Flag("s").Value.String()
 		targetPath := cmd.Flag("t").Value.String()
-		handler, err := copy2.Get(sourcePath, targetPath)
+		// 也可以直接传入源路径和目标路径，支持 local:、sftp:// 和 s3:// 这样的存储路径
+		if len(sourcePath) == 0 && len(targetPath) == 0 && len(args) == 2 {
+			sourcePath, targetPath = args[0], args[1]
+		}
+		// 执行保存的计划时源路径和目标路径以计划为准
+		var plan *copy2.Plan
+		if planPath := cmd.Flag("plan").Value.String(); len(planPath) > 0 {
+			var err error
+			if plan, err = copy2.LoadPlan(planPath); err != nil {
+				log.Warn("load copy plan error: %v", err)
+				return
+			}
+			sourcePath, targetPath = plan.SourcePath, plan.TargetPath
+		}
+		// 重新复制上一次报告中的失败时源路径和目标路径以报告为准
+		var lastReport *report.Report
+		if failedReport := cmd.Flag("retry-failed").Value.String(); len(failedReport) > 0 {
+			var err error
+			if lastReport, err = report.Load(failedReport); err != nil {
+				log.Warn("load report error: %v", err)
+				return
+			}
+			sourcePath, targetPath = lastReport.SourcePath, lastReport.TargetPath
+			log.Info("copy %v failures of report %v again", len(lastReport.Failures), failedReport)
+		}
+		parallelismNumber := getParallelism(cmd)
+		handler, err := copy2.Get(sourcePath, targetPath, parallelismNumber)
 		if err != nil {
 			log.Warn("init copy env error: %v", err)
 			return
 		}
-		log.Info("source path: %v, target path: %v", sourcePath, targetPath)
+		if handler.DryRun, err = cmd.Flags().GetBool("dry-run"); err != nil {
+			panic(fmt.Sprintf("decode flag --dry-run error: %v", err))
+		}
+		if handler.Resume, err = cmd.Flags().GetBool("resume"); err != nil {
+			panic(fmt.Sprintf("decode flag --resume error: %v", err))
+		}
+		handler.Verify = copy2.HashAlgorithm(cmd.Flag("verify").Value.String())
+		if handler.VerifyRetry, err = cmd.Flags().GetInt("verify-retry"); err != nil {
+			panic(fmt.Sprintf("decode flag --verify-retry error: %v", err))
+		}
+		parseCopyFlags(cmd, handler)
+		handler.Filter = parseFilterFlags(cmd)
+		var stopControl func()
+		handler.Throttle, stopControl = parseThrottleFlags(cmd)
+		defer stopControl()
+		handler.Retry = parseRetryFlags(cmd)
+		var reportPath string
+		if !handler.DryRun {
+			handler.Report, reportPath = parseReportFlags(cmd, "copy", sourcePath, targetPath)
+		}
+		log.Info("source path: %v, target path: %v, parallelism: %v", sourcePath, targetPath, handler.Parallelism)
 		startTime := time.Now().Unix()
-		_, err = handler.Copy()
-		if err != nil {
+		ctx, stopSignal := signalContext()
+		defer stopSignal()
+		if plan != nil {
+			_, err = handler.ExecutePlanWithContext(ctx, plan)
+		} else if lastReport != nil {
+			_, err = handler.RetryFailedWithContext(ctx, lastReport.Failures)
+		} else {
+			_, err = handler.CopyWithContext(ctx)
+		}
+		if refusedForSpace(err) {
+			return
+		}
+		canceled := errors.Is(err, context.Canceled)
+		noSpace := errors.Is(err, syscall.ENOSPC)
+		if err != nil && !canceled && !noSpace {
 			log.Warn("copy file error: %v", err)
 			return
 		}
-		log.Info("copy process finish, dir: %v, files: %v cost time: %vs", handler.DirNumber, handler.FileNumber, time.Now().Unix()-startTime)
+		if handler.DryRun {
+			if !canceled {
+				writePlan(cmd, handler.Plan)
+			}
+			return
+		}
+		logConflicts(handler)
+		logDedup(handler)
+		logFailures(handler.FailFiles)
+		writeReport(handler.Report, reportPath)
+		if canceled {
+			log.Warn("copy canceled, run again with --resume to continue, partial result:")
+		}
+		if noSpace {
+			log.Warn("copy stopped: %v, partial file removed, %v files (%v) done, free up space and run again with --resume to continue", err, handler.FileNumber, units.FormatSize(handler.CopiedBytes))
+		}
+		log.Info("copy process finish, dir: %v, files: %v, skipped: %v, changed while reading: %v, strategies: %v cost time: %vs", handler.DirNumber, handler.FileNumber, handler.SkipNumber, handler.ChangedNumber, handler.Strategies, time.Now().Unix()-startTime)
+	},
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var syncCmd = &cobra.Command{
+	Use:     fmt.Sprintf(CUT_OFF_COMMAND_PREFIX, "sync"),
+	Aliases: []string{fmt.Sprintf(CUT_OFF_COMMAND_PREFIX, "sync")},
+	Short:   "sync files command, only copy new or changed files",
+	Long:    "sync files command, only copy new or changed files compared by size and modify time, optionally by checksum, and delete extraneous target files in mirror mode",
+	Example: "co_sync --s ./aa/ --t ./bb/ --delete",
+	//Args:                       cobra.ExactArgs(),
+	ArgAliases: nil,
+	Run: func(cmd *cobra.Command, args []string) {
+		sourcePath := cmd.Flag("s").Value.String()
+		targetPath := cmd.Flag("t").Value.String()
+		parallelismNumber := getParallelism(cmd)
+		handler, err := copy2.Get(sourcePath, targetPath, parallelismNumber)
+		if err != nil {
+			log.Warn("init sync env error: %v", err)
+			return
+		}
+		handler.Sync = true
+		if handler.Checksum, err = cmd.Flags().GetBool("checksum"); err != nil {
+			panic(fmt.Sprintf("decode flag --checksum error: %v", err))
+		}
+		if handler.Delete, err = cmd.Flags().GetBool("delete"); err != nil {
+			panic(fmt.Sprintf("decode flag --delete error: %v", err))
+		}
+		parseCopyFlags(cmd, handler)
+		handler.Filter = parseFilterFlags(cmd)
+		var stopControl func()
+		handler.Throttle, stopControl = parseThrottleFlags(cmd)
+		defer stopControl()
+		handler.Retry = parseRetryFlags(cmd)
+		var reportPath string
+		handler.Report, reportPath = parseReportFlags(cmd, "sync", sourcePath, targetPath)
+		log.Info("source path: %v, target path: %v, parallelism: %v", sourcePath, targetPath, handler.Parallelism)
+		startTime := time.Now().Unix()
+		ctx, stopSignal := signalContext()
+		defer stopSignal()
+		_, err = handler.CopyWithContext(ctx)
+		if refusedForSpace(err) {
+			return
+		}
+		canceled := errors.Is(err, context.Canceled)
+		noSpace := errors.Is(err, syscall.ENOSPC)
+		if err != nil && !canceled && !noSpace {
+			log.Warn("sync file error: %v", err)
+			return
+		}
+		logConflicts(handler)
+		logDedup(handler)
+		logFailures(handler.FailFiles)
+		writeReport(handler.Report, reportPath)
+		if canceled {
+			log.Warn("sync canceled, run again to continue, partial result:")
+		}
+		if noSpace {
+			log.Warn("sync stopped: %v, partial file removed, %v files (%v) done, free up space and run again with --resume to continue", err, handler.FileNumber, units.FormatSize(handler.CopiedBytes))
+		}
+		log.Info("sync process finish, copied: %v, skipped: %v, deleted: %v, failed: %v, changed while reading: %v cost time: %vs", handler.FileNumber, handler.SkipNumber, handler.DeleteNumber, len(handler.FailFiles), handler.ChangedNumber, time.Now().Unix()-startTime)
+	},
+	RunE:                       nil,
+	PostRun:                    nil,
+	PostRunE:                   nil,
+	PersistentPostRun:          nil,
+	PersistentPostRunE:         nil,
+	FParseErrWhitelist:         cobra.FParseErrWhitelist{},
+	CompletionOptions:          cobra.CompletionOptions{},
+	TraverseChildren:           false,
+	Hidden:                     false,
+	SilenceErrors:              false,
+	SilenceUsage:               false,
+	DisableFlagParsing:         false,
+	DisableAutoGenTag:          false,
+	DisableFlagsInUseLine:      false,
+	DisableSuggestions:         false,
+	SuggestionsMinimumDistance: 0,
+}
+
+var moveCmd = &cobra.Command{
+	Use:     fmt.Sprintf(CUT_OFF_COMMAND_PREFIX, "move"),
+	Aliases: []string{fmt.Sprintf(CUT_OFF_COMMAND_PREFIX, "move")},
+	Short:   "move files command, rename in the same filesystem, otherwise copy, verify and delete source",
+	Long:    "move files command, rename files when source and target share a filesystem, otherwise copy, verify and fsync every file before deleting its source, so an interruption never loses data",
+	Example: "co_move --s /mnt/a/data --t /mnt/b/data -p 8",
+	//Args:                       cobra.ExactArgs(),
+	ArgAliases: nil,
+	Run: func(cmd *cobra.Command, args []string) {
+		sourcePath := cmd.Flag("s").Value.String()
+		targetPath := cmd.Flag("t").Value.String()
+		parallelismNumber := getParallelism(cmd)
+		handler, err := copy2.Get(sourcePath, targetPath, parallelismNumber)
+		if err != nil {
+			log.Warn("init move env error: %v", err)
+			return
+		}
+		handler.Move = true
+		if handler.Resume, err = cmd.Flags().GetBool("resume"); err != nil {
+			panic(fmt.Sprintf("decode flag --resume error: %v", err))
+		}
+		handler.Verify = copy2.HashAlgorithm(cmd.Flag("verify").Value.String())
+		parseCopyFlags(cmd, handler)
+		handler.Filter = parseFilterFlags(cmd)
+		var stopControl func()
+		handler.Throttle, stopControl = parseThrottleFlags(cmd)
+		defer stopControl()
+		handler.Retry = parseRetryFlags(cmd)
+		var reportPath string
+		handler.Report, reportPath = parseReportFlags(cmd, "move", sourcePath, targetPath)
+		log.Info("source path: %v, target path: %v, parallelism: %v", sourcePath, targetPath, handler.Parallelism)
+		startTime := time.Now().Unix()
+		ctx, stopSignal := signalContext()
+		defer stopSignal()
+		_, err = handler.CopyWithContext(ctx)
+		if refusedForSpace(err) {
+			return
+		}
+		canceled := errors.Is(err, context.Canceled)
+		noSpace := errors.Is(err, syscall.ENOSPC)
+		if err != nil && !canceled && !noSpace {
+			log.Warn("move file error: %v", err)
+			return
+		}
+		logConflicts(handler)
+		logDedup(handler)
+		logFailures(handler.FailFiles)
+		writeReport(handler.Report, reportPath)
+		if canceled {
+			log.Warn("move canceled, source files not moved yet are kept, run again with --resume to continue, partial result:")
+		}
+		if noSpace {
+			log.Warn("move stopped: %v, partial file removed, %v files (%v) done, free up space and run again with --resume to continue", err, handler.FileNumber, units.FormatSize(handler.CopiedBytes))
+		}
+		log.Info("move process finish, dir: %v, files: %v, skipped: %v, failed: %v, changed while reading: %v, strategies: %v cost time: %vs", handler.DirNumber, handler.FileNumber, handler.SkipNumber, len(handler.FailFiles), handler.ChangedNumber, handler.Strategies, time.Now().Unix()-startTime)
 	},
 	RunE:                       nil,
 	PostRun:                    nil,
@@ -58,34 +293,46 @@ var compressCmd = &cobra.Command{
 	Aliases: []string{fmt.Sprintf(CUT_OFF_COMMAND_PREFIX, "compress")},
 	Short:   "compress files command, speed up compress process by multiple parallelism",
 	Long:    "compress files command, speed up compress process by multiple parallelism",
-	Example: "co_compress ./aa/ ./bb/ -parallelism 4",
+	Example: "co_compress ./aa/ ./bb/ -parallelism 4\nco_compress ./aa/ ./bb/ --format zstd\nco_compress --s ./aa/ --t ./bb/aa.tar.xz",
 	//Args:                       cobra.ExactArgs(),
 	ArgAliases: nil,
 	Run: func(cmd *cobra.Command, args []string) {
 		sourcePath := cmd.Flag("s").Value.String()
 		targetPath := cmd.Flag("t").Value.String()
-		parallelism := cmd.Flag("p").Value.String()
-		var parallelismNumber int = 0
-		var err error
-		if len(parallelism) > 0 {
-			parallelismNumber, err = strconv.Atoi(parallelism)
-			if err != nil {
-				panic(fmt.Sprintf("decode flag --p error: %v", err))
-			}
-		}
+		parallelismNumber := getParallelism(cmd)
 		handler, err := gzip.Get(sourcePath, targetPath, parallelismNumber, 0, true, true)
 		if err != nil {
 			log.Warn("init compress env error: %v", err)
 			return
 		}
+		// 没有指定格式时根据压缩包的扩展名选择，压缩包名称是生成的时候按照格式修改扩展名
+		handler.Format = compress.Format(cmd.Flag("format").Value.String())
+		if _, err := handler.ResolveFormat(); err != nil {
+			log.Warn("init compress env error: %v", err)
+			return
+		}
+		handler.Filter = parseFilterFlags(cmd)
+		handler.OnChange = paths.ChangePolicy(cmd.Flag("on-change").Value.String())
+		var stopControl func()
+		handler.Throttle, stopControl = parseThrottleFlags(cmd)
+		defer stopControl()
+		handler.Retry = parseRetryFlags(cmd)
+		var reportPath string
+		handler.Report, reportPath = parseReportFlags(cmd, "compress", handler.SourcePath, handler.TargetPath)
 		log.Info("source path: %v, target path: %v, parallelism: %v", sourcePath, targetPath, handler.Parallelism)
 		startTime := time.Now().Unix()
-		err = handler.Compress()
-		if err != nil {
+		ctx, stopSignal := signalContext()
+		defer stopSignal()
+		err = handler.CompressWithContext(ctx)
+		logFailures(handler.FailFiles)
+		writeReport(handler.Report, reportPath)
+		if errors.Is(err, context.Canceled) {
+			log.Warn("compress canceled, incomplete archive %v removed, partial result:", handler.TargetPath)
+		} else if err != nil {
 			log.Warn("compress file error: %v", err)
 			return
 		}
-		log.Info("compress process finish, dir: %v, files: %v cost time: %vs", handler.DirNum, handler.FileNum, time.Now().Unix()-startTime)
+		log.Info("compress process finish, format: %v, archive: %v, dir: %v, files: %v, changed while reading: %v cost time: %vs", handler.Format, handler.TargetPath, handler.DirNum, handler.FileNum, handler.ChangedNum, time.Now().Unix()-startTime)
 	},
 	RunE:                       nil,
 	PostRun:                    nil,
@@ -116,28 +363,44 @@ var decompressCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		sourcePath := cmd.Flag("s").Value.String()
 		targetPath := cmd.Flag("t").Value.String()
-		parallelism := cmd.Flag("p").Value.String()
-		var parallelismNumber int = 0
-		var err error
-		if len(parallelism) > 0 {
-			parallelismNumber, err = strconv.Atoi(parallelism)
-			if err != nil {
-				panic(fmt.Sprintf("decode flag --p error: %v", err))
-			}
-		}
+		parallelismNumber := getParallelism(cmd)
 		handler, err := gzip.Get(sourcePath, targetPath, parallelismNumber, 0, false, true)
 		if err != nil {
 			log.Warn("init decompress env error: %v", err)
 			return
 		}
+		if handler.Durable, err = cmd.Flags().GetBool("durable"); err != nil {
+			panic(fmt.Sprintf("decode flag --durable error: %v", err))
+		}
+		if handler.Force, err = cmd.Flags().GetBool("force"); err != nil {
+			panic(fmt.Sprintf("decode flag --force error: %v", err))
+		}
+		var stopControl func()
+		handler.Throttle, stopControl = parseThrottleFlags(cmd)
+		defer stopControl()
+		handler.Retry = parseRetryFlags(cmd)
+		var reportPath string
+		handler.Report, reportPath = parseReportFlags(cmd, "decompress", handler.SourcePath, handler.TargetPath)
 		log.Info("source path: %v, target path: %v, parallelism: %v", sourcePath, targetPath, handler.Parallelism)
 		startTime := time.Now().Unix()
-		err = handler.Decompress()
-		if err != nil {
+		ctx, stopSignal := signalContext()
+		defer stopSignal()
+		err = handler.DecompressWithContext(ctx)
+		if refusedForSpace(err) {
+			return
+		}
+		logFailures(handler.FailFiles)
+		writeReport(handler.Report, reportPath)
+		if errors.Is(err, context.Canceled) {
+			log.Warn("decompress canceled, partial result:")
+		} else if errors.Is(err, syscall.ENOSPC) {
+			log.Warn("decompress stopped: %v, partial file removed, %v files (%v) done", err, handler.FileNum, units.FormatSize(handler.DoneBytes))
+			return
+		} else if err != nil {
 			log.Warn("decompress file error: %v", err)
 			return
 		}
-		log.Info("decompress process finish, files: %v cost time: %vs", handler.FileNum, time.Now().Unix()-startTime)
+		log.Info("decompress process finish, format: %v, files: %v, dirs: %v cost time: %vs", handler.Format, handler.FileNum, handler.DirNum, time.Now().Unix()-startTime)
 	},
 	RunE:                       nil,
 	PostRun:                    nil,
@@ -156,3 +419,241 @@ var decompressCmd = &cobra.Command{
 	DisableSuggestions:         false,
 	SuggestionsMinimumDistance: 0,
 }
+
+func getParallelism(cmd *cobra.Command) int {
+	parallelism := cmd.Flag("p").Value.String()
+	if len(parallelism) == 0 {
+		return 0
+	}
+	parallelismNumber, err := strconv.Atoi(parallelism)
+	if err != nil {
+		panic(fmt.Sprintf("decode flag --p error: %v", err))
+	}
+	return parallelismNumber
+}
+
+// parseCopyFlags 解析 co_copy、co_sync 和 co_move 共用的参数
+func parseCopyFlags(cmd *cobra.Command, handler *copy2.CopyFiles) {
+	var err error
+	if handler.Preserve, err = copy2.ParsePreserve(cmd.Flag("preserve").Value.String()); err != nil {
+		panic(fmt.Sprintf("decode flag --preserve error: %v", err))
+	}
+	handler.Symlink = copy2.SymlinkPolicy(cmd.Flag("symlink").Value.String())
+	if handler.Hardlink, err = cmd.Flags().GetBool("hardlink"); err != nil {
+		panic(fmt.Sprintf("decode flag --hardlink error: %v", err))
+	}
+	if handler.ChunkThreshold, err = units.ParseSize(cmd.Flag("chunk-threshold").Value.String()); err != nil {
+		panic(fmt.Sprintf("decode flag --chunk-threshold error: %v", err))
+	}
+	if handler.ChunkSize, err = units.ParseSize(cmd.Flag("chunk-size").Value.String()); err != nil {
+		panic(fmt.Sprintf("decode flag --chunk-size error: %v", err))
+	}
+	if handler.ChunkRetry, err = cmd.Flags().GetInt("chunk-retry"); err != nil {
+		panic(fmt.Sprintf("decode flag --chunk-retry error: %v", err))
+	}
+	handler.OnChange = paths.ChangePolicy(cmd.Flag("on-change").Value.String())
+	handler.Dedup = copy2.DedupMode(cmd.Flag("dedup").Value.String())
+	handler.DedupIndex = cmd.Flag("dedup-index").Value.String()
+	handler.Conflict = copy2.ConflictPolicy(cmd.Flag("conflict").Value.String())
+	handler.BackupDir = cmd.Flag("backup-dir").Value.String()
+	if handler.Durable, err = cmd.Flags().GetBool("durable"); err != nil {
+		panic(fmt.Sprintf("decode flag --durable error: %v", err))
+	}
+	if handler.Force, err = cmd.Flags().GetBool("force"); err != nil {
+		panic(fmt.Sprintf("decode flag --force error: %v", err))
+	}
+}
+
+// refusedForSpace 目标的可用空间不够、没有开始时输出提示并返回 true
+func refusedForSpace(err error) bool {
+	var spaceErr *paths.SpaceError
+	if !errors.As(err, &spaceErr) {
+		return false
+	}
+	log.Warn("%v, free up space or run again with --force", err)
+	return true
+}
+
+// logConflicts 输出覆盖的目标数量和其他冲突处理结果
+func logConflicts(handler *copy2.CopyFiles) {
+	if handler.OverwriteNumber > 0 {
+		log.Info("%v existing targets overwritten", handler.OverwriteNumber)
+	}
+	for _, item := range handler.Conflicts {
+		if len(item.MovedTo) > 0 {
+			log.Info("conflict %v: %v, existing target moved to %v", item.TargetPath, item.Resolution, item.MovedTo)
+		} else {
+			log.Info("conflict %v: %v", item.TargetPath, item.Resolution)
+		}
+	}
+}
+
+// logDedup 开启去重时输出链接的重复文件数量和节省的空间
+func logDedup(handler *copy2.CopyFiles) {
+	if len(handler.Dedup) == 0 {
+		return
+	}
+	log.Info("dedup finish, %v duplicate files %v to existing copies, saved: %v", handler.DedupNumber, handler.Dedup, units.FormatSize(handler.DedupBytes))
+}
+
+// logFailures 输出每个失败的文件和失败原因
+func logFailures(failures []report.FailItem) {
+	for _, item := range failures {
+		log.Warn("failed %v [%v]: %v", item.Path, item.Type, item.Reason)
+	}
+}
+
+// parseRetryFlags 解析重试参数，--retry 小于等于 1 时返回 nil，不重试
+func parseRetryFlags(cmd *cobra.Command) *retry.Policy {
+	attempts, err := cmd.Flags().GetInt("retry")
+	if err != nil {
+		panic(fmt.Sprintf("decode flag --retry error: %v", err))
+	}
+	if attempts <= 1 {
+		return nil
+	}
+	policy := &retry.Policy{Attempts: attempts}
+	if policy.BaseDelay, err = cmd.Flags().GetDuration("retry-delay"); err != nil {
+		panic(fmt.Sprintf("decode flag --retry-delay error: %v", err))
+	}
+	if policy.MaxDelay, err = cmd.Flags().GetDuration("retry-max-delay"); err != nil {
+		panic(fmt.Sprintf("decode flag --retry-max-delay error: %v", err))
+	}
+	return policy
+}
+
+// parseReportFlags 设置了 --report 时返回需要记录的报告和保存路径，开始前检查报告格式
+func parseReportFlags(cmd *cobra.Command, name, sourcePath, targetPath string) (*report.Report, string) {
+	reportPath := cmd.Flag("report").Value.String()
+	if len(reportPath) == 0 {
+		return nil, ""
+	}
+	if _, err := report.FormatOf(reportPath); err != nil {
+		panic(fmt.Sprintf("decode flag --report error: %v", err))
+	}
+	return report.New(name, sourcePath, targetPath), reportPath
+}
+
+func writeReport(result *report.Report, reportPath string) {
+	if result == nil {
+		return
+	}
+	if err := result.Save(reportPath); err != nil {
+		log.Warn("save report error: %v", err)
+		return
+	}
+	log.Info("report saved to %v", reportPath)
+}
+
+// writePlan 按 --plan-format 输出 dry-run 生成的计划，设置了 --plan-out 时同时保存为 JSON
+func writePlan(cmd *cobra.Command, plan *copy2.Plan) {
+	var err error
+	switch format := cmd.Flag("plan-format").Value.String(); format {
+	case "table":
+		err = plan.WriteTable(os.Stdout)
+	case "json":
+		err = plan.WriteJSON(os.Stdout)
+	default:
+		panic(fmt.Sprintf("decode flag --plan-format error: unsupported format %v", format))
+	}
+	if err != nil {
+		log.Warn("write copy plan error: %v", err)
+		return
+	}
+	if planOut := cmd.Flag("plan-out").Value.String(); len(planOut) > 0 {
+		if err := plan.Save(planOut); err != nil {
+			log.Warn("save copy plan error: %v", err)
+			return
+		}
+		log.Info("copy plan saved to %v, run it by: co_copy --plan %v", planOut, planOut)
+	}
+}
+
+// parseThrottleFlags 解析限速参数，没有限速也没有控制 socket 时返回 nil。
+// 返回的函数关闭控制 socket
+func parseThrottleFlags(cmd *cobra.Command) (*throttle.Throttle, func()) {
+	bwlimit := cmd.Flag("bwlimit").Value.String()
+	control := cmd.Flag("control").Value.String()
+	fps, err := cmd.Flags().GetInt64("fps")
+	if err != nil {
+		panic(fmt.Sprintf("decode flag --fps error: %v", err))
+	}
+	if len(bwlimit) == 0 && fps <= 0 && len(control) == 0 {
+		return nil, func() {}
+	}
+	var rate int64
+	if len(bwlimit) > 0 {
+		if rate, err = units.ParseSize(bwlimit); err != nil {
+			panic(fmt.Sprintf("decode flag --bwlimit error: %v", err))
+		}
+	}
+	limiter := throttle.New(rate, rate, fps)
+	if len(control) == 0 {
+		return limiter, func() {}
+	}
+	stop, err := startControl(control, limiter)
+	if err != nil {
+		panic(fmt.Sprintf("decode flag --control error: %v", err))
+	}
+	return limiter, stop
+}
+
+// parseFilterFlags 解析过滤参数，没有设置任何过滤条件时返回 nil
+func parseFilterFlags(cmd *cobra.Command) *paths.Filter {
+	includes, _ := cmd.Flags().GetStringArray("include")
+	excludes, _ := cmd.Flags().GetStringArray("exclude")
+	excludeFromFiles, _ := cmd.Flags().GetStringArray("exclude-from")
+	ignoreFiles, _ := cmd.Flags().GetStringArray("ignore-file")
+	minSize := cmd.Flag("min-size").Value.String()
+	maxSize := cmd.Flag("max-size").Value.String()
+	newerThan := cmd.Flag("newer-than").Value.String()
+	olderThan := cmd.Flag("older-than").Value.String()
+	if len(includes) == 0 && len(excludes) == 0 && len(excludeFromFiles) == 0 && len(ignoreFiles) == 0 &&
+		len(minSize) == 0 && len(maxSize) == 0 && len(newerThan) == 0 && len(olderThan) == 0 {
+		return nil
+	}
+	filter, err := paths.NewFilter(includes, excludes)
+	if err != nil {
+		panic(fmt.Sprintf("decode flag --include/--exclude error: %v", err))
+	}
+	for _, excludeFrom := range excludeFromFiles {
+		if err := filter.AddExcludeFrom(excludeFrom); err != nil {
+			panic(fmt.Sprintf("decode flag --exclude-from error: %v", err))
+		}
+	}
+	filter.IgnoreFiles = ignoreFiles
+	if len(minSize) > 0 {
+		if filter.MinSize, err = units.ParseSize(minSize); err != nil {
+			panic(fmt.Sprintf("decode flag --min-size error: %v", err))
+		}
+	}
+	if len(maxSize) > 0 {
+		if filter.MaxSize, err = units.ParseSize(maxSize); err != nil {
+			panic(fmt.Sprintf("decode flag --max-size error: %v", err))
+		}
+	}
+	if len(newerThan) > 0 {
+		if filter.NewerThan, err = parseTime(newerThan); err != nil {
+			panic(fmt.Sprintf("decode flag --newer-than error: %v", err))
+		}
+	}
+	if len(olderThan) > 0 {
+		if filter.OlderThan, err = parseTime(olderThan); err != nil {
+			panic(fmt.Sprintf("decode flag --older-than error: %v", err))
+		}
+	}
+	return filter
+}
+
+// parseTime 支持 2006-01-02、2006-01-02 15:04:05 格式的时间，以及 24h 这样表示多久之前的时长
+func parseTime(value string) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if result, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return result, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %v", value)
+}
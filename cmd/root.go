@@ -4,8 +4,11 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	copy2 "go_tools/files/copy"
 	"go_tools/log"
+	"go_tools/paths"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -46,18 +49,121 @@ func init() {
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-	copyCmd.PersistentFlags().String("s", "", "source file/directory path")
-	copyCmd.PersistentFlags().String("t", "", "target file/directory path")
+	copyCmd.PersistentFlags().String("s", "", "source file/directory path, or local:, sftp:// and s3:// location")
+	copyCmd.PersistentFlags().String("t", "", "target file/directory path, or local:, sftp:// and s3:// location")
 	copyCmd.PersistentFlags().String("p", "", "copy parallelism")
+	copyCmd.PersistentFlags().Bool("resume", false, "skip files finished by the last interrupted copy and continue partial files")
+	copyCmd.PersistentFlags().String("verify", "", "verify copied files by hash: crc32c, sha256, blake3 or xxhash")
+	copyCmd.PersistentFlags().Lookup("verify").NoOptDefVal = string(copy2.HashXXHash)
+	copyCmd.PersistentFlags().Int("verify-retry", 0, "copy again when verify failed")
+	copyCmd.PersistentFlags().Bool("dry-run", false, "only print what would be done without touching the target path")
+	copyCmd.PersistentFlags().String("plan-format", "table", "dry-run plan output format: table or json")
+	copyCmd.PersistentFlags().String("plan-out", "", "save dry-run plan as json to this file")
+	copyCmd.PersistentFlags().String("plan", "", "execute a plan saved by --plan-out")
+	copyCmd.PersistentFlags().String("retry-failed", "", "only copy again the failures of a json report saved by --report")
+	addCopyFlags(copyCmd)
+	addFilterFlags(copyCmd)
+	addThrottleFlags(copyCmd)
+	addReportFlags(copyCmd)
+	addRetryFlags(copyCmd)
 	rootCmd.AddCommand(copyCmd)
 
+	syncCmd.PersistentFlags().String("s", "", "source file/directory path")
+	syncCmd.PersistentFlags().String("t", "", "target file/directory path")
+	syncCmd.PersistentFlags().String("p", "", "sync parallelism")
+	syncCmd.PersistentFlags().Bool("checksum", false, "compare content of files with same size and modify time")
+	syncCmd.PersistentFlags().Bool("delete", false, "delete target files which not exist in source path")
+	addCopyFlags(syncCmd)
+	addFilterFlags(syncCmd)
+	addThrottleFlags(syncCmd)
+	addReportFlags(syncCmd)
+	addRetryFlags(syncCmd)
+	rootCmd.AddCommand(syncCmd)
+
+	moveCmd.PersistentFlags().String("s", "", "source file/directory path")
+	moveCmd.PersistentFlags().String("t", "", "target file/directory path")
+	moveCmd.PersistentFlags().String("p", "", "move parallelism")
+	moveCmd.PersistentFlags().Bool("resume", false, "skip files finished by the last interrupted move and continue partial files")
+	moveCmd.PersistentFlags().String("verify", string(copy2.HashXXHash), "verify files copied across filesystems by hash before deleting source: crc32c, sha256, blake3 or xxhash")
+	addCopyFlags(moveCmd)
+	addFilterFlags(moveCmd)
+	addThrottleFlags(moveCmd)
+	addReportFlags(moveCmd)
+	addRetryFlags(moveCmd)
+	rootCmd.AddCommand(moveCmd)
+
 	compressCmd.PersistentFlags().String("s", "", "source file/directory path")
 	compressCmd.PersistentFlags().String("t", "", "target file/directory path")
 	compressCmd.PersistentFlags().String("p", "", "compress parallelism")
+	compressCmd.PersistentFlags().String("format", "", "compress format: gzip, zstd, xz, s2 or lz4, default by target extension or gzip")
+	addFilterFlags(compressCmd)
+	addChangeFlags(compressCmd)
+	addThrottleFlags(compressCmd)
+	addReportFlags(compressCmd)
+	addRetryFlags(compressCmd)
 	rootCmd.AddCommand(compressCmd)
 
 	decompressCmd.PersistentFlags().String("s", "", "source file/directory path")
 	decompressCmd.PersistentFlags().String("t", "", "target file/directory path")
 	decompressCmd.PersistentFlags().String("p", "", "decompress parallelism")
+	decompressCmd.PersistentFlags().Bool("durable", false, "fsync every file and its directory before and after renaming it into place")
+	decompressCmd.PersistentFlags().Bool("force", false, "start even if the target filesystem has less free space than the uncompressed size, read from zip and tar headers or the gzip trailer without decompressing; other formats skip the check")
+	addThrottleFlags(decompressCmd)
+	addReportFlags(decompressCmd)
+	addRetryFlags(decompressCmd)
 	rootCmd.AddCommand(decompressCmd)
 }
+
+// addCopyFlags co_copy、co_sync 和 co_move 共用的参数
+func addCopyFlags(command *cobra.Command) {
+	command.PersistentFlags().String("preserve", "", "preserve metadata after copy: mode,times,owner,xattr or all")
+	command.PersistentFlags().Lookup("preserve").NoOptDefVal = "all"
+	command.PersistentFlags().String("symlink", string(copy2.SymlinkCopyLink), "symlink policy: copy-link, follow or skip")
+	command.PersistentFlags().Bool("hardlink", true, "recreate hardlink groups as hardlinks at target")
+	addChangeFlags(command)
+	command.PersistentFlags().String("dedup", "", "copy identical content only once and link duplicates to the first copy: hardlink or reflink")
+	command.PersistentFlags().String("dedup-index", "", "content index reused by later copies into the same target, default <target>.co_copy.dedup")
+	command.PersistentFlags().String("chunk-threshold", "1G", "copy files larger than this size by parallel chunks, 0 to disable")
+	command.PersistentFlags().String("chunk-size", "64M", "chunk size of parallel chunk copy")
+	command.PersistentFlags().Int("chunk-retry", 3, "retry times of each failed chunk")
+	command.PersistentFlags().String("conflict", string(copy2.ConflictOverwrite), "policy for existing target: overwrite, skip, update-if-newer, rename-with-suffix, backup-to-dir or fail")
+	command.PersistentFlags().Bool("durable", false, "fsync every file and its directory before and after renaming it into place, and every resume checkpoint; without it resume survives process interruption but not power loss")
+	command.PersistentFlags().String("backup-dir", "", "backup directory of backup-to-dir conflict policy, default <target>.co_backup")
+	command.PersistentFlags().Bool("force", false, "start even if the target filesystem has less free space than the source")
+}
+
+// addChangeFlags 读取过程中源文件被修改时的处理策略
+func addChangeFlags(command *cobra.Command) {
+	command.PersistentFlags().String("on-change", string(paths.ChangeWarn), "policy for source files modified while reading: warn, retry or fail")
+}
+
+// addThrottleFlags 限速参数，所有并行的协程共享同一个限制
+func addThrottleFlags(command *cobra.Command) {
+	command.PersistentFlags().String("bwlimit", "", "limit both read and write bandwidth, e.g. 50M means 50MB/s")
+	command.PersistentFlags().Int64("fps", 0, "limit files handled per second, 0 means unlimited")
+	command.PersistentFlags().String("control", "", "unix socket path to adjust limits at runtime, e.g. echo \"bwlimit 20M\" | nc -U <path>")
+}
+
+// addReportFlags 结束后导出每个文件处理结果的报告
+func addReportFlags(command *cobra.Command) {
+	command.PersistentFlags().String("report", "", "export per-file report to this file, format by extension: .json, .csv or .html")
+}
+
+// addRetryFlags 暂时性 I/O 错误的重试参数
+func addRetryFlags(command *cobra.Command) {
+	command.PersistentFlags().Int("retry", 3, "attempts of files failed by transient I/O errors like EIO, ETIMEDOUT or ESTALE, 1 to disable retry")
+	command.PersistentFlags().Duration("retry-delay", time.Second, "delay before the first retry, doubled after each retry")
+	command.PersistentFlags().Duration("retry-max-delay", 30*time.Second, "max delay between retries")
+}
+
+// addFilterFlags co_copy、co_sync 和 co_compress 共用的过滤参数
+func addFilterFlags(command *cobra.Command) {
+	command.PersistentFlags().StringArray("include", nil, "only handle files matching this glob, can be repeated")
+	command.PersistentFlags().StringArray("exclude", nil, "skip files and directories matching this .gitignore style pattern, can be repeated")
+	command.PersistentFlags().StringArray("exclude-from", nil, "read exclude patterns from this .gitignore style file, can be repeated")
+	command.PersistentFlags().StringArray("ignore-file", nil, "read exclude patterns from this file name in every directory, e.g. .gitignore")
+	command.PersistentFlags().String("min-size", "", "skip files smaller than this size, e.g. 10K")
+	command.PersistentFlags().String("max-size", "", "skip files larger than this size, e.g. 1G")
+	command.PersistentFlags().String("newer-than", "", "only handle files modified after this date (2006-01-02) or duration ago (24h)")
+	command.PersistentFlags().String("older-than", "", "only handle files modified before this date (2006-01-02) or duration ago (24h)")
+}
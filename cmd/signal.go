@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"context"
+	"go_tools/log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// signalContext 第一次收到 Ctrl-C 或者 SIGTERM 时取消返回的 ctx，不再开始新的文件并输出已经完成部分的报告，
+// 第二次收到时直接退出。返回的函数停止监听信号
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warn("received %v, stopping after in-flight files, press Ctrl-C again to force exit", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			log.Warn("force exit")
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,278 @@
+package compress
+
+import (
+	"compress/bzip2"
+	"fmt"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+	"io"
+	"sort"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatGzip  Format = "gzip"  // pgzip 多协程压缩和解压
+	FormatZstd  Format = "zstd"  // 多协程压缩，压缩率和速度都比 gzip 好
+	FormatXz    Format = "xz"    // 单协程，压缩率最高，速度最慢
+	FormatS2    Format = "s2"    // snappy 的扩展，多协程压缩，速度最快，压缩率最低
+	FormatLz4   Format = "lz4"   // lz4 帧格式，多协程压缩和解压，速度接近 s2
+	FormatBzip2 Format = "bzip2" // 只能解压
+	FormatTar   Format = "tar"   // 不压缩的 tar
+	// zip 自己包含目录结构，不是 tar 流的压缩格式，只能解压
+	FormatZip Format = "zip"
+)
+
+// Options 创建压缩和解压流的参数，不支持的格式忽略对应的参数
+type Options struct {
+	Parallelism int   // 压缩或解压使用的协程数量
+	BlockSize   int64 // 每个协程一次压缩的数据大小
+	// 写入压缩流头部的注释，只有 gzip 支持
+	Comment string
+}
+
+// Codec 一种压缩格式，把 tar 流压缩成压缩包或者从压缩包中读出 tar 流
+type Codec interface {
+	Format() Format
+	// Extensions 压缩包的扩展名，第一个是生成压缩包名称时使用的默认扩展名
+	Extensions() []string
+	// NewWriter Close 时写入压缩流的结尾，不会关闭 writer
+	NewWriter(writer io.Writer, options Options) (io.WriteCloser, error)
+	// NewReader Close 时释放解压使用的资源，不会关闭 reader
+	NewReader(reader io.Reader, options Options) (io.ReadCloser, error)
+}
+
+var codecs = map[Format]Codec{
+	FormatGzip:  gzipCodec{},
+	FormatZstd:  zstdCodec{},
+	FormatXz:    xzCodec{},
+	FormatS2:    s2Codec{},
+	FormatLz4:   lz4Codec{},
+	FormatBzip2: bzip2Codec{},
+	FormatTar:   tarCodec{},
+}
+
+// Formats 返回所有支持的格式名称
+func Formats() []string {
+	formats := make([]string, 0, len(codecs))
+	for format := range codecs {
+		formats = append(formats, string(format))
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// ForFormat 返回格式对应的 Codec
+func ForFormat(format Format) (Codec, error) {
+	codec, ok := codecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown compress format %v, supported: %v", format, strings.Join(Formats(), ", "))
+	}
+	return codec, nil
+}
+
+// ForPath 根据压缩包的扩展名返回 Codec，不能识别时返回 false
+func ForPath(path string) (Codec, bool) {
+	name := strings.ToLower(path)
+	var result Codec
+	longest := 0
+	// .tar.gz 和 .gz 这样的扩展名都能匹配时使用更长的
+	for _, codec := range codecs {
+		for _, extension := range codec.Extensions() {
+			if strings.HasSuffix(name, extension) && len(extension) > longest {
+				result, longest = codec, len(extension)
+			}
+		}
+	}
+	return result, result != nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Format() Format {
+	return FormatGzip
+}
+
+func (gzipCodec) Extensions() []string {
+	return []string{".tar.gz", ".tgz", ".gz"}
+}
+
+func (gzipCodec) NewWriter(writer io.Writer, options Options) (io.WriteCloser, error) {
+	gzWriter := pgzip.NewWriter(writer)
+	if options.Parallelism > 0 && options.BlockSize > 0 {
+		if err := gzWriter.SetConcurrency(int(options.BlockSize), options.Parallelism); err != nil {
+			return nil, errors.Wrap(err, "set gzip concurrency error")
+		}
+	}
+	gzWriter.Comment = options.Comment
+	return gzWriter, nil
+}
+
+func (gzipCodec) NewReader(reader io.Reader, options Options) (io.ReadCloser, error) {
+	gzReader, err := pgzip.NewReader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "create gzip reader error")
+	}
+	return gzReader, nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Format() Format {
+	return FormatZstd
+}
+
+func (zstdCodec) Extensions() []string {
+	return []string{".tar.zst", ".tzst", ".zst"}
+}
+
+func (zstdCodec) NewWriter(writer io.Writer, options Options) (io.WriteCloser, error) {
+	var zstdOptions []zstd.EOption
+	if options.Parallelism > 0 {
+		zstdOptions = append(zstdOptions, zstd.WithEncoderConcurrency(options.Parallelism))
+	}
+	encoder, err := zstd.NewWriter(writer, zstdOptions...)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd writer error")
+	}
+	return encoder, nil
+}
+
+func (zstdCodec) NewReader(reader io.Reader, options Options) (io.ReadCloser, error) {
+	var zstdOptions []zstd.DOption
+	if options.Parallelism > 0 {
+		zstdOptions = append(zstdOptions, zstd.WithDecoderConcurrency(options.Parallelism))
+	}
+	decoder, err := zstd.NewReader(reader, zstdOptions...)
+	if err != nil {
+		return nil, errors.Wrap(err, "create zstd reader error")
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+type xzCodec struct{}
+
+func (xzCodec) Format() Format {
+	return FormatXz
+}
+
+func (xzCodec) Extensions() []string {
+	return []string{".tar.xz", ".txz", ".xz"}
+}
+
+func (xzCodec) NewWriter(writer io.Writer, options Options) (io.WriteCloser, error) {
+	xzWriter, err := xz.NewWriter(writer)
+	if err != nil {
+		return nil, errors.Wrap(err, "create xz writer error")
+	}
+	return xzWriter, nil
+}
+
+func (xzCodec) NewReader(reader io.Reader, options Options) (io.ReadCloser, error) {
+	xzReader, err := xz.NewReader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "create xz reader error")
+	}
+	return io.NopCloser(xzReader), nil
+}
+
+type s2Codec struct{}
+
+func (s2Codec) Format() Format {
+	return FormatS2
+}
+
+func (s2Codec) Extensions() []string {
+	return []string{".tar.s2", ".s2"}
+}
+
+func (s2Codec) NewWriter(writer io.Writer, options Options) (io.WriteCloser, error) {
+	var s2Options []s2.WriterOption
+	if options.Parallelism > 0 {
+		s2Options = append(s2Options, s2.WriterConcurrency(options.Parallelism))
+	}
+	return s2.NewWriter(writer, s2Options...), nil
+}
+
+func (s2Codec) NewReader(reader io.Reader, options Options) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(reader)), nil
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) Format() Format {
+	return FormatLz4
+}
+
+func (lz4Codec) Extensions() []string {
+	return []string{".tar.lz4", ".lz4"}
+}
+
+func (lz4Codec) NewWriter(writer io.Writer, options Options) (io.WriteCloser, error) {
+	lz4Writer := lz4.NewWriter(writer)
+	if options.Parallelism > 0 {
+		if err := lz4Writer.Apply(lz4.ConcurrencyOption(options.Parallelism)); err != nil {
+			return nil, errors.Wrap(err, "set lz4 concurrency error")
+		}
+	}
+	return lz4Writer, nil
+}
+
+func (lz4Codec) NewReader(reader io.Reader, options Options) (io.ReadCloser, error) {
+	lz4Reader := lz4.NewReader(reader)
+	if options.Parallelism > 0 {
+		if err := lz4Reader.Apply(lz4.ConcurrencyOption(options.Parallelism)); err != nil {
+			return nil, errors.Wrap(err, "set lz4 concurrency error")
+		}
+	}
+	return io.NopCloser(lz4Reader), nil
+}
+
+type bzip2Codec struct{}
+
+func (bzip2Codec) Format() Format {
+	return FormatBzip2
+}
+
+func (bzip2Codec) Extensions() []string {
+	return []string{".tar.bz2", ".tbz2", ".bz2"}
+}
+
+func (bzip2Codec) NewWriter(writer io.Writer, options Options) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("compress format %v is read-only, choose another format", FormatBzip2)
+}
+
+func (bzip2Codec) NewReader(reader io.Reader, options Options) (io.ReadCloser, error) {
+	return io.NopCloser(bzip2.NewReader(reader)), nil
+}
+
+type tarCodec struct{}
+
+func (tarCodec) Format() Format {
+	return FormatTar
+}
+
+func (tarCodec) Extensions() []string {
+	return []string{".tar"}
+}
+
+func (tarCodec) NewWriter(writer io.Writer, options Options) (io.WriteCloser, error) {
+	return nopWriteCloser{Writer: writer}, nil
+}
+
+func (tarCodec) NewReader(reader io.Reader, options Options) (io.ReadCloser, error) {
+	return io.NopCloser(reader), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HeaderSize 识别格式需要读取的开头字节数，tar 的第一个文件头有 512 字节
+const HeaderSize = 512
+
+// UnsupportedError 数据的格式不能解压，Detected 是识别出的格式名称
+type UnsupportedError struct {
+	Detected string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported archive format: detected %v", e.Detected)
+}
+
+type magic struct {
+	prefix string
+	format Format
+	name   string // 不支持的格式名称
+}
+
+var magics = []magic{
+	{prefix: "\x1f\x8b", format: FormatGzip},
+	{prefix: "\x28\xb5\x2f\xfd", format: FormatZstd},
+	{prefix: "\xfd7zXZ\x00", format: FormatXz},
+	{prefix: "BZh", format: FormatBzip2},
+	{prefix: "\x04\x22\x4d\x18", format: FormatLz4},
+	{prefix: "\xff\x06\x00\x00S2sTwO", format: FormatS2},
+	// s2 也可以读取 snappy 的分帧格式
+	{prefix: "\xff\x06\x00\x00sNaPpY", format: FormatS2},
+	{prefix: "PK\x03\x04", format: FormatZip},
+	{prefix: "PK\x05\x06", format: FormatZip}, // 空的 zip
+	{prefix: "7z\xbc\xaf\x27\x1c", name: "7z"},
+	{prefix: "Rar!\x1a\x07", name: "rar"},
+	{prefix: "LZIP", name: "lzip"},
+	{prefix: "\x1f\x9d", name: "compress (.Z)"},
+	{prefix: "!<arch>\n", name: "ar"},
+}
+
+// Detect 根据数据开头的魔数识别格式，header 不足 HeaderSize 字节时不能识别 tar。
+// 能识别但是不能解压的格式和不能识别的数据返回 *UnsupportedError
+func Detect(header []byte) (Format, error) {
+	if len(header) == 0 {
+		return "", &UnsupportedError{Detected: "empty file"}
+	}
+	for _, item := range magics {
+		if !bytes.HasPrefix(header, []byte(item.prefix)) {
+			continue
+		}
+		if len(item.format) == 0 {
+			return "", &UnsupportedError{Detected: item.name}
+		}
+		return item.format, nil
+	}
+	if IsTar(header) {
+		return FormatTar, nil
+	}
+	prefix := header
+	if len(prefix) > 8 {
+		prefix = prefix[:8]
+	}
+	return "", &UnsupportedError{Detected: fmt.Sprintf("unknown data starting with % x", prefix)}
+}
+
+// IsTar block 是否是 tar 的文件头：有 ustar 标记，或者是校验和正确的旧格式文件头
+func IsTar(block []byte) bool {
+	if len(block) < HeaderSize {
+		return false
+	}
+	if string(block[257:262]) == "ustar" {
+		return true
+	}
+	// 没有文件的 tar 只有全部是 0 的结尾块
+	if bytes.Count(block[:HeaderSize], []byte{0}) == HeaderSize {
+		return true
+	}
+	// 校验和是文件头所有字节的和，计算时校验和字段本身按照空格计算
+	recorded, err := strconv.ParseInt(strings.Trim(string(block[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum int64
+	for i, b := range block[:HeaderSize] {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	return sum == recorded
+}
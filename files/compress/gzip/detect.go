@@ -0,0 +1,179 @@
+package gzip
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"github.com/pkg/errors"
+	"go_tools/files/compress"
+	"go_tools/log"
+	"go_tools/storage"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveKind 解压时识别出的压缩包结构
+type archiveKind string
+
+const (
+	kindTar  archiveKind = "tar"  // tar 归档，可能经过压缩
+	kindFile archiveKind = "file" // 没有 tar 的单个压缩文件
+	kindZip  archiveKind = "zip"
+)
+
+// archiveStream 识别出结构后的压缩包
+type archiveStream struct {
+	kind archiveKind
+	// 解压后的 tar 流或者单个文件的内容，zip 为空
+	reader io.Reader
+	zip    *zip.Reader
+	closer io.Closer
+}
+
+func (s *archiveStream) close() {
+	if s.closer == nil {
+		return
+	}
+	if err := s.closer.Close(); err != nil {
+		log.Debug("close decompress stream error: %v", err)
+	}
+}
+
+// openStream 根据压缩包开头的魔数而不是扩展名选择解压流程，Format 不为空时按照 Format 解压。
+// 解压后的内容以 tar 文件头开始时按照 tar 解压，否则作为单个压缩文件解压。
+// sourceFile 是打开的压缩包，zip 需要随机读取；reader 是从 sourceFile 顺序读取的流
+func (g *GzipInfo) openStream(sourceFile io.Reader, reader io.Reader, size int64) (*archiveStream, error) {
+	buffered := bufio.NewReaderSize(reader, compress.HeaderSize)
+	header, err := buffered.Peek(compress.HeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "read source file %v error", g.SourcePath)
+	}
+	if len(g.Format) == 0 {
+		if g.Format, err = compress.Detect(header); err != nil {
+			return nil, errors.Wrapf(err, "decompress %v error", g.SourcePath)
+		}
+	}
+	if g.Format == compress.FormatZip {
+		zipReader, err := g.openZip(sourceFile, buffered, size)
+		if err != nil {
+			return nil, err
+		}
+		return &archiveStream{kind: kindZip, zip: zipReader}, nil
+	}
+	codec, err := compress.ForFormat(g.Format)
+	if err != nil {
+		return nil, err
+	}
+	decompressor, err := codec.NewReader(buffered, g.codecOptions(""))
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %v archive %v error", g.Format, g.SourcePath)
+	}
+	stream := &archiveStream{kind: kindFile, closer: decompressor}
+	content := bufio.NewReaderSize(decompressor, compress.HeaderSize)
+	block, err := content.Peek(compress.HeaderSize)
+	if err != nil && err != io.EOF {
+		stream.close()
+		return nil, errors.Wrapf(err, "read %v archive %v error", g.Format, g.SourcePath)
+	}
+	if compress.IsTar(block) {
+		stream.kind = kindTar
+	}
+	stream.reader = content
+	return stream, nil
+}
+
+// openZip zip 的目录在文件末尾，需要随机读取，不能随机读取的存储先把整个压缩包读到内存中
+func (g *GzipInfo) openZip(sourceFile io.Reader, reader io.Reader, size int64) (*zip.Reader, error) {
+	readerAt, ok := sourceFile.(io.ReaderAt)
+	if !ok {
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read source file %v error", g.SourcePath)
+		}
+		readerAt, size = bytes.NewReader(content), int64(len(content))
+	}
+	zipReader, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open zip archive %v error", g.SourcePath)
+	}
+	return zipReader, nil
+}
+
+// extractZip 按照 zip 中记录的顺序解压，进度按照已经解压的文件压缩后的大小统计
+func (g *GzipInfo) extractZip(zipReader *zip.Reader) error {
+	target := g.target()
+	tracker := g.Progress.Track()
+	var done int64
+	for _, file := range zipReader.File {
+		if g.ctx.Err() != nil {
+			break
+		}
+		info := file.FileInfo()
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			log.Warn("skip %v, %v entry is not supported", file.Name, info.Mode().Type())
+			continue
+		}
+		entry := &zipEntry{file: file}
+		stop, err := g.extractEntry(entry, target, file.Name, info.IsDir())
+		if closeErr := entry.Close(); closeErr != nil {
+			log.Debug("close zip entry %v error: %v", file.Name, closeErr)
+		}
+		done += int64(file.CompressedSize64)
+		tracker.Set(done)
+		if stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipEntry 第一次读取时才打开 zip 中的文件，打开的错误和读取的错误一样处理
+type zipEntry struct {
+	file   *zip.File
+	reader io.ReadCloser
+}
+
+func (e *zipEntry) Read(p []byte) (int, error) {
+	if e.reader == nil {
+		reader, err := e.file.Open()
+		if err != nil {
+			return 0, err
+		}
+		e.reader = reader
+	}
+	return e.reader.Read(p)
+}
+
+func (e *zipEntry) Close() error {
+	if e.reader == nil {
+		return nil
+	}
+	return e.reader.Close()
+}
+
+// extractSingle 没有 tar 的单个压缩文件解压成一个文件
+func (g *GzipInfo) extractSingle(reader io.Reader) error {
+	target := g.target()
+	_, err := g.extractEntry(reader, target, g.singlePath(target), false)
+	return err
+}
+
+// singlePath 单个压缩文件解压后的路径：目标是已经存在的目录时解压到其中去掉压缩扩展名的同名文件，否则解压到目标路径本身
+func (g *GzipInfo) singlePath(target storage.Storage) string {
+	info, err := target.Stat("")
+	if err != nil || !info.IsDir {
+		return ""
+	}
+	name := path.Base(filepath.ToSlash(storage.LocalPath(g.SourcePath)))
+	if codec, err := compress.ForFormat(g.Format); err == nil {
+		for _, extension := range codec.Extensions() {
+			if strings.HasSuffix(strings.ToLower(name), extension) && len(name) > len(extension) {
+				return name[:len(name)-len(extension)]
+			}
+		}
+	}
+	// 没有压缩扩展名时不能和压缩包同名
+	return name + ".out"
+}
@@ -2,47 +2,95 @@ package gzip
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/binary"
 	"fmt"
-	"github.com/klauspost/pgzip"
 	"github.com/pkg/errors"
+	"go_tools/files/compress"
 	"go_tools/log"
 	"go_tools/paths"
+	"go_tools/progress"
+	"go_tools/report"
+	"go_tools/retry"
+	"go_tools/storage"
+	"go_tools/throttle"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// GzipInfo 压缩和解压 tar 归档，tar 流的压缩格式由 Format 决定，默认 gzip
 type GzipInfo struct {
-	SourcePath       string   `json:"source_path"`
-	TargetPath       string   `json:"target_path"`
-	Parallelism      int      `json:"parallelism"`
-	BlockSize        int64    `json:"block_size"`
-	IsCompress       bool     `json:"is_compress"`
-	IsDir            bool     `json:"is_dir"`
-	IgnoreFailedFile bool     `json:"ignore_failed_file"`
-	DirNum           int64    `json:"dir_num"`
-	FileNum          int64    `json:"file_num"`
-	FailFiles        []string `json:"fail_files"`
+	SourcePath       string            `json:"source_path"`
+	TargetPath       string            `json:"target_path"`
+	Parallelism      int               `json:"parallelism"`
+	BlockSize        int64             `json:"block_size"`
+	IsCompress       bool              `json:"is_compress"`
+	IsDir            bool              `json:"is_dir"`
+	IgnoreFailedFile bool              `json:"ignore_failed_file"`
+	DirNum           int64             `json:"dir_num"`
+	FileNum          int64             `json:"file_num"`
+	FailFiles        []report.FailItem `json:"fail_files"`
+	// 压缩目录时的过滤规则，为空时压缩所有文件
+	Filter *paths.Filter `json:"filter"`
+	// 解压的文件先写入隐藏临时文件再 rename，Durable 时 rename 前后 fsync 文件和目录
+	Durable bool `json:"durable"`
+	// 字节级进度，为空时创建一个输出到标准错误的进度
+	Progress *progress.Progress `json:"-"`
+	// 读写带宽和每秒文件数限制，为空时不限制
+	Throttle *throttle.Throttle `json:"-"`
+	// 每个文件的处理结果和失败原因，为空时不记录
+	Report *report.Report `json:"-"`
+	// 读写遇到暂时性 I/O 错误时的重试策略，为空时不重试
+	Retry *retry.Policy `json:"retry"`
+	// 压缩过程中源文件被修改时的处理策略，为空时按照 warn 处理。压缩包中已经写入的内容不能删除，
+	// retry 时再次写入同名的文件，fail 时这个文件的内容仍然在压缩包中，但是记录为失败
+	OnChange   paths.ChangePolicy `json:"on_change"`
+	ChangedNum int64              `json:"changed_num"` // 压缩过程中被修改、按照 warn 策略保留了内容的文件数量
+	// 解压前不检查解压后的总大小是否超过目标的可用空间
+	Force     bool  `json:"force"`
+	DoneBytes int64 `json:"done_bytes"` // 已经完整写入压缩包或者解压到目标的文件大小之和
+	// 压缩格式。压缩时为空则根据压缩包的扩展名选择，不能识别时使用 gzip；
+	// 解压时为空则根据压缩包开头的魔数识别，识别出的格式记录在这里
+	Format compress.Format `json:"format"`
+	codec  compress.Codec
+	// 压缩包名称是根据源路径生成的，选择格式后修改扩展名
+	defaultTarget bool
+	// 源和目标所在的存储，为空时使用本地的 SourcePath 和 TargetPath。压缩时目标存储的根路径是压缩包，解压时是解压目录
+	SourceStorage storage.Storage `json:"-"`
+	TargetStorage storage.Storage `json:"-"`
+	ctx           context.Context
 }
 
+// brokenError 保留读取源文件的原始错误，同时可以用 errArchiveBroken 判断
+type brokenError struct {
+	error
+}
+
+func (e *brokenError) Is(target error) bool {
+	return target == errArchiveBroken
+}
+
+func (e *brokenError) Unwrap() error {
+	return e.error
+}
+
+// changeRetry retry 策略下源文件在压缩过程中被修改后重新写入的次数
+const changeRetry = 3
+
+// errArchiveBroken 文件头写入后读取源文件出错，压缩包中这个文件的内容不完整，即使 IgnoreFailedFile 也不能跳过这个文件继续压缩
+var errArchiveBroken = errors.New("archive is broken")
+
+// defaultExtension 生成压缩包名称时使用的扩展名，选择其他格式后替换
+const defaultExtension = ".tar.gz"
+
 func Get(sourcePath string, targetPath string, parallelism int, blockSize int64, isCompress, ignoreFailedFile bool) (result *GzipInfo, err error) {
-	if parallelism <= 0 {
-		parallelism = runtime.NumCPU()
-	}
-	if blockSize <= 0 {
-		blockSize = 10 * 1024 * 1024
-	}
-	result = &GzipInfo{
-		SourcePath:       "",
-		TargetPath:       "",
-		Parallelism:      parallelism,
-		BlockSize:        blockSize,
-		IsCompress:       isCompress,
-		IgnoreFailedFile: ignoreFailedFile,
-	}
+	result = newGzipInfo(parallelism, blockSize, isCompress, ignoreFailedFile)
 	if len(sourcePath) == 0 {
 		return nil, errors.New("source path is empty")
 	}
@@ -67,17 +115,20 @@ func Get(sourcePath string, targetPath string, parallelism int, blockSize int64,
 	if len(targetPath) == 0 {
 		targetPath = "./"
 	}
+	// 以分隔符结尾或者已经存在的目录是压缩包所在的目录，格式化后就没有结尾的分隔符了
+	targetIsDir := strings.HasSuffix(targetPath, "/") || strings.HasSuffix(targetPath, string(filepath.Separator))
 	if targetPath, err = filepath.Abs(targetPath); err != nil {
 		return nil, errors.Wrap(err, "format target path error")
 	} else {
-		if paths.IsDir(targetPath) { // target 是目录
+		if info, err := os.Stat(targetPath); targetIsDir || paths.IsDir(targetPath) || err == nil && info.IsDir() { // target 是目录
 			if isCompress {
 				if result.IsDir {
-					targetPath = filepath.Join(targetPath, "target.tar.gz") // 默认压缩包名称
+					targetPath = filepath.Join(targetPath, "target"+defaultExtension) // 默认压缩包名称
 				} else {
 					_, sourceFileName := filepath.Split(result.SourcePath)
-					targetPath = filepath.Join(targetPath, fmt.Sprintf("%v.tar.gz", strings.Split(sourceFileName, ".")[0]))
+					targetPath = filepath.Join(targetPath, strings.Split(sourceFileName, ".")[0]+defaultExtension)
 				}
+				result.defaultTarget = true
 			}
 		}
 		result.TargetPath = targetPath
@@ -86,67 +137,204 @@ func Get(sourcePath string, targetPath string, parallelism int, blockSize int64,
 	return result, nil
 }
 
+// GetWithStorage 在存储之间压缩或者解压，source 的根路径是需要压缩的文件、目录或者压缩包，
+// 压缩时 target 的根路径是压缩包，解压时是解压目录
+func GetWithStorage(source, target storage.Storage, parallelism int, blockSize int64, isCompress, ignoreFailedFile bool) (*GzipInfo, error) {
+	sourceInfo, err := source.Stat("")
+	if err != nil {
+		return nil, errors.Wrap(err, "get source path info error")
+	}
+	if !isCompress && sourceInfo.IsDir {
+		return nil, errors.New("source file is directory")
+	}
+	result := newGzipInfo(parallelism, blockSize, isCompress, ignoreFailedFile)
+	result.SourcePath = source.String()
+	result.TargetPath = target.String()
+	result.IsDir = sourceInfo.IsDir
+	result.SourceStorage = source
+	result.TargetStorage = target
+	return result, nil
+}
+
+func newGzipInfo(parallelism int, blockSize int64, isCompress, ignoreFailedFile bool) *GzipInfo {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	if blockSize <= 0 {
+		blockSize = 10 * 1024 * 1024
+	}
+	return &GzipInfo{
+		Parallelism:      parallelism,
+		BlockSize:        blockSize,
+		IsCompress:       isCompress,
+		IgnoreFailedFile: ignoreFailedFile,
+		FailFiles:        []report.FailItem{},
+	}
+}
+
+// source 返回源路径所在的存储，没有传入时使用本地路径
+func (g *GzipInfo) source() storage.Storage {
+	if g.SourceStorage != nil {
+		return g.SourceStorage
+	}
+	return &storage.Local{Root: g.SourcePath}
+}
+
+// target 返回目标路径所在的存储，没有传入时使用本地路径
+func (g *GzipInfo) target() storage.Storage {
+	if g.TargetStorage != nil {
+		return g.TargetStorage
+	}
+	return &storage.Local{Root: g.TargetPath, Durable: g.Durable}
+}
+
+// ResolveFormat 选择压缩时使用的格式：优先使用 Format，为空时根据压缩包的扩展名选择，不能识别时使用 gzip。
+// 压缩包名称是生成的时候按照格式修改扩展名。解压时根据压缩包开头的魔数识别格式，不使用扩展名
+func (g *GzipInfo) ResolveFormat() (compress.Codec, error) {
+	var err error
+	var codec compress.Codec
+	if len(g.Format) > 0 {
+		if codec, err = compress.ForFormat(g.Format); err != nil {
+			return nil, err
+		}
+	} else if detected, ok := compress.ForPath(g.TargetPath); ok {
+		codec = detected
+	} else if codec, err = compress.ForFormat(compress.FormatGzip); err != nil {
+		return nil, err
+	}
+	if g.defaultTarget {
+		g.TargetPath = strings.TrimSuffix(g.TargetPath, defaultExtension) + codec.Extensions()[0]
+		g.defaultTarget = false
+	}
+	g.Format = codec.Format()
+	g.codec = codec
+	return codec, nil
+}
+
+// codecOptions 压缩和解压流使用的并行参数
+func (g *GzipInfo) codecOptions(comment string) compress.Options {
+	return compress.Options{
+		Parallelism: g.Parallelism,
+		BlockSize:   g.BlockSize,
+		Comment:     comment,
+	}
+}
+
 func (g *GzipInfo) Compress() error {
-	// file write
-	fw, err := paths.CreateFile(g.TargetPath)
+	return g.CompressWithContext(context.Background())
+}
+
+// CompressWithContext ctx 取消后停止压缩，没有写完的压缩包不会出现在目标路径，返回取消的原因
+func (g *GzipInfo) CompressWithContext(ctx context.Context) error {
+	g.ctx = ctx
+	if len(g.OnChange) > 0 {
+		if err := paths.CheckChangePolicy(g.OnChange); err != nil {
+			return err
+		}
+	}
+	if _, err := g.ResolveFormat(); err != nil {
+		return err
+	}
+	err := g.compress()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	g.Report.Finish(g.FailFiles, err)
+	return err
+}
+
+// compress 压缩包先写入临时位置，全部写完后才提交到目标路径，出错时丢弃
+func (g *GzipInfo) compress() error {
+	archive, err := g.target().Create("")
 	if err != nil {
-		panic(err)
+		return errors.Wrapf(err, "create target file %v error", g.TargetPath)
 	}
+	committed := false
 	defer func() {
-		if err := fw.Close(); err != nil {
-			log.Debug("close target file error")
+		if committed {
+			return
 		}
-	}()
-	gzWriter := pgzip.NewWriter(fw)
-	defer func() {
-		if err := gzWriter.Close(); err != nil {
-			log.Debug("close gzip writer error")
+		if err := archive.Abort(); err != nil {
+			log.Debug("abort target file %v error: %v", g.TargetPath, err)
 		}
 	}()
-	gzWriter.Comment = "file"
+	comment := "file"
 	if g.IsDir {
-		gzWriter.Comment = "dir"
+		comment = "dir"
+	}
+	compressor, err := g.codec.NewWriter(g.Throttle.Writer(g.Retry.Writer(g.ctx, archive)), g.codecOptions(comment))
+	if err != nil {
+		return errors.Wrapf(err, "create %v writer error", g.Format)
 	}
 	// tar write
-	tarWriter := tar.NewWriter(gzWriter)
-	defer func() {
-		if err := tarWriter.Close(); err != nil {
-			log.Debug("close tar writer error")
-		}
-	}()
+	tarWriter := tar.NewWriter(compressor)
+	if err := g.writeArchive(tarWriter); err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return errors.Wrap(err, "close tar writer error")
+	}
+	if err := compressor.Close(); err != nil {
+		return errors.Wrapf(err, "close %v writer error", g.Format)
+	}
+	if err := g.ctx.Err(); err != nil {
+		return err
+	}
+	committed = true
+	return archive.Commit()
+}
+
+// writeArchive 把源路径中的文件写入压缩包
+func (g *GzipInfo) writeArchive(tarWriter *tar.Writer) error {
+	if g.Progress == nil {
+		g.Progress = progress.Default("compress")
+	}
 	if g.IsDir {
-		ticker := time.NewTicker(time.Second * 3)
-		go func() {
-			for {
-				<-ticker.C
-				log.Info("compress success dir number: %v && file number: %v, failed number: %v", g.DirNum, g.FileNum, len(g.FailFiles))
-			}
-		}()
-		_, err := paths.DoIterPath(g.SourcePath, func(fileInfo *paths.FileInfo, iterErr error) error {
+		stop := g.Progress.Begin(g.scanSource)
+		defer stop()
+		var brokenErr error
+		err := g.walkSource(func(fileInfo *paths.FileInfo, iterErr error) error {
 			if iterErr != nil {
 				log.Warn(iterErr.Error())
 				return nil
 			}
+			// 取消时正在压缩的文件会返回错误，不能当作压缩失败；压缩包已经损坏时不再压缩剩下的文件
+			if g.ctx.Err() != nil || brokenErr != nil {
+				return nil
+			}
 			if fileInfo.IsDir {
 				g.DirNum += 1
 			} else {
 				g.FileNum += 1
 				if err := g.gzip(fileInfo, tarWriter); err != nil {
 					log.Warn(err.Error())
-					if !g.IgnoreFailedFile {
-						g.FailFiles = append(g.FailFiles, fmt.Sprintf("%v: %v", fileInfo.Path, err))
+					g.FailFiles = append(g.FailFiles, report.NewFailItem(g.sourceLocation(fileInfo), err))
+					if errors.Is(err, errArchiveBroken) {
+						brokenErr = err
+					} else if !g.IgnoreFailedFile {
 						panic(err)
 					}
 				}
 			}
 			return nil
-		}, false, g.IgnoreFailedFile)
+		}, paths.IterOption{
+			IgnoreErr: g.IgnoreFailedFile,
+			Filter:    g.Filter,
+			Context:   g.ctx,
+		})
+		if brokenErr != nil {
+			return brokenErr
+		}
 		return err
 	} else {
-		sourceFileInfo, err := paths.GetFileInfo(g.SourcePath)
+		sourceFileInfo, err := g.sourceRoot()
 		if err != nil {
 			return err
 		}
+		stop := g.Progress.Begin(func() {
+			g.Progress.AddTotal(sourceFileInfo.Size, 1)
+		})
+		defer stop()
 		if err := g.gzip(sourceFileInfo, tarWriter); err != nil {
 			return err
 		}
@@ -154,38 +342,215 @@ func (g *GzipInfo) Compress() error {
 	return nil
 }
 
+// walkSource 遍历源目录，本地路径的 FileInfo.Path 是绝对路径，存储中的是相对路径。
+// 存储中的符号链接跟随，压缩链接指向的内容，指向祖先目录的循环链接作为错误处理
+func (g *GzipInfo) walkSource(doFunc paths.DoFunc, option paths.IterOption) error {
+	if g.SourceStorage == nil {
+		_, err := paths.DoIterPathWithOption(g.SourcePath, doFunc, option)
+		return err
+	}
+	option.FollowSymlink = true
+	_, err := paths.DoIterFS(storage.FS(g.SourceStorage), ".", doFunc, option)
+	return err
+}
+
+// sourceRoot 返回需要压缩的单个文件
+func (g *GzipInfo) sourceRoot() (*paths.FileInfo, error) {
+	if g.SourceStorage == nil {
+		return paths.GetFileInfo(g.SourcePath)
+	}
+	return g.SourceStorage.Stat("")
+}
+
+// relPath 文件在压缩包中的路径，压缩单个文件时为 "."
+func (g *GzipInfo) relPath(fileInfo *paths.FileInfo) (string, error) {
+	if g.SourceStorage == nil {
+		return filepath.Rel(g.SourcePath, fileInfo.Path)
+	}
+	if len(fileInfo.Path) == 0 {
+		return ".", nil
+	}
+	return fileInfo.Path, nil
+}
+
+// sourceLocation 日志、报告和失败记录中使用的源文件路径
+func (g *GzipInfo) sourceLocation(fileInfo *paths.FileInfo) string {
+	if g.SourceStorage == nil {
+		return fileInfo.Path
+	}
+	return storage.Location(g.SourceStorage, storage.Join(fileInfo.Path))
+}
+
+// scanSource 使用和压缩相同的过滤规则统计需要压缩的文件总大小
+func (g *GzipInfo) scanSource() {
+	err := g.walkSource(func(fileInfo *paths.FileInfo, iterErr error) error {
+		if iterErr == nil && !fileInfo.IsDir {
+			g.Progress.AddTotal(fileInfo.Size, 1)
+		}
+		return nil
+	}, paths.IterOption{
+		IgnoreErr: true,
+		Filter:    g.Filter,
+		Context:   g.ctx,
+	})
+	if err != nil {
+		log.Debug("scan source path %v error: %v", g.SourcePath, err)
+	}
+}
+
 func (g *GzipInfo) Decompress() error {
-	return g.unzip()
+	return g.DecompressWithContext(context.Background())
 }
 
+// DecompressWithContext ctx 取消后停止解压，正在解压的文件不会出现在目标路径中，返回取消的原因
+func (g *GzipInfo) DecompressWithContext(ctx context.Context) error {
+	g.ctx = ctx
+	err := g.checkSpace()
+	if err == nil {
+		err = g.unzip()
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	g.Report.Finish(g.FailFiles, err)
+	return err
+}
+
+// gzip 把一个源文件写入压缩包，读取过程中源文件被修改时按照 OnChange 处理
 func (g *GzipInfo) gzip(sourceFile *paths.FileInfo, writer *tar.Writer) error {
-	file, err := os.Open(sourceFile.Path)
+	location := g.sourceLocation(sourceFile)
+	relPath, err := g.relPath(sourceFile)
 	if err != nil {
-		return errors.Wrapf(err, "open source file %v error", sourceFile.Path)
+		return errors.Wrapf(err, "get %v relate path error", location)
+	}
+	defer g.Progress.FileDone()
+	g.Throttle.WaitFile()
+	startTime := time.Now()
+	tracker := g.Progress.Track()
+	attempts := 0
+	for retries := 0; ; retries++ {
+		tracker.Set(0)
+		size, readRetries, err := g.writeEntry(sourceFile, relPath, location, writer, tracker)
+		attempts += readRetries + 1
+		changed := errors.Is(err, paths.ErrFileChanged)
+		if err != nil && !changed {
+			return err
+		}
+		if changed {
+			switch g.OnChange {
+			case paths.ChangeRetry:
+				if retries < changeRetry {
+					// 已经写入压缩包的内容不能删除，重新写入同名的文件，解压时后写入的覆盖前面的
+					log.Warn("%v, compress again %v/%v", err, retries+1, changeRetry)
+					continue
+				}
+				return err
+			case paths.ChangeFail:
+				return err
+			default:
+				log.Warn("%v, keep the compressed content", err)
+				g.ChangedNum += 1
+			}
+		}
+		g.DoneBytes += size
+		g.Report.Add(report.FileItem{
+			SourcePath: location,
+			TargetPath: relPath,
+			Outcome:    report.OutcomeCompressed,
+			Bytes:      size,
+			Duration:   time.Since(startTime),
+			Attempts:   attempts,
+			Changed:    changed,
+		})
+		return nil
 	}
-	relPath, err := filepath.Rel(g.SourcePath, sourceFile.Path)
+}
+
+// writeEntry 把源文件作为一个 tar 条目写入压缩包，返回条目的大小和读取重试的次数。
+// 条目大小是打开文件后的大小，读取过程中文件变长时截断、变短时补零，文件变化时压缩包的结构仍然完整，返回的错误可以用 paths.ErrFileChanged 判断
+func (g *GzipInfo) writeEntry(sourceFile *paths.FileInfo, relPath, location string, writer *tar.Writer, tracker *progress.Tracker) (int64, int, error) {
+	var file io.ReadCloser
+	_, err := g.Retry.Do(g.ctx, fmt.Sprintf("open %v", location), func(attempt int) (err error) {
+		file, err = g.source().Open(filepath.ToSlash(relPath))
+		return err
+	})
 	if err != nil {
-		return errors.Wrapf(err, "get %v relate path error", sourceFile.Path)
+		return 0, 0, errors.Wrapf(err, "open source file %v error", location)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close source file %v error: %v", location, err)
+		}
+	}()
+	before, err := g.sourceState(sourceFile)
+	if err != nil {
+		return 0, 0, err
 	}
 	h := new(tar.Header)
 	h.Name = relPath
-	h.Size = sourceFile.Size
+	h.Size = before.Size
 	h.Mode = int64(os.ModePerm)
-	h.ModTime = time.Unix(sourceFile.UpdatedAt, 0)
+	h.ModTime = before.ModTime
 
 	if err := writer.WriteHeader(h); err != nil {
-		return errors.Wrapf(err, "write file %v header error", sourceFile.Path)
+		return 0, 0, errors.Wrapf(err, "write file %v header error", location)
 	}
 
-	_, err = io.Copy(writer, file)
+	// 压缩包中已经写入了文件头，只能在读取时重试，不能重新压缩整个文件
+	reader := g.Retry.Reader(g.ctx, file)
+	written, err := io.Copy(writer, io.LimitReader(paths.ContextReader(g.ctx, tracker.Reader(g.Throttle.Reader(reader))), h.Size))
+	retries := int(reader.Retries())
 	if err != nil {
-		return errors.Wrapf(err, "encode source file %v error", sourceFile.Path)
+		return 0, retries, errors.Wrapf(&brokenError{err}, "encode source file %v error", location)
 	}
-	return nil
+	if written < h.Size {
+		if _, err := io.CopyN(writer, zeroReader{}, h.Size-written); err != nil {
+			return 0, retries, errors.Wrapf(&brokenError{err}, "pad source file %v error", location)
+		}
+	}
+	after, err := g.sourceState(sourceFile)
+	if err != nil {
+		return 0, retries, err
+	}
+	changeErr := before.Compare(after)
+	if changeErr == nil && written < h.Size {
+		changeErr = errors.Wrapf(paths.ErrFileChanged, "read %v of %v bytes", written, h.Size)
+	}
+	if changeErr != nil {
+		return h.Size, retries, errors.Wrapf(changeErr, "source file %v", location)
+	}
+	return h.Size, retries, nil
+}
+
+// sourceState 本地文件比较大小、修改时间和 ctime，其他存储中的文件只比较大小和秒级的修改时间
+func (g *GzipInfo) sourceState(sourceFile *paths.FileInfo) (paths.FileState, error) {
+	if g.SourceStorage == nil {
+		return paths.StatFile(sourceFile.Path)
+	}
+	fileInfo, err := g.SourceStorage.Stat(storage.Join(sourceFile.Path))
+	if err != nil {
+		return paths.FileState{}, errors.Wrapf(err, "get source file %v info error", g.sourceLocation(sourceFile))
+	}
+	return paths.FileState{Size: fileInfo.Size, ModTime: time.Unix(fileInfo.UpdatedAt, 0)}, nil
+}
+
+// zeroReader 读取过程中变短的文件用 0 补齐到文件头中的大小
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
 }
 
 func (g *GzipInfo) unzip() error {
-	sourceFile, err := os.Open(g.SourcePath)
+	source := g.source()
+	sourceInfo, err := source.Stat("")
+	if err != nil {
+		return errors.Wrapf(err, "get source file %v info error", g.SourcePath)
+	}
+	sourceFile, err := source.Open("")
 	if err != nil {
 		return errors.Wrapf(err, "open source file %v error", g.SourcePath)
 	}
@@ -194,19 +559,29 @@ func (g *GzipInfo) unzip() error {
 			log.Debug("close source file error: %v", err)
 		}
 	}()
-	gzipReader, err := pgzip.NewReader(sourceFile)
+	if g.Progress == nil {
+		g.Progress = progress.Default("decompress")
+	}
+	// 解压前不知道文件数量和解压后的大小，按照读取的压缩包字节数统计进度
+	stop := g.Progress.Begin(func() {
+		g.Progress.AddTotal(sourceInfo.Size, 0)
+	})
+	defer stop()
+	stream, err := g.openStream(sourceFile, g.Progress.Track().Reader(g.Throttle.Reader(g.Retry.Reader(g.ctx, sourceFile))), sourceInfo.Size)
 	if err != nil {
-		return errors.Wrap(err, "create gzip reader error")
+		return err
 	}
-	reader := tar.NewReader(gzipReader)
-	ticker := time.NewTicker(time.Second * 3)
-	go func() {
-		for {
-			<-ticker.C
-			log.Info("compress success file number: %v, failed number: %v", g.FileNum, len(g.FailFiles))
-		}
-	}()
-	for {
+	defer stream.close()
+	log.Debug("decompress %v as %v %v", g.SourcePath, g.Format, stream.kind)
+	switch stream.kind {
+	case kindZip:
+		return g.extractZip(stream.zip)
+	case kindFile:
+		return g.extractSingle(stream.reader)
+	}
+	reader := tar.NewReader(stream.reader)
+	target := g.target()
+	for g.ctx.Err() == nil {
 		header, err := reader.Next()
 		if err != nil {
 			if err == io.EOF {
@@ -216,22 +591,261 @@ func (g *GzipInfo) unzip() error {
 				return errors.Wrap(err, "read source file error")
 			}
 		}
-		decodeFilePath := filepath.Join(g.TargetPath, header.Name)
-		file, err := paths.CreateFile(decodeFilePath)
+		info := header.FileInfo()
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			log.Warn("skip %v, %v entry is not supported", header.Name, info.Mode().Type())
+			continue
+		}
+		if stop, err := g.extractEntry(reader, target, header.Name, info.IsDir()); stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractEntry 解压压缩包中的一个文件或目录，返回 true 时停止解压，返回的错误是停止的原因
+func (g *GzipInfo) extractEntry(reader io.Reader, target storage.Storage, name string, isDir bool) (bool, error) {
+	relPath := storage.Join(filepath.ToSlash(name))
+	decodeFilePath := storage.Location(target, relPath)
+	startTime := time.Now()
+	var size int64
+	attempts := 1
+	var err error
+	if relPath == ".." || strings.HasPrefix(relPath, "../") {
+		err = fmt.Errorf("entry %v is outside of target %v", name, target)
+	} else if isDir {
+		if err = target.MkdirAll(relPath); err == nil {
+			g.DirNum += 1
+			return false, nil
+		}
+		err = errors.Wrapf(err, "make dir %v error", decodeFilePath)
+	} else {
+		g.Throttle.WaitFile()
+		size, attempts, err = g.extractFile(reader, target, relPath)
+	}
+	if err != nil {
+		// 取消时正在解压的文件已经删除，不算解压失败
+		if g.ctx.Err() != nil {
+			return true, nil
+		}
+		log.Warn(err.Error())
+		noSpace := errors.Is(err, syscall.ENOSPC)
+		if !g.IgnoreFailedFile && !noSpace {
+			return true, err
+		}
+		failItem := report.NewFailItem(decodeFilePath, err)
+		failItem.Attempts = attempts
+		g.FailFiles = append(g.FailFiles, failItem)
+		if noSpace {
+			// 写了一半的文件已经丢弃，后面的文件也没有空间
+			return true, errors.Wrap(err, "no space left on target, decompress stopped")
+		}
+		return false, nil
+	}
+	g.Report.Add(report.FileItem{
+		SourcePath: name,
+		TargetPath: decodeFilePath,
+		Outcome:    report.OutcomeExtracted,
+		Bytes:      size,
+		Duration:   time.Since(startTime),
+		Attempts:   attempts,
+	})
+	g.FileNum += 1
+	g.DoneBytes += size
+	g.Progress.FileDone()
+	return false, nil
+}
+
+// checkSpace 解压前根据不需要解压就能读到的大小信息统计解压后的总大小，目标的可用空间不够时拒绝开始解压。
+// 目标中已经存在的同名文件会被覆盖，只计算增加的部分。不解压就不能知道大小的压缩包跳过检查
+func (g *GzipInfo) checkSpace() error {
+	if g.Force {
+		return nil
+	}
+	target := g.target()
+	free, err := storage.FreeSpace(target)
+	if err != nil {
+		log.Warn("get free space of %v error: %v, skip space check", target, err)
+		return nil
+	}
+	need, known, err := g.extractedSize(target)
+	if err != nil {
+		return err
+	}
+	if !known {
+		log.Debug("uncompressed size of %v is unknown without decompressing it, skip space check", g.SourcePath)
+		return nil
+	}
+	if need > free {
+		return &paths.SpaceError{Path: target.String(), Need: need, Free: free}
+	}
+	return nil
+}
+
+// extractedSize 返回压缩包中的文件解压后还需要写入目标的字节数，不会解压整个压缩包：
+// zip 读取目录，tar 跳过文件内容只读取文件头，gzip 读取末尾记录的原始大小。
+// 压缩的 tar 只能得到整个 tar 流的大小，包含文件头和对齐，也不扣除会被覆盖的已有文件。
+// 其他格式、不能随机读取的存储返回 false
+func (g *GzipInfo) extractedSize(target storage.Storage) (int64, bool, error) {
+	source := g.source()
+	sourceInfo, err := source.Stat("")
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "get source file %v info error", g.SourcePath)
+	}
+	sourceFile, err := source.Open("")
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "open source file %v error", g.SourcePath)
+	}
+	defer func() {
+		if err := sourceFile.Close(); err != nil {
+			log.Debug("close source file error: %v", err)
+		}
+	}()
+	readerAt, ok := sourceFile.(io.ReaderAt)
+	if !ok {
+		return 0, false, nil
+	}
+	size := sourceInfo.Size
+	if len(g.Format) == 0 {
+		header := make([]byte, compress.HeaderSize)
+		n, err := readerAt.ReadAt(header, 0)
+		if err != nil && err != io.EOF {
+			return 0, false, errors.Wrapf(err, "read source file %v error", g.SourcePath)
+		}
+		if g.Format, err = compress.Detect(header[:n]); err != nil {
+			return 0, false, errors.Wrapf(err, "decompress %v error", g.SourcePath)
+		}
+	}
+	var need int64
+	// 覆盖已经存在的文件只需要增加的部分
+	add := func(relPath string, size int64) {
+		if info, err := target.Stat(relPath); err == nil && !info.IsDir {
+			size -= info.Size
+		}
+		if size > 0 {
+			need += size
+		}
+	}
+	switch g.Format {
+	case compress.FormatZip:
+		zipReader, err := zip.NewReader(readerAt, size)
 		if err != nil {
-			log.Warn(err.Error())
-			if !g.IgnoreFailedFile {
-				return err
+			return 0, false, errors.Wrapf(err, "open zip archive %v error", g.SourcePath)
+		}
+		for _, file := range zipReader.File {
+			if !file.FileInfo().IsDir() {
+				add(storage.Join(file.Name), int64(file.UncompressedSize64))
 			}
 		}
-		_, err = io.Copy(file, reader)
-		if err != nil {
-			log.Warn("writer file %v error: %v", decodeFilePath, err)
-			if !g.IgnoreFailedFile {
-				return errors.Wrapf(err, "writer file %v error", decodeFilePath)
+		return need, true, nil
+	case compress.FormatTar:
+		// SectionReader 可以 Seek，tar 跳过文件内容时不需要读取
+		reader := tar.NewReader(io.NewSectionReader(readerAt, 0, size))
+		for {
+			if err := g.ctx.Err(); err != nil {
+				return 0, false, err
+			}
+			header, err := reader.Next()
+			if err == io.EOF {
+				return need, true, nil
+			}
+			if err != nil {
+				return 0, false, errors.Wrap(err, "read source file error")
 			}
+			if header.FileInfo().Mode().IsRegular() {
+				add(storage.Join(filepath.ToSlash(header.Name)), header.Size)
+			}
+		}
+	case compress.FormatGzip:
+		uncompressed, known, err := gzipSize(readerAt, size)
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "read gzip size of %v error", g.SourcePath)
+		}
+		if !known {
+			log.Debug("gzip size of %v may exceed 4GB, skip space check", g.SourcePath)
+			return 0, false, nil
+		}
+		isTar, err := g.gzipIsTar(readerAt, size)
+		if err != nil {
+			return 0, false, err
+		}
+		if isTar {
+			return uncompressed, true, nil
 		}
-		g.FileNum += 1
+		add(g.singlePath(target), uncompressed)
+		return need, true, nil
 	}
-	return nil
+	return 0, false, nil
+}
+
+const (
+	// gzipMinSize 最短的 gzip：10 字节的文件头加上末尾 8 字节的 CRC32 和 ISIZE
+	gzipMinSize = 18
+	// gzipMaxRatio deflate 的最大压缩比，压缩后的大小乘上它还不到 4GB 时 ISIZE 不会回绕
+	gzipMaxRatio = 1032
+)
+
+// gzipSize 返回 gzip 末尾 ISIZE 记录的原始大小。ISIZE 是原始大小对 2^32 取模，
+// 可能回绕时返回 false：压缩后不少于 4GB，或者 ISIZE 比压缩后的大小还小而原始大小又可能超过 4GB
+func gzipSize(readerAt io.ReaderAt, size int64) (int64, bool, error) {
+	if size < gzipMinSize {
+		return 0, false, errors.New("gzip file is too short")
+	}
+	trailer := make([]byte, 4)
+	if _, err := readerAt.ReadAt(trailer, size-4); err != nil {
+		return 0, false, err
+	}
+	uncompressed := int64(binary.LittleEndian.Uint32(trailer))
+	if size*gzipMaxRatio < 1<<32 {
+		return uncompressed, true, nil
+	}
+	if size >= 1<<32 || uncompressed < size {
+		return 0, false, nil
+	}
+	return uncompressed, true, nil
+}
+
+// gzipIsTar 只解压开头的一个块，判断 gzip 中是不是 tar
+func (g *GzipInfo) gzipIsTar(readerAt io.ReaderAt, size int64) (bool, error) {
+	codec, err := compress.ForFormat(compress.FormatGzip)
+	if err != nil {
+		return false, err
+	}
+	decompressor, err := codec.NewReader(io.NewSectionReader(readerAt, 0, size), g.codecOptions(""))
+	if err != nil {
+		return false, errors.Wrapf(err, "open gzip archive %v error", g.SourcePath)
+	}
+	defer func() {
+		if err := decompressor.Close(); err != nil {
+			log.Debug("close decompress stream error: %v", err)
+		}
+	}()
+	block := make([]byte, compress.HeaderSize)
+	n, err := io.ReadFull(decompressor, block)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, errors.Wrapf(err, "read gzip archive %v error", g.SourcePath)
+	}
+	return compress.IsTar(block[:n]), nil
+}
+
+// extractFile 写入目标存储，完整写入后才提交，出错时丢弃写了一半的文件，返回写入的字节数和尝试的次数
+func (g *GzipInfo) extractFile(reader io.Reader, target storage.Storage, relPath string) (int64, int, error) {
+	file, err := target.Create(relPath)
+	if err != nil {
+		return 0, 1, errors.Wrapf(err, "create file %v error", storage.Location(target, relPath))
+	}
+	writer := g.Retry.Writer(g.ctx, file)
+	size, err := io.Copy(g.Throttle.Writer(writer), paths.ContextReader(g.ctx, reader))
+	attempts := int(writer.Retries()) + 1
+	if err != nil {
+		if abortErr := file.Abort(); abortErr != nil {
+			log.Debug("abort file %v error: %v", storage.Location(target, relPath), abortErr)
+		}
+	} else {
+		err = file.Commit()
+	}
+	if err != nil {
+		return size, attempts, errors.Wrapf(err, "writer file %v error", storage.Location(target, relPath))
+	}
+	return size, attempts, nil
 }
@@ -2,17 +2,37 @@ package gzip
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
 	"github.com/klauspost/pgzip"
 	"github.com/stretchr/testify/assert"
+	"go_tools/files/compress"
+	"go_tools/paths"
+	"go_tools/report"
+	"go_tools/retry"
+	"go_tools/storage"
 	"io"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 )
 
+// writeTestFile 在临时目录中创建一个用于压缩的文件
+func writeTestFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "logs.txt")
+	assert.Nil(t, os.WriteFile(path, bytes.Repeat([]byte("log line\n"), 1024), 0644))
+	return path
+}
+
 func TestGzip(t *testing.T) {
 	// file write
-	fw, err := os.Create("golang_src.tar.gz")
+	fw, err := os.Create(filepath.Join(t.TempDir(), "golang_src.tar.gz"))
 	if err != nil {
 		panic(err)
 	}
@@ -27,9 +47,10 @@ func TestGzip(t *testing.T) {
 	defer tw.Close()
 
 	// open file to compress
-	fileInfo, err := os.Stat("~/logs.txt")
+	sourcePath := writeTestFile(t)
+	fileInfo, err := os.Stat(sourcePath)
 	assert.Nil(t, err)
-	file, err := os.Open("~/logs.txt")
+	file, err := os.Open(sourcePath)
 	assert.Nil(t, err)
 	defer file.Close()
 	h := new(tar.Header)
@@ -50,7 +71,7 @@ func TestGzip(t *testing.T) {
 
 func TestPGzip(t *testing.T) {
 	// file write
-	fw, err := os.Create("sgolang_src.tar.gz")
+	fw, err := os.Create(filepath.Join(t.TempDir(), "sgolang_src.tar.gz"))
 	if err != nil {
 		panic(err)
 	}
@@ -63,9 +84,10 @@ func TestPGzip(t *testing.T) {
 	defer tw.Close()
 
 	// open file to compress
-	fileInfo, err := os.Stat("~/logs.txt")
+	sourcePath := writeTestFile(t)
+	fileInfo, err := os.Stat(sourcePath)
 	assert.Nil(t, err)
-	file, err := os.Open("~/logs.txt")
+	file, err := os.Open(sourcePath)
 	assert.Nil(t, err)
 	defer file.Close()
 	h := new(tar.Header)
@@ -82,30 +104,538 @@ func TestPGzip(t *testing.T) {
 
 }
 
+// newTestMemory 返回一个包含 Downloads 目录的内存存储
+func newTestMemory(t *testing.T) *storage.Memory {
+	memory := storage.NewMemory()
+	assert.Nil(t, memory.WriteFile("Downloads/0000.txt", []byte("0000"), time.Now()))
+	assert.Nil(t, memory.WriteFile("Downloads/dir/a.txt", bytes.Repeat([]byte("a"), 64*1024), time.Now()))
+	assert.Nil(t, memory.WriteFile("Downloads/dir/b.log", []byte("bbb"), time.Now()))
+	return memory
+}
+
+// subStorage 返回 memory 中以 root 为根路径的存储
+func subStorage(memory *storage.Memory, root string) storage.Storage {
+	return &prefixStorage{Storage: memory, root: root}
+}
+
+// prefixStorage 把所有路径加上 root 前缀，用于指定压缩包和解压目录在内存存储中的位置
+type prefixStorage struct {
+	storage.Storage
+	root string
+}
+
+func (p *prefixStorage) Stat(path string) (*paths.FileInfo, error) {
+	fileInfo, err := p.Storage.Stat(storage.Join(p.root, path))
+	if err != nil {
+		return nil, err
+	}
+	fileInfo.Path = path
+	return fileInfo, nil
+}
+
+func (p *prefixStorage) List(path string) ([]*paths.FileInfo, error) {
+	children, err := p.Storage.List(storage.Join(p.root, path))
+	for _, child := range children {
+		child.Path = storage.Join(path, child.Name)
+	}
+	return children, err
+}
+
+func (p *prefixStorage) Open(path string) (io.ReadCloser, error) {
+	return p.Storage.Open(storage.Join(p.root, path))
+}
+
+func (p *prefixStorage) Create(path string) (storage.Writer, error) {
+	return p.Storage.Create(storage.Join(p.root, path))
+}
+
+func (p *prefixStorage) FreeSpace() (int64, error) {
+	return storage.FreeSpace(p.Storage)
+}
+
+func (p *prefixStorage) String() string {
+	return p.Storage.String() + p.root
+}
+
 func TestCompressDir(t *testing.T) {
-	handler, err := Get("~/Downloads/", "~/test.tar.gz", 0, 0, true, false)
+	memory := newTestMemory(t)
+	handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar.gz"), 0, 0, true, false)
+	assert.Nil(t, err)
+	handler.Filter, err = paths.NewFilter(nil, []string{"*.log"})
 	assert.Nil(t, err)
 	err = handler.Compress()
 	assert.Nil(t, err)
+	assert.Equal(t, int64(2), handler.FileNum)
+	assert.Equal(t, int64(2), handler.DirNum)
 }
 
 func TestCompress(t *testing.T) {
-	handler, err := Get("~/Downloads/0000.txt", "~/test_file.tar.gz", 0, 0, true, false)
+	memory := newTestMemory(t)
+	handler, err := GetWithStorage(subStorage(memory, "Downloads/0000.txt"), subStorage(memory, "test_file.tar.gz"), 0, 0, true, false)
 	assert.Nil(t, err)
 	err = handler.Compress()
 	assert.Nil(t, err)
+	_, err = memory.Stat("test_file.tar.gz")
+	assert.Nil(t, err)
 }
 
 func TestDecompressDir(t *testing.T) {
-	handler, err := Get("~/test.tar.gz", "~/temp.tar.gz", 0, 0, false, false)
+	memory := newTestMemory(t)
+	handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar.gz"), 0, 0, true, false)
+	assert.Nil(t, err)
+	assert.Nil(t, handler.Compress())
+	handler, err = GetWithStorage(subStorage(memory, "test.tar.gz"), subStorage(memory, "temp"), 0, 0, false, false)
 	assert.Nil(t, err)
 	err = handler.Decompress()
 	assert.Nil(t, err)
+	assert.Equal(t, int64(3), handler.FileNum)
+	content, err := memory.ReadFile("temp/dir/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("a"), 64*1024), content)
 }
 
 func TestDecompressFile(t *testing.T) {
-	handler, err := Get("~/test_file.tar.gz", "~/temp", 0, 0, false, false)
+	memory := newTestMemory(t)
+	handler, err := GetWithStorage(subStorage(memory, "Downloads/0000.txt"), subStorage(memory, "test_file.tar.gz"), 0, 0, true, false)
+	assert.Nil(t, err)
+	assert.Nil(t, handler.Compress())
+	handler, err = GetWithStorage(subStorage(memory, "test_file.tar.gz"), subStorage(memory, "temp"), 0, 0, false, false)
 	assert.Nil(t, err)
 	err = handler.Decompress()
 	assert.Nil(t, err)
+	content, err := memory.ReadFile("temp")
+	assert.Nil(t, err)
+	assert.Equal(t, "0000", string(content))
+}
+
+func TestCompressFormats(t *testing.T) {
+	for _, format := range []compress.Format{compress.FormatGzip, compress.FormatZstd, compress.FormatXz, compress.FormatS2, compress.FormatLz4} {
+		t.Run(string(format), func(t *testing.T) {
+			memory := newTestMemory(t)
+			handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar"), 0, 0, true, false)
+			assert.Nil(t, err)
+			handler.Format = format
+			assert.Nil(t, handler.Compress())
+			handler, err = GetWithStorage(subStorage(memory, "test.tar"), subStorage(memory, "temp"), 0, 0, false, false)
+			assert.Nil(t, err)
+			handler.Format = format
+			assert.Nil(t, handler.Decompress())
+			assert.Equal(t, int64(3), handler.FileNum)
+			content, err := memory.ReadFile("temp/dir/a.txt")
+			assert.Nil(t, err)
+			assert.Equal(t, bytes.Repeat([]byte("a"), 64*1024), content)
+		})
+	}
+	t.Run("bzip2 is read-only", func(t *testing.T) {
+		memory := newTestMemory(t)
+		handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar"), 0, 0, true, false)
+		assert.Nil(t, err)
+		handler.Format = compress.FormatBzip2
+		assert.NotNil(t, handler.Compress())
+		_, err = memory.Stat("test.tar")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("by extension", func(t *testing.T) {
+		sourcePath := writeTestFile(t)
+		targetPath := filepath.Join(t.TempDir(), "logs.tar.zst")
+		handler, err := Get(sourcePath, targetPath, 0, 0, true, false)
+		assert.Nil(t, err)
+		assert.Nil(t, handler.Compress())
+		assert.Equal(t, compress.FormatZstd, handler.Format)
+		handler, err = Get(targetPath, filepath.Join(t.TempDir(), "logs.txt"), 0, 0, false, false)
+		assert.Nil(t, err)
+		assert.Nil(t, handler.Decompress())
+		assert.Equal(t, compress.FormatZstd, handler.Format)
+		content, err := os.ReadFile(handler.TargetPath)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("log line\n"), 1024), content)
+	})
+	t.Run("default archive name", func(t *testing.T) {
+		targetDir := t.TempDir()
+		handler, err := Get(writeTestFile(t), targetDir, 0, 0, true, false)
+		assert.Nil(t, err)
+		assert.Equal(t, filepath.Join(targetDir, "logs.tar.gz"), handler.TargetPath)
+		handler.Format = compress.FormatXz
+		assert.Nil(t, handler.Compress())
+		assert.Equal(t, filepath.Join(targetDir, "logs.tar.xz"), handler.TargetPath)
+		_, err = os.Stat(handler.TargetPath)
+		assert.Nil(t, err)
+	})
+	t.Run("unknown format", func(t *testing.T) {
+		memory := newTestMemory(t)
+		handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar"), 0, 0, true, false)
+		assert.Nil(t, err)
+		handler.Format = "rar"
+		assert.NotNil(t, handler.Compress())
+	})
+}
+
+func TestCompressFaults(t *testing.T) {
+	t.Run("read error", func(t *testing.T) {
+		memory := newTestMemory(t)
+		memory.FailReadAt = 1
+		handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar.gz"), 0, 0, true, true)
+		assert.Nil(t, err)
+		// 文件头已经写入压缩包，即使忽略失败的文件也不能继续压缩
+		err = handler.Compress()
+		assert.True(t, errors.Is(err, syscall.EIO))
+		assert.Len(t, handler.FailFiles, 1)
+		assert.Equal(t, report.FailTypeTransient, handler.FailFiles[0].Type)
+		_, err = memory.Stat("test.tar.gz")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("read error retried", func(t *testing.T) {
+		memory := newTestMemory(t)
+		memory.FailReadAt = 1
+		handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar.gz"), 0, 0, true, false)
+		assert.Nil(t, err)
+		handler.Retry = &retry.Policy{Attempts: 2, BaseDelay: time.Millisecond}
+		assert.Nil(t, handler.Compress())
+		assert.Empty(t, handler.FailFiles)
+	})
+	t.Run("no space", func(t *testing.T) {
+		memory := newTestMemory(t)
+		// 只剩下不够写入一个 tar 块的空间
+		memory.Capacity = 64*1024 + 7 + 256
+		handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar.gz"), 0, 0, true, true)
+		assert.Nil(t, err)
+		err = handler.Compress()
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		// 没有写完的压缩包不可见
+		_, err = memory.Stat("test.tar.gz")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("slow write canceled", func(t *testing.T) {
+		memory := newTestMemory(t)
+		handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar.gz"), 0, 0, true, false)
+		assert.Nil(t, err)
+		assert.Nil(t, handler.Compress())
+		memory.WriteDelay = 50 * time.Millisecond
+		handler, err = GetWithStorage(subStorage(memory, "test.tar.gz"), subStorage(memory, "temp"), 0, 0, false, false)
+		assert.Nil(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err = handler.DecompressWithContext(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Less(t, handler.FileNum, int64(3))
+		_, err = memory.Stat("temp/dir/b.log")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+}
+
+func TestDecompressSpace(t *testing.T) {
+	prepare := func(t *testing.T, format compress.Format) (*storage.Memory, *GzipInfo) {
+		memory := newTestMemory(t)
+		handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.tar.gz"), 0, 0, true, false)
+		assert.Nil(t, err)
+		handler.Format = format
+		assert.Nil(t, handler.Compress())
+		// 只剩下 32K 空间，能解压 0000.txt，不能解压 dir/a.txt
+		memory.Capacity = 1 << 30
+		free, err := memory.FreeSpace()
+		assert.Nil(t, err)
+		memory.Capacity = 1<<30 - free + 32*1024
+		handler, err = GetWithStorage(subStorage(memory, "test.tar.gz"), subStorage(memory, "temp"), 0, 0, false, true)
+		assert.Nil(t, err)
+		return memory, handler
+	}
+	t.Run("preflight", func(t *testing.T) {
+		memory, handler := prepare(t, compress.FormatGzip)
+		err := handler.Decompress()
+		var spaceErr *paths.SpaceError
+		assert.True(t, errors.As(err, &spaceErr))
+		// 压缩的 tar 按照 gzip 末尾记录的 tar 流大小计算
+		content, err := memory.ReadFile("test.tar.gz")
+		assert.Nil(t, err)
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		assert.Nil(t, err)
+		tarSize, err := io.Copy(io.Discard, reader)
+		assert.Nil(t, err)
+		assert.Equal(t, tarSize, spaceErr.Need)
+		assert.Equal(t, int64(32*1024), spaceErr.Free)
+		_, err = memory.Stat("temp")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("preflight tar", func(t *testing.T) {
+		_, handler := prepare(t, compress.FormatTar)
+		err := handler.Decompress()
+		var spaceErr *paths.SpaceError
+		assert.True(t, errors.As(err, &spaceErr))
+		// 不压缩的 tar 只读取文件头，统计的是文件内容的大小
+		assert.Equal(t, int64(64*1024+7), spaceErr.Need)
+	})
+	t.Run("unknown size", func(t *testing.T) {
+		memory, handler := prepare(t, compress.FormatZstd)
+		// 不解压就不能知道大小，跳过检查后在写满时停止
+		err := handler.Decompress()
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		assert.False(t, errors.As(err, new(*paths.SpaceError)))
+		_, err = memory.Stat("temp/dir/a.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("force", func(t *testing.T) {
+		memory, handler := prepare(t, compress.FormatGzip)
+		handler.Force = true
+		// 即使忽略失败的文件，没有空间后也停止解压
+		err := handler.Decompress()
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		assert.Equal(t, int64(1), handler.FileNum)
+		assert.Equal(t, int64(4), handler.DoneBytes)
+		assert.Len(t, handler.FailFiles, 1)
+		assert.Equal(t, report.FailTypeNoSpace, handler.FailFiles[0].Type)
+		_, err = memory.Stat("temp/dir/a.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+		_, err = memory.Stat("temp/dir/b.log")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("wrapped isize", func(t *testing.T) {
+		for _, test := range []struct {
+			size  int64
+			isize uint32
+			known bool
+		}{
+			{size: 1024, isize: 1, known: true},
+			{size: 64 << 20, isize: 1 << 30, known: true},
+			// ISIZE 比压缩后的大小还小，可能是超过 4GB 后回绕的结果
+			{size: 64 << 20, isize: 1 << 20, known: false},
+			{size: 5 << 30, isize: 1<<32 - 1, known: false},
+		} {
+			uncompressed, known, err := gzipSize(isizeReader(test.isize), test.size)
+			assert.Nil(t, err)
+			assert.Equal(t, test.known, known, "size %v isize %v", test.size, test.isize)
+			if known {
+				assert.Equal(t, int64(test.isize), uncompressed)
+			}
+		}
+	})
+}
+
+// isizeReader 任意位置都读到同一个 ISIZE 的 io.ReaderAt，模拟很大的 gzip 文件的末尾
+type isizeReader uint32
+
+func (r isizeReader) ReadAt(p []byte, _ int64) (int, error) {
+	trailer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(trailer, uint32(r))
+	return copy(p, trailer), nil
+}
+
+// shrinkingStorage 第一次打开 path 时只能读到一半内容，读取时把 memory 中的文件截断成这一半，模拟压缩过程中文件被修改
+type shrinkingStorage struct {
+	storage.Storage
+	memory *storage.Memory
+	path   string
+	opened bool
+}
+
+func (s *shrinkingStorage) Open(path string) (io.ReadCloser, error) {
+	reader, err := s.Storage.Open(path)
+	if err != nil || path != s.path || s.opened {
+		return reader, err
+	}
+	s.opened = true
+	content, err := s.memory.ReadFile("Downloads/" + path)
+	if err != nil {
+		return nil, err
+	}
+	return &shrinkingReader{Reader: io.LimitReader(reader, int64(len(content)/2)), storage: s, content: content[:len(content)/2]}, nil
+}
+
+type shrinkingReader struct {
+	io.Reader
+	storage *shrinkingStorage
+	content []byte
+	shrunk  bool
+}
+
+func (r *shrinkingReader) Read(p []byte) (int, error) {
+	if !r.shrunk {
+		r.shrunk = true
+		if err := r.storage.memory.WriteFile("Downloads/"+r.storage.path, r.content, time.Now().Add(time.Hour)); err != nil {
+			return 0, err
+		}
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *shrinkingReader) Close() error {
+	return nil
+}
+
+func TestCompressChanged(t *testing.T) {
+	compress := func(t *testing.T, policy paths.ChangePolicy) (*storage.Memory, *GzipInfo, error) {
+		memory := newTestMemory(t)
+		source := &shrinkingStorage{Storage: subStorage(memory, "Downloads"), memory: memory, path: "dir/a.txt"}
+		handler, err := GetWithStorage(source, subStorage(memory, "test.tar.gz"), 0, 0, true, true)
+		assert.Nil(t, err)
+		handler.OnChange = policy
+		handler.Report = report.New("compress", "Downloads", "test.tar.gz")
+		return memory, handler, handler.Compress()
+	}
+	decompress := func(t *testing.T, memory *storage.Memory) []byte {
+		handler, err := GetWithStorage(subStorage(memory, "test.tar.gz"), subStorage(memory, "temp"), 0, 0, false, false)
+		assert.Nil(t, err)
+		// 变短的文件补齐后压缩包结构完整，后面的文件也能解压
+		assert.Nil(t, handler.Decompress())
+		content, err := memory.ReadFile("temp/dir/b.log")
+		assert.Nil(t, err)
+		assert.Equal(t, "bbb", string(content))
+		content, err = memory.ReadFile("temp/dir/a.txt")
+		assert.Nil(t, err)
+		return content
+	}
+
+	t.Run("warn", func(t *testing.T) {
+		memory, handler, err := compress(t, paths.ChangeWarn)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), handler.ChangedNum)
+		assert.Equal(t, int64(1), handler.Report.Totals.Changed)
+		content := decompress(t, memory)
+		assert.Equal(t, append(bytes.Repeat([]byte("a"), 32*1024), make([]byte, 32*1024)...), content)
+	})
+	t.Run("retry", func(t *testing.T) {
+		memory, handler, err := compress(t, paths.ChangeRetry)
+		assert.Nil(t, err)
+		assert.Zero(t, handler.ChangedNum)
+		assert.Empty(t, handler.FailFiles)
+		// 后写入的同名文件覆盖前面不一致的内容
+		assert.Equal(t, bytes.Repeat([]byte("a"), 32*1024), decompress(t, memory))
+	})
+	t.Run("fail", func(t *testing.T) {
+		memory, handler, err := compress(t, paths.ChangeFail)
+		assert.Nil(t, err)
+		assert.Len(t, handler.FailFiles, 1)
+		assert.Equal(t, report.FailTypeChanged, handler.FailFiles[0].Type)
+		decompress(t, memory)
+	})
+}
+
+func TestDecompressAtomic(t *testing.T) {
+	sourceDir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aaa"), 0644))
+	archivePath := filepath.Join(t.TempDir(), "a.tar.gz")
+	handler, err := Get(sourceDir, archivePath, 0, 0, true, false)
+	assert.Nil(t, err)
+	assert.Nil(t, handler.Compress())
+
+	targetDir := t.TempDir()
+	handler, err = Get(archivePath, targetDir, 0, 0, false, false)
+	assert.Nil(t, err)
+	handler.Durable = true
+	handler.Report = report.New("decompress", archivePath, targetDir)
+	assert.Nil(t, handler.Decompress())
+	assert.Equal(t, int64(1), handler.FileNum)
+	assert.Empty(t, handler.FailFiles)
+	assert.Len(t, handler.Report.Files, 1)
+	assert.Equal(t, report.OutcomeExtracted, handler.Report.Files[0].Outcome)
+	assert.Equal(t, int64(3), handler.Report.Totals.Bytes)
+	entries, err := os.ReadDir(targetDir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	content, err := os.ReadFile(filepath.Join(targetDir, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "aaa", string(content))
+}
+
+func TestDecompressDetect(t *testing.T) {
+	for _, format := range []compress.Format{compress.FormatGzip, compress.FormatZstd, compress.FormatXz, compress.FormatS2, compress.FormatLz4, compress.FormatTar} {
+		t.Run(string(format), func(t *testing.T) {
+			memory := newTestMemory(t)
+			handler, err := GetWithStorage(subStorage(memory, "Downloads"), subStorage(memory, "test.bin"), 0, 0, true, false)
+			assert.Nil(t, err)
+			handler.Format = format
+			assert.Nil(t, handler.Compress())
+			// 扩展名不能说明格式，根据魔数识别
+			handler, err = GetWithStorage(subStorage(memory, "test.bin"), subStorage(memory, "temp"), 0, 0, false, false)
+			assert.Nil(t, err)
+			assert.Nil(t, handler.Decompress())
+			assert.Equal(t, format, handler.Format)
+			assert.Equal(t, int64(3), handler.FileNum)
+			content, err := memory.ReadFile("temp/dir/b.log")
+			assert.Nil(t, err)
+			assert.Equal(t, "bbb", string(content))
+		})
+	}
+	t.Run("zip", func(t *testing.T) {
+		var buffer bytes.Buffer
+		zipWriter := zip.NewWriter(&buffer)
+		_, err := zipWriter.Create("dir/")
+		assert.Nil(t, err)
+		writer, err := zipWriter.Create("dir/a.txt")
+		assert.Nil(t, err)
+		_, err = writer.Write([]byte("aaa"))
+		assert.Nil(t, err)
+		writer, err = zipWriter.Create("../evil.txt")
+		assert.Nil(t, err)
+		_, err = writer.Write([]byte("evil"))
+		assert.Nil(t, err)
+		assert.Nil(t, zipWriter.Close())
+		memory := storage.NewMemory()
+		assert.Nil(t, memory.WriteFile("in/test.zip", buffer.Bytes(), time.Now()))
+
+		handler, err := GetWithStorage(subStorage(memory, "in/test.zip"), subStorage(memory, "out"), 0, 0, false, true)
+		assert.Nil(t, err)
+		assert.Nil(t, handler.Decompress())
+		assert.Equal(t, compress.FormatZip, handler.Format)
+		assert.Equal(t, int64(1), handler.FileNum)
+		assert.Equal(t, int64(1), handler.DirNum)
+		content, err := memory.ReadFile("out/dir/a.txt")
+		assert.Nil(t, err)
+		assert.Equal(t, "aaa", string(content))
+		// 路径跳出解压目录的文件不解压
+		assert.Len(t, handler.FailFiles, 1)
+		_, err = memory.Stat("evil.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("single file", func(t *testing.T) {
+		for _, format := range []compress.Format{compress.FormatGzip, compress.FormatZstd, compress.FormatLz4} {
+			codec, err := compress.ForFormat(format)
+			assert.Nil(t, err)
+			var buffer bytes.Buffer
+			writer, err := codec.NewWriter(&buffer, compress.Options{})
+			assert.Nil(t, err)
+			_, err = writer.Write(bytes.Repeat([]byte("log line\n"), 1024))
+			assert.Nil(t, err)
+			assert.Nil(t, writer.Close())
+			memory := storage.NewMemory()
+			name := "logs.txt" + codec.Extensions()[len(codec.Extensions())-1]
+			assert.Nil(t, memory.WriteFile(name, buffer.Bytes(), time.Now()))
+			assert.Nil(t, memory.MkdirAll("out"))
+
+			// 解压到目录时去掉压缩扩展名
+			handler, err := GetWithStorage(subStorage(memory, name), subStorage(memory, "out"), 0, 0, false, false)
+			assert.Nil(t, err)
+			assert.Nil(t, handler.Decompress())
+			assert.Equal(t, format, handler.Format)
+			assert.Equal(t, int64(1), handler.FileNum)
+			content, err := memory.ReadFile("out/logs.txt")
+			assert.Nil(t, err)
+			assert.Equal(t, bytes.Repeat([]byte("log line\n"), 1024), content)
+
+			// 目标不存在时解压到目标路径
+			handler, err = GetWithStorage(subStorage(memory, name), subStorage(memory, "plain"), 0, 0, false, false)
+			assert.Nil(t, err)
+			assert.Nil(t, handler.Decompress())
+			content, err = memory.ReadFile("plain")
+			assert.Nil(t, err)
+			assert.Equal(t, bytes.Repeat([]byte("log line\n"), 1024), content)
+		}
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		memory := storage.NewMemory()
+		assert.Nil(t, memory.WriteFile("test.7z", []byte("7z\xbc\xaf\x27\x1c\x00\x04"), time.Now()))
+		assert.Nil(t, memory.WriteFile("test.tar.gz", bytes.Repeat([]byte("random"), 100), time.Now()))
+		handler, err := GetWithStorage(subStorage(memory, "test.7z"), subStorage(memory, "out"), 0, 0, false, false)
+		assert.Nil(t, err)
+		err = handler.Decompress()
+		var unsupported *compress.UnsupportedError
+		assert.True(t, errors.As(err, &unsupported))
+		assert.Contains(t, err.Error(), "7z")
+		handler, err = GetWithStorage(subStorage(memory, "test.tar.gz"), subStorage(memory, "out"), 0, 0, false, false)
+		assert.Nil(t, err)
+		err = handler.Decompress()
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "unknown")
+		_, err = memory.Stat("out")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
 }
@@ -0,0 +1,14 @@
+package copy
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// dropCache 把文件刷盘后从 page cache 中清除，校验时重新读取的才是磁盘上的真实数据
+func dropCache(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
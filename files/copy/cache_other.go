@@ -0,0 +1,9 @@
+//go:build !linux
+
+package copy
+
+import "os"
+
+func dropCache(file *os.File) error {
+	return file.Sync()
+}
@@ -0,0 +1,52 @@
+package copy
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/progress"
+	"sync/atomic"
+)
+
+// changeRetry retry 策略下源文件在复制过程中被修改后重新复制的次数
+const changeRetry = 3
+
+// copyStable 复制前后比较源文件的大小、修改时间和 ctime，复制过程中源文件被修改时按照 OnChange 处理，
+// warn 策略保留复制的内容并返回 changed
+func (c *CopyFiles) copyStable(fileInfo *TodoFile, offset int64, resume bool, tracker *progress.Tracker) (sourceSum []byte, strategy CopyStrategy, attempts int, changed bool, err error) {
+	for retries := 0; ; retries++ {
+		before, err := c.sourceState(fileInfo.FileInfo.Path)
+		if err != nil {
+			return nil, "", attempts + 1, false, errors.Wrap(err, "get source file state error")
+		}
+		var copyAttempts int
+		sourceSum, strategy, copyAttempts, err = c.copyWithRetry(fileInfo, offset, resume, tracker)
+		attempts += copyAttempts
+		if err != nil {
+			return nil, strategy, attempts, false, err
+		}
+		after, err := c.sourceState(fileInfo.FileInfo.Path)
+		if err != nil {
+			return nil, strategy, attempts, false, errors.Wrap(err, "get source file state error")
+		}
+		changeErr := before.Compare(after)
+		if changeErr == nil {
+			return sourceSum, strategy, attempts, false, nil
+		}
+		changeErr = errors.Wrapf(changeErr, "source file %v", fileInfo.FileInfo.Path)
+		switch c.OnChange {
+		case paths.ChangeRetry:
+			if retries < changeRetry {
+				log.Warn("%v, copy again %v/%v", changeErr, retries+1, changeRetry)
+				offset, resume = 0, false
+				continue
+			}
+		case paths.ChangeFail:
+		default:
+			log.Warn("%v, keep the copied content", changeErr)
+			atomic.AddInt64(&c.ChangedNumber, 1)
+			return sourceSum, strategy, attempts, true, nil
+		}
+		return nil, strategy, attempts, false, changeErr
+	}
+}
@@ -0,0 +1,171 @@
+package copy
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/progress"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	StrategyChunked CopyStrategy = "chunked" // 大文件切分成多个块并行复制
+)
+
+func (c *CopyFiles) isChunked(todoFile *TodoFile) bool {
+	return c.ChunkThreshold > 0 && todoFile.FileInfo.Size > c.ChunkThreshold
+}
+
+// chunkCopy 把大文件切分成 ChunkSize 大小的块，由当前协程和从协程池借到的空闲协程一起用 ReadAt/WriteAt 复制。
+// 借不到空闲协程时当前协程自己复制所有块，所以 Parallelism 仍然是全局并发上限
+func (c *CopyFiles) chunkCopy(todoFile *TodoFile, resume bool, tracker *progress.Tracker) ([]byte, CopyStrategy, error) {
+	sourceFile, err := os.Open(todoFile.FileInfo.Path)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "open source file error")
+	}
+	defer func() {
+		if err := sourceFile.Close(); err != nil {
+			log.Debug(err.Error())
+		}
+	}()
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "get source file info error")
+	}
+	destination, err := os.OpenFile(todoFile.TargetPath, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "open target file path %v error", todoFile.TargetPath)
+	}
+	defer func() {
+		if err := destination.Close(); err != nil {
+			log.Debug(err.Error())
+		}
+	}()
+	doneChunks := map[int64]int64{}
+	if resume {
+		doneChunks = c.journal.doneChunks(todoFile)
+	}
+	// 没有完成的块时丢弃临时文件中上次写入的所有内容，稀疏复制不会覆盖空洞部分
+	if len(doneChunks) == 0 {
+		if err := destination.Truncate(0); err != nil {
+			return nil, "", errors.Wrapf(err, "truncate target file %v error", todoFile.TargetPath)
+		}
+	}
+	size := sourceInfo.Size()
+	if err := destination.Truncate(size); err != nil {
+		return nil, "", errors.Wrapf(err, "truncate target file %v error", todoFile.TargetPath)
+	}
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = journalCommitSize
+	}
+	var starts []int64
+	var done int64
+	for start := int64(0); start < size; start += chunkSize {
+		if length, ok := doneChunks[start]; ok && length == chunkLength(start, chunkSize, size) {
+			done += length
+			continue
+		}
+		starts = append(starts, start)
+	}
+	tracker.Resume(done)
+	if len(doneChunks) > 0 {
+		log.Debug("resume file %v, %v chunks left", todoFile.FileInfo.Path, len(starts))
+	}
+
+	sparse := isSparse(sourceInfo)
+	var next int64
+	var failed atomic.Bool
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	var work func(borrow bool)
+	work = func(borrow bool) {
+		for !failed.Load() {
+			index := atomic.AddInt64(&next, 1) - 1
+			if index >= int64(len(starts)) {
+				return
+			}
+			// 其他文件复制结束后协程池中会有空闲位置，每个块开始前都尝试借用
+			for borrow && atomic.LoadInt64(&next) < int64(len(starts)) && c.pool.TryAdd() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer c.pool.Done()
+					work(false)
+				}()
+			}
+			if err := c.ctx.Err(); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+				})
+				failed.Store(true)
+				return
+			}
+			start := starts[index]
+			length := chunkLength(start, chunkSize, size)
+			if err := c.copyChunk(destination, sourceFile, start, length, sparse); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+				})
+				failed.Store(true)
+				return
+			}
+			c.journal.commitChunk(todoFile, start, length)
+			tracker.Add(length)
+		}
+	}
+	work(true)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, "", firstErr
+	}
+	if len(c.Verify) == 0 {
+		return nil, StrategyChunked, nil
+	}
+	// 分块复制没有顺序，校验时单独读取一遍源文件计算哈希
+	if err := dropCache(destination); err != nil {
+		return nil, "", errors.Wrapf(err, "flush target file %v error", todoFile.TargetPath)
+	}
+	sourceSum, err := fileChecksum(todoFile.FileInfo.Path, c.Verify)
+	if err != nil {
+		return nil, "", err
+	}
+	return sourceSum, StrategyChunked, nil
+}
+
+// copyChunk 复制一个块，Durable 时落盘，失败时重试 ChunkRetry 次
+func (c *CopyFiles) copyChunk(destination, source *os.File, start, length int64, sparse bool) error {
+	var err error
+	for attempt := 0; attempt <= c.ChunkRetry; attempt++ {
+		if attempt > 0 {
+			log.Warn("copy chunk [%v, %v) of %v error: %v, retry %v/%v", start, start+length, source.Name(), err, attempt, c.ChunkRetry)
+		}
+		if c.Throttle.LimitsBytes() {
+			err = bufferedCopy(c.Throttle.Writer(io.NewOffsetWriter(destination, start)),
+				c.Throttle.Reader(io.NewSectionReader(source, start, length)), start, noCommit)
+		} else {
+			err = chunkRange(destination, source, start, length, sparse)
+		}
+		if err != nil {
+			continue
+		}
+		if c.Durable {
+			if err = destination.Sync(); err != nil {
+				err = errors.Wrapf(err, "sync target file %v error", destination.Name())
+				continue
+			}
+		}
+		return nil
+	}
+	return errors.Wrapf(err, "copy chunk [%v, %v) error", start, start+length)
+}
+
+func chunkLength(start, chunkSize, size int64) int64 {
+	if size-start < chunkSize {
+		return size - start
+	}
+	return chunkSize
+}
@@ -0,0 +1,212 @@
+package copy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/paths"
+	"go_tools/storage"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+type ConflictPolicy string
+
+const (
+	ConflictOverwrite     ConflictPolicy = "overwrite"          // 覆盖已有目标，类型冲突时删除已有目标
+	ConflictSkip          ConflictPolicy = "skip"               // 保留已有目标，不复制
+	ConflictUpdateIfNewer ConflictPolicy = "update-if-newer"    // 源文件比已有目标新时覆盖，否则跳过
+	ConflictRename        ConflictPolicy = "rename-with-suffix" // 已有目标重命名为 name_1.ext 这样带后缀的名字后再复制
+	ConflictBackup        ConflictPolicy = "backup-to-dir"      // 已有目标按相对路径移动到 BackupDir 后再复制
+	ConflictFail          ConflictPolicy = "fail"               // 记录为失败，不复制
+)
+
+type ConflictResolution string
+
+const (
+	ResolutionOverwritten ConflictResolution = "overwritten"
+	ResolutionSkipped     ConflictResolution = "skipped"
+	ResolutionRenamed     ConflictResolution = "renamed"
+	ResolutionBackedUp    ConflictResolution = "backed_up"
+	ResolutionFailed      ConflictResolution = "failed"
+)
+
+const backupSuffix = ".co_backup"
+
+func checkConflictPolicy(policy ConflictPolicy) error {
+	switch policy {
+	case ConflictOverwrite, ConflictSkip, ConflictUpdateIfNewer, ConflictRename, ConflictBackup, ConflictFail:
+		return nil
+	default:
+		return fmt.Errorf("unknown conflict policy: %v", policy)
+	}
+}
+
+// getBackupDir 没有指定 BackupDir 时备份到目标路径旁边的 <target>.co_backup 目录，存储路径保留其中的参数
+func getBackupDir(targetPath string) string {
+	if storage.IsRemote(targetPath) {
+		if u, err := url.Parse(targetPath); err == nil {
+			u.Path = strings.TrimSuffix(u.Path, "/") + backupSuffix
+			return u.String()
+		}
+	}
+	return filepath.Clean(targetPath) + backupSuffix
+}
+
+// openBackup backup-to-dir 策略打开备份目录所在的存储
+func (c *CopyFiles) openBackup() error {
+	c.backup = nil
+	if c.Conflict != ConflictBackup {
+		return nil
+	}
+	backupDir := c.BackupDir
+	if len(backupDir) == 0 {
+		backupDir = getBackupDir(c.TargetPath)
+	}
+	backup, err := storage.Open(backupDir)
+	if err != nil {
+		return errors.Wrapf(err, "open backup dir %v error", backupDir)
+	}
+	c.backup = backup
+	c.opened = append(c.opened, backup)
+	return nil
+}
+
+// decideConflict 按照 Conflict 策略决定如何处理已经存在的目标，目标是目录且源也是目录时不算冲突
+func (c *CopyFiles) decideConflict(fileInfo *paths.FileInfo, targetIsDir bool, targetUpdatedAt int64) ConflictResolution {
+	switch c.Conflict {
+	case ConflictSkip:
+		return ResolutionSkipped
+	case ConflictUpdateIfNewer:
+		// 类型冲突时比较修改时间没有意义，按照源路径更新
+		if fileInfo.IsDir != targetIsDir || fileInfo.UpdatedAt > targetUpdatedAt {
+			return ResolutionOverwritten
+		}
+		return ResolutionSkipped
+	case ConflictRename:
+		return ResolutionRenamed
+	case ConflictBackup:
+		return ResolutionBackedUp
+	case ConflictFail:
+		return ResolutionFailed
+	default:
+		return ResolutionOverwritten
+	}
+}
+
+// resolveConflict 目标已经存在时按照 Conflict 策略处理并记录，返回 false 表示不需要再复制
+func (c *CopyFiles) resolveConflict(todoFile *TodoFile) (bool, error) {
+	targetInfo, err := c.statTarget(todoFile.TargetPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return true, nil
+		}
+		return false, errors.Wrapf(err, "get target %v info error", todoFile.TargetPath)
+	}
+	typeConflict := todoFile.FileInfo.IsDir != targetInfo.IsDir
+	if todoFile.FileInfo.IsDir && !typeConflict {
+		return true, nil
+	}
+	item := ConflictItem{
+		SourcePath:   todoFile.FileInfo.Path,
+		TargetPath:   todoFile.TargetPath,
+		TypeConflict: typeConflict,
+		Policy:       c.Conflict,
+		Resolution:   c.decideConflict(todoFile.FileInfo, targetInfo.IsDir, targetInfo.UpdatedAt),
+	}
+	switch item.Resolution {
+	case ResolutionSkipped:
+		c.addConflict(item)
+		c.addSkip(todoFile.FileInfo.Path, todoFile.TargetPath, todoFile.FileInfo.Size)
+		return false, nil
+	case ResolutionFailed:
+		c.addConflict(item)
+		c.addFail(FailItem{
+			Path:   todoFile.FileInfo.Path,
+			Reason: fmt.Sprintf("target %v already exists", todoFile.TargetPath),
+			Type:   FailTypeConflict,
+		})
+		return false, nil
+	case ResolutionRenamed:
+		// 选好的名字可能在 rename 之前被其他并发复制的文件占用，不覆盖，换下一个名字重试
+		for {
+			item.MovedTo = uniquePath(todoFile.TargetPath, c.targetExists)
+			err := c.renameTarget(todoFile.TargetPath, item.MovedTo)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, os.ErrExist) {
+				return false, errors.Wrapf(err, "move conflict target %v to %v error", todoFile.TargetPath, item.MovedTo)
+			}
+		}
+	case ResolutionBackedUp:
+		if item.MovedTo, err = c.backupTarget(todoFile.TargetPath); err != nil {
+			return false, err
+		}
+	default:
+		// 符号链接也要删除，否则写入会穿过链接修改链接指向的文件
+		if typeConflict || targetInfo.IsSymlink {
+			if err := c.removeTarget(todoFile.TargetPath); err != nil {
+				return false, errors.Wrapf(err, "remove conflict target %v error", todoFile.TargetPath)
+			}
+		}
+		if !typeConflict {
+			// 重复复制时大部分目标都会被覆盖，不逐个记录
+			atomic.AddInt64(&c.OverwriteNumber, 1)
+			return true, nil
+		}
+		c.addConflict(item)
+		return true, nil
+	}
+	c.addConflict(item)
+	return true, nil
+}
+
+// backupTarget 把已有目标按照相对目标路径的位置移动到备份目录，返回移动后的路径。
+// 本地目录之间直接 rename，否则复制到备份存储后删除
+func (c *CopyFiles) backupTarget(targetPath string) (string, error) {
+	relPath, err := storage.RelPath(c.target, targetPath)
+	if err != nil {
+		return "", err
+	}
+	movedRel := uniquePath(relPath, func(path string) bool {
+		_, err := c.backup.Stat(path)
+		return err == nil
+	})
+	movedTo := storage.Location(c.backup, movedRel)
+	if err := c.backup.MkdirAll(storage.Join(movedRel, "..")); err != nil {
+		return "", errors.Wrapf(err, "make backup dir of %v error", movedTo)
+	}
+	if _, ok := c.backup.(*storage.Local); ok && c.localTarget() {
+		err = os.Rename(targetPath, movedTo)
+	} else {
+		err = storage.Move(c.target, relPath, c.backup, movedRel)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "move conflict target %v to %v error", targetPath, movedTo)
+	}
+	return movedTo, nil
+}
+
+func (c *CopyFiles) addConflict(item ConflictItem) {
+	c.Lock()
+	c.Conflicts = append(c.Conflicts, item)
+	c.Unlock()
+}
+
+// uniquePath 返回 path 或者在扩展名前加上 _1、_2 这样后缀的第一个不存在的路径
+func uniquePath(path string, exists func(path string) bool) string {
+	if !exists(path) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%v_%v%v", base, i, ext)
+		if !exists(candidate) {
+			return candidate
+		}
+	}
+}
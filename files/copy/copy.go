@@ -1,184 +1,775 @@
 package copy
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"go_tools/env"
+	"go_tools/gopool"
 	"go_tools/log"
 	"go_tools/paths"
+	"go_tools/progress"
+	"go_tools/report"
+	"go_tools/retry"
+	"go_tools/storage"
+	"go_tools/throttle"
+	"hash"
 	"io"
 	"os"
-	"path/filepath"
-	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	maxCacheSize = 110 * 1024 * 1024
-)
-
 type CopyFiles struct {
-	SourcePath  string        `json:"source_path"`
-	TargetPath  string        `json:"target_path"`
-	FailFiles   []FailItem    `json:"fail_files"`
-	FileNumber  int64         `json:"file_number"`
-	DirNumber   int64         `json:"dir_number"`
-	todoFileNum int           `json:"-"`
-	todoFiles   chan TodoFile `json:"-"`
-	endFlag     bool          `json:"-"`
+	SourcePath   string        `json:"source_path"`
+	TargetPath   string        `json:"target_path"`
+	Parallelism  int           `json:"parallelism"`
+	FailFiles    []FailItem    `json:"fail_files"`
+	FileNumber   int64         `json:"file_number"`
+	DirNumber    int64         `json:"dir_number"`
+	SkipNumber   int64         `json:"skip_number"`
+	DeleteNumber int64         `json:"delete_number"`
+	LinkNumber   int64         `json:"link_number"`  // 创建的符号链接和硬链接数量
+	Resume       bool          `json:"resume"`       // 根据目标路径旁的 journal 跳过已完成文件，并从断点继续复制
+	Sync         bool          `json:"sync"`         // 增量同步，只复制大小或修改时间变化的文件
+	Checksum     bool          `json:"checksum"`     // 同步模式下大小和修改时间相同的文件再比较内容
+	Delete       bool          `json:"delete"`       // 同步模式下删除源路径中已经不存在的目标文件
+	Verify       HashAlgorithm `json:"verify"`       // 复制后重新读取目标文件校验哈希，为空时不校验
+	VerifyRetry  int           `json:"verify_retry"` // 校验失败后重新复制的次数
+	Preserve     Preserve      `json:"preserve"`     // 复制后保留的元数据
+	Symlink      SymlinkPolicy `json:"symlink"`      // 符号链接处理策略，默认 copy-link
+	Hardlink     bool          `json:"hardlink"`     // 在目标路径重建硬链接组，而不是复制多份内容
+	// 超过这个大小的文件切分成 ChunkSize 大小的块并行复制，为 0 时不分块
+	ChunkThreshold int64 `json:"chunk_threshold"`
+	ChunkSize      int64 `json:"chunk_size"`
+	ChunkRetry     int   `json:"chunk_retry"` // 每个块失败后的重试次数
+	// 过滤规则，为空时复制所有文件
+	Filter *paths.Filter `json:"filter"`
+	DryRun bool          `json:"dry_run"` // 只生成复制计划，不修改目标路径
+	Plan   *Plan         `json:"plan"`    // DryRun 生成的复制计划
+	// 目标已经存在时的处理策略，默认 overwrite。覆盖同类型的已有目标只计数到 OverwriteNumber，
+	// 其他处理结果逐个记录在 Conflicts 中
+	Conflict        ConflictPolicy `json:"conflict"`
+	BackupDir       string         `json:"backup_dir"` // backup-to-dir 策略的备份目录，默认 <target>.co_backup
+	Conflicts       []ConflictItem `json:"conflicts"`
+	OverwriteNumber int64          `json:"overwrite_number"`
+	// 文件先写入目标目录下的隐藏临时文件再 rename，Durable 时 rename 前后 fsync 文件和目录，
+	// 每次向 journal 提交进度前也先 fsync。没有 Durable 时 resume 只能从进程中断恢复，断电后已提交的进度可能没有落盘
+	Durable bool `json:"durable"`
+	// 所有协程共享的读写带宽和每秒文件数限制，为空时不限制
+	Throttle *throttle.Throttle `json:"-"`
+	// 字节级进度，为空时 Copy 创建一个输出到标准错误的进度，库的使用者可以传入自己的进度注册回调
+	Progress *progress.Progress `json:"-"`
+	// 每个文件的处理结果和失败原因，为空时不记录
+	Report *report.Report `json:"-"`
+	// 暂时性 I/O 错误的重试策略，为空时不重试
+	Retry *retry.Policy `json:"retry"`
+	// 移动文件，同一个文件系统中直接 rename，否则复制、校验并落盘后删除源文件，最后删除移空的源目录
+	Move bool `json:"move"`
+	// 复制过程中源文件被修改时的处理策略，默认 warn
+	OnChange      paths.ChangePolicy `json:"on_change"`
+	ChangedNumber int64              `json:"changed_number"` // 复制过程中被修改、按照 warn 策略保留了内容的文件数量
+	// 按内容去重，相同内容只复制一次，其他文件按照这个模式链接到已经复制的目标文件，为空时不去重
+	Dedup DedupMode `json:"dedup"`
+	// 内容索引的保存路径，默认 <target>.co_copy.dedup，下次复制到同一个目标时复用
+	DedupIndex  string `json:"dedup_index"`
+	DedupNumber int64  `json:"dedup_number"` // 链接到已有内容而没有复制的文件数量
+	DedupBytes  int64  `json:"dedup_bytes"`  // 去重节省的字节数
+	// 目标文件系统的可用空间小于需要写入的大小时仍然开始复制
+	Force       bool  `json:"force"`
+	CopiedBytes int64 `json:"copied_bytes"` // 已经完整写入目标的文件大小之和
+	// 源和目标所在的存储，为空时根据 SourcePath 和 TargetPath 打开。都是本地目录时使用本地文件系统的复制策略，
+	// 否则通过存储接口流式复制，不支持分块、链接和去重
+	SourceStorage storage.Storage `json:"-"`
+	TargetStorage storage.Storage `json:"-"`
+	// 实际使用的源、目标和 backup-to-dir 策略的备份存储，以及复制时打开、结束后需要关闭的存储
+	source storage.Storage
+	target storage.Storage
+	backup storage.Storage
+	opened []storage.Storage
+	// 源和目标可能在同一个文件系统中，rename 失败一次后不再尝试
+	renameable atomic.Bool
+	// 格式化后的源路径和目标路径
+	sourcePath string
+	targetPath string
+	ctx        context.Context
+	// 取消 ctx 并记录原因，目标没有空间时停止整个复制
+	stop context.CancelCauseFunc
+	// 每种复制策略复制的文件数量
+	Strategies map[CopyStrategy]int64 `json:"strategies"`
+	pool       *gopool.Pool
+	journal    *journal
+	// 本次遍历到的源文件对应的目标路径，镜像删除时使用
+	sourceTargets map[string]struct{}
+	// 遍历到的目录，所有文件复制完成后再设置目录元数据
+	dirs []TodoFile
+	// 因为冲突没有创建的目标目录，不再处理其中的文件
+	skippedDirs []string
+	// 硬链接组中第一个复制的文件，以及等待链接到它的文件
+	hardlinks    map[hardlinkKey]*TodoFile
+	pendingLinks []TodoFile
+	dedup        *dedupIndex
 	sync.RWMutex
 }
 
-func Get(oriPath, targetPath string) (*CopyFiles, error) {
+func Get(oriPath, targetPath string, parallelism int) (*CopyFiles, error) {
 	if len(oriPath) == 0 {
 		return nil, errors.New("source path is empty")
 	}
 	if len(targetPath) == 0 {
 		return nil, errors.New("target path is empty")
 	}
+	if parallelism <= 0 {
+		parallelism = env.GetCpuCores()
+	}
 	return &CopyFiles{
-		SourcePath: oriPath,
-		TargetPath: targetPath,
-		FailFiles:  []FailItem{},
-		todoFiles:  make(chan TodoFile, runtime.NumCPU()*2),
-		endFlag:    false,
+		SourcePath:  oriPath,
+		TargetPath:  targetPath,
+		Parallelism: parallelism,
+		FailFiles:   []FailItem{},
+		Strategies:  map[CopyStrategy]int64{},
 	}, nil
 }
 
+// Copy 遍历源路径并使用 Parallelism 个协程并行复制文件，所有文件复制结束后才返回。
+// DryRun 时只生成复制计划保存到 Plan 中，不修改目标路径
 func (c *CopyFiles) Copy() ([]FailItem, error) {
-	oriPathFormatted, err := filepath.Abs(c.SourcePath)
-	if err != nil {
-		return nil, errors.Wrapf(err, "format source path %v error", c.SourcePath)
+	return c.CopyWithContext(context.Background())
+}
+
+// CopyWithContext ctx 取消后不再提交新的文件，正在复制的文件在下一次读取或提交进度时停止，
+// 停止的文件只留下临时文件和 journal 中的进度，可以 resume 继续。返回已经记录的失败文件和取消的原因
+func (c *CopyFiles) CopyWithContext(ctx context.Context) ([]FailItem, error) {
+	defer c.begin(ctx)()
+	if err := c.prepare(); err != nil {
+		return nil, err
 	}
-	targetPathFormatted, err := filepath.Abs(c.TargetPath)
-	if err != nil {
-		return nil, errors.Wrapf(err, "format target path %v error", c.TargetPath)
+	if c.DryRun {
+		plan, err := c.buildPlan()
+		if err != nil {
+			return nil, err
+		}
+		c.Plan = plan
+		return c.FailFiles, nil
 	}
-	ticker := time.NewTicker(time.Second * 3)
-	go func() {
-		for {
-			<-ticker.C
-			log.Info("copy success dir number: %v && file number: %v, failed number: %v", c.DirNumber, c.FileNumber, len(c.FailFiles))
+	if err := c.checkSpace(); err != nil {
+		return nil, err
+	}
+	if err := c.openJournal(c.Resume); err != nil {
+		return nil, err
+	}
+	stop := c.startProgress(c.scanSource)
+	defer stop()
+	// 生产者，遍历需要 copy 的文件，每个文件占用协程池中的一个位置
+	err := c.walkSource(c.doCopy)
+	return c.finish(err, c.Sync && c.Delete)
+}
+
+// begin 使用可以由复制内部停止的 ctx，返回的函数在复制结束后释放 ctx 并关闭复制时打开的存储
+func (c *CopyFiles) begin(ctx context.Context) func() {
+	c.ctx, c.stop = context.WithCancelCause(ctx)
+	return func() {
+		c.stop(nil)
+		c.closeStorages()
+	}
+}
+
+// prepare 检查参数并初始化一次复制需要的状态
+func (c *CopyFiles) prepare() error {
+	if c.ctx == nil {
+		c.ctx = context.Background()
+	}
+	if err := c.openStorages(); err != nil {
+		return err
+	}
+	c.sourcePath = storage.Location(c.source, "")
+	c.targetPath = storage.Location(c.target, "")
+	if len(c.Verify) > 0 {
+		if _, err := NewHash(c.Verify); err != nil {
+			return err
 		}
-	}()
+	}
+	if len(c.Symlink) == 0 {
+		c.Symlink = SymlinkCopyLink
+	}
+	if err := checkSymlinkPolicy(c.Symlink); err != nil {
+		return err
+	}
+	if err := c.prepareMove(); err != nil {
+		return err
+	}
+	if len(c.Conflict) == 0 {
+		c.Conflict = ConflictOverwrite
+	}
+	if err := checkConflictPolicy(c.Conflict); err != nil {
+		return err
+	}
+	if err := c.openBackup(); err != nil {
+		return err
+	}
+	if c.Hardlink && !c.local() {
+		log.Warn("hardlink is not supported when copying from %v to %v, copy linked files separately", c.source, c.target)
+		c.Hardlink = false
+	}
+	if len(c.OnChange) == 0 {
+		c.OnChange = paths.ChangeWarn
+	}
+	if err := paths.CheckChangePolicy(c.OnChange); err != nil {
+		return err
+	}
+	c.dedup = nil
+	if len(c.Dedup) > 0 {
+		if err := checkDedupMode(c.Dedup); err != nil {
+			return err
+		}
+		if !c.local() {
+			return fmt.Errorf("dedup is not supported when copying from %v to %v", c.source, c.target)
+		}
+		if !c.DryRun {
+			indexPath := c.DedupIndex
+			if len(indexPath) == 0 {
+				indexPath = getDedupIndexPath(c.targetPath)
+			}
+			var err error
+			if c.dedup, err = loadDedupIndex(indexPath); err != nil {
+				return err
+			}
+		}
+	}
+	c.pool = gopool.New(c.Parallelism)
+	c.sourceTargets = map[string]struct{}{}
+	c.dirs = nil
+	c.skippedDirs = nil
+	c.hardlinks = map[hardlinkKey]*TodoFile{}
+	c.pendingLinks = nil
+	return nil
+}
+
+// startProgress 开始统计进度，scan 在后台预扫描总大小，返回的函数等待预扫描结束并输出最后一次进度
+func (c *CopyFiles) startProgress(scan func()) func() {
+	if c.Progress == nil {
+		c.Progress = progress.Default("copy")
+	}
+	return c.Progress.Begin(scan)
+}
+
+// scanSource 使用和复制相同的遍历参数统计需要复制的文件总大小
+func (c *CopyFiles) scanSource() {
+	c.scanPath(c.sourcePath)
+}
+
+func (c *CopyFiles) scanPath(root string) {
+	err := c.iterSource(root, func(fileInfo *paths.FileInfo, iterErr error) error {
+		if iterErr == nil && !fileInfo.IsDir && !fileInfo.IsSymlink {
+			c.Progress.AddTotal(fileInfo.Size, 1)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debug("scan source path %v error: %v", root, err)
+	}
+}
 
-	// 消费者，执行复制文件逻辑
-	go c.copyFile()
+// walkSource 遍历源路径，把每个路径和对应的目标路径交给 doFunc，遍历和处理错误记录为失败
+func (c *CopyFiles) walkSource(doFunc func(fileInfo *paths.FileInfo, targetPath string) error) error {
+	return c.walkPath(c.sourcePath, doFunc)
+}
 
-	// 生产者，生产需要 copy 的文件列表
-	_, err = paths.DoIterPath(c.SourcePath, func(fileInfo *paths.FileInfo, iterErr error) error {
+// walkPath 遍历源路径中的 root
+func (c *CopyFiles) walkPath(root string, doFunc func(fileInfo *paths.FileInfo, targetPath string) error) error {
+	return c.iterSource(root, func(fileInfo *paths.FileInfo, iterErr error) error {
 		if iterErr != nil {
-			c.FailFiles = append(c.FailFiles, FailItem{
-				Path:   fileInfo.Path,
-				Reason: iterErr.Error(),
-			})
+			c.addFailItem(fileInfo.Path, iterErr)
 			return nil
 		}
 		defer func() {
 			if err := recover(); err != nil {
-				c.FailFiles = append(c.FailFiles, FailItem{
-					Path:   fileInfo.Path,
-					Reason: fmt.Sprintf("%v", err),
-				})
+				c.addFailItem(fileInfo.Path, fmt.Errorf("%v", err))
 				log.Warn("%v", err)
 			}
 		}()
-		targetFilePath := strings.ReplaceAll(fileInfo.Path, oriPathFormatted, targetPathFormatted)
-		if err = c.doCopy(fileInfo, targetFilePath); err != nil {
-			c.FailFiles = append(c.FailFiles, FailItem{
-				Path:   fileInfo.Path,
-				Reason: err.Error(),
-			})
+		targetFilePath, err := c.targetOf(fileInfo.Path)
+		if err != nil {
+			c.addFailItem(fileInfo.Path, err)
 			return nil
 		}
+		if c.inSkippedDir(targetFilePath) {
+			return nil
+		}
+		if err := doFunc(fileInfo, targetFilePath); err != nil {
+			c.addFailItem(fileInfo.Path, err)
+		}
 		return nil
-	}, false, true)
-	if err != nil {
-		return nil, err
+	})
+}
+
+// inSkippedDir 目标路径的某个上级目录因为冲突没有创建
+func (c *CopyFiles) inSkippedDir(targetPath string) bool {
+	for _, dir := range c.skippedDirs {
+		if isUnder(targetPath, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish 等待所有文件复制完成，再创建硬链接、删除多余文件和设置目录元数据
+func (c *CopyFiles) finish(err error, deleteExtraneous bool) ([]FailItem, error) {
+	// 遍历出错时也需要等待已经提交的文件复制完成
+	c.pool.Wait()
+	// 遍历结束后才取消时，正在复制的文件也没有完成；复制内部停止时返回停止的原因
+	if err == nil || err == c.ctx.Err() {
+		err = context.Cause(c.ctx)
+	}
+	c.createHardlinks()
+	c.createDedupLinks()
+	if err == nil && deleteExtraneous {
+		// 源路径有遍历或复制失败时不能确定哪些文件真的被删除了
+		if failNumber := c.failNumber(); failNumber > 0 {
+			log.Warn("skip deleting extraneous files because %v files failed", failNumber)
+		} else {
+			err = c.deleteExtraneous(c.targetPath)
+		}
 	}
-	c.endFlag = true
-	return c.FailFiles, nil
+	if err == nil {
+		c.applyDirMetadata(c.Preserve)
+		if c.Move {
+			c.removeMovedDirs()
+		}
+	}
+	// 有失败文件或者取消时保留 journal，方便下次 resume 重试
+	c.journal.close(err == nil && len(c.FailFiles) == 0)
+	c.Report.Finish(c.FailFiles, err)
+	return c.FailFiles, err
 }
 
 func (c *CopyFiles) doCopy(fileInfo *paths.FileInfo, targetPath string) error {
+	c.sourceTargets[targetPath] = struct{}{}
 	if fileInfo.IsDir {
-		c.DirNumber += 1
-		if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
-			return errors.Wrapf(err, "make dir %v error", targetPath)
+		if err := c.makeDir(&TodoFile{
+			FileInfo:   fileInfo,
+			TargetPath: targetPath,
+		}); err != nil {
+			return err
 		}
 		if len(fileInfo.Includes) > 0 {
 			for _, info := range fileInfo.Includes {
-				if err := c.doCopy(info, filepath.Join(targetPath, info.Name)); err != nil {
+				includeTarget, err := c.targetOf(info.Path)
+				if err != nil {
+					return err
+				}
+				if err := c.doCopy(info, includeTarget); err != nil {
 					return err
 				}
 			}
 		}
+	} else if fileInfo.IsSymlink {
+		if c.Symlink == SymlinkSkip {
+			c.addSkip(fileInfo.Path, targetPath, fileInfo.Size)
+			return nil
+		}
+		return c.copySymlink(&TodoFile{
+			FileInfo:   fileInfo,
+			TargetPath: targetPath,
+		})
 	} else {
-		c.Lock()
-		c.FileNumber += 1
-		c.todoFileNum += 1
-		c.Unlock()
-		c.todoFiles <- TodoFile{
+		todoFile := TodoFile{
 			FileInfo:   fileInfo,
 			TargetPath: targetPath,
 		}
+		if c.Hardlink && fileInfo.Links > 1 && c.addHardlink(&todoFile) {
+			c.Progress.Skip(fileInfo.Size)
+			return nil
+		}
+		if c.Resume && c.journal.isDone(&todoFile) {
+			// 上次移动时已经复制完成，但是还没有删除源文件
+			if err := c.verifyMoved(&todoFile); err != nil {
+				log.Warn("%v, copy again", err)
+				c.submit(&todoFile)
+				return nil
+			}
+			c.removeMoved(&todoFile)
+			c.addSkip(fileInfo.Path, targetPath, fileInfo.Size)
+			c.Progress.Skip(fileInfo.Size)
+			return nil
+		}
+		c.submit(&todoFile)
+	}
+	return nil
+}
+
+// makeDir 按照冲突策略处理目标路径已有的非目录文件后创建目录，不能创建时跳过目录中的所有文件
+func (c *CopyFiles) makeDir(todoFile *TodoFile) error {
+	ok, err := c.resolveConflict(todoFile)
+	if err != nil || !ok {
+		c.skippedDirs = append(c.skippedDirs, todoFile.TargetPath)
+		return err
+	}
+	atomic.AddInt64(&c.DirNumber, 1)
+	if err := c.mkdirTarget(todoFile.TargetPath); err != nil {
+		return err
 	}
+	c.dirs = append(c.dirs, *todoFile)
 	return nil
 }
 
-func (c *CopyFiles) copyFile() {
-	for true {
-		fileInfo := <-c.todoFiles
-		c.Lock()
-		c.todoFileNum -= 1
-		c.Unlock()
-		c.copyItem(&fileInfo)
-		if c.endFlag && c.todoFileNum == 0 { // 遍历已经结束，而且所有待 copy 文件已经进入 copy 流程。只需要等待所有 copy 协程结束就可以了
+// submit 占用协程池中的一个位置复制文件，协程池满或者超过每秒文件数限制时阻塞
+func (c *CopyFiles) submit(todoFile *TodoFile) {
+	c.Throttle.WaitFile()
+	c.pool.Add(1)
+	go func() {
+		defer c.pool.Done()
+		// 等待协程池期间已经取消
+		if c.ctx.Err() != nil {
+			return
+		}
+		copied := false
+		defer func() {
+			// 没有复制的文件也计入进度，否则进度到不了 100%
+			if !copied {
+				c.Progress.Skip(todoFile.FileInfo.Size)
+			}
+		}()
+		if c.Sync {
+			need, err := c.needCopy(todoFile)
+			if err != nil {
+				c.addFailItem(todoFile.FileInfo.Path, err)
+				return
+			}
+			if !need {
+				c.addSkip(todoFile.FileInfo.Path, todoFile.TargetPath, todoFile.FileInfo.Size)
+				return
+			}
+		}
+		// 重复文件等所有文件复制完成后再链接，链接时处理冲突
+		if c.dedupFile(todoFile) {
 			return
 		}
+		// 上次中断时复制了一部分的目标文件需要继续复制，不按冲突处理
+		if !c.Resume || !c.journal.started(c.tempTodoFile(todoFile)) {
+			ok, err := c.resolveConflict(todoFile)
+			if err != nil {
+				c.addFailItem(todoFile.FileInfo.Path, err)
+				return
+			}
+			if !ok {
+				return
+			}
+		}
+		copied = true
+		if c.renameFile(todoFile) {
+			return
+		}
+		atomic.AddInt64(&c.FileNumber, 1)
+		c.copyItem(todoFile)
+	}()
+}
+
+func (c *CopyFiles) addFailItem(path string, err error) {
+	c.addFail(report.NewFailItem(path, err))
+}
+
+func (c *CopyFiles) addFail(item FailItem) {
+	c.Lock()
+	c.FailFiles = append(c.FailFiles, item)
+	c.Unlock()
+	if c.journal != nil {
+		c.journal.fail(item)
+	}
+}
+
+// failType 取消导致的失败单独标记，下次 resume 时继续
+func (c *CopyFiles) failType(err error) FailType {
+	if c.ctx.Err() != nil {
+		return FailTypeCanceled
 	}
+	return report.Classify(err)
+}
+
+// addSkip 记录一个不需要处理的路径
+func (c *CopyFiles) addSkip(sourcePath, targetPath string, size int64) {
+	atomic.AddInt64(&c.SkipNumber, 1)
+	c.Report.Add(report.FileItem{
+		SourcePath: sourcePath,
+		TargetPath: targetPath,
+		Outcome:    report.OutcomeSkipped,
+		Bytes:      size,
+	})
+}
+
+func (c *CopyFiles) addLink(todoFile *TodoFile) {
+	atomic.AddInt64(&c.LinkNumber, 1)
+	c.Report.Add(report.FileItem{
+		SourcePath: todoFile.FileInfo.Path,
+		TargetPath: todoFile.TargetPath,
+		Outcome:    report.OutcomeLinked,
+	})
+}
+
+// addDelete 记录一个删除的多余目标，只有目标路径
+func (c *CopyFiles) addDelete(targetPath string) {
+	atomic.AddInt64(&c.DeleteNumber, 1)
+	c.Report.Add(report.FileItem{
+		TargetPath: targetPath,
+		Outcome:    report.OutcomeDeleted,
+	})
+}
+
+func (c *CopyFiles) addStrategy(strategy CopyStrategy) {
+	c.Lock()
+	defer c.Unlock()
+	c.Strategies[strategy] += 1
+}
+
+func (c *CopyFiles) failNumber() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.FailFiles)
 }
 
-func (c *CopyFiles) copyItem(fileInfo *TodoFile) {
+func (c *CopyFiles) copyItem(todoFile *TodoFile) {
+	// 先写入同一目录下的临时文件，全部成功后再 rename 到目标路径
+	fileInfo := c.tempTodoFile(todoFile)
+	defer c.Progress.FileDone()
+	startTime := time.Now()
+	var strategy CopyStrategy
+	var attempts int
+	copied, changed := false, false
+	defer func() {
+		if copied {
+			atomic.AddInt64(&c.CopiedBytes, todoFile.FileInfo.Size)
+			outcome := report.OutcomeCopied
+			if c.Move {
+				outcome = report.OutcomeMoved
+			}
+			c.Report.Add(report.FileItem{
+				SourcePath: todoFile.FileInfo.Path,
+				TargetPath: todoFile.TargetPath,
+				Outcome:    outcome,
+				Bytes:      todoFile.FileInfo.Size,
+				Duration:   time.Since(startTime),
+				Strategy:   string(strategy),
+				Attempts:   attempts,
+				Changed:    changed,
+			})
+		}
+	}()
+	tracker := c.Progress.Track()
+	var offset int64
+	if c.Resume {
+		offset = c.journal.offset(fileInfo)
+	}
+	for attempt := 0; ; attempt++ {
+		sourceSum, copyStrategy, copyAttempts, copyChanged, err := c.copyStable(fileInfo, offset, c.Resume && attempt == 0, tracker)
+		strategy = copyStrategy
+		attempts += copyAttempts
+		changed = copyChanged
+		if err != nil {
+			c.addFail(FailItem{
+				Path:     fileInfo.FileInfo.Path,
+				Reason:   err.Error(),
+				Type:     c.failType(err),
+				Attempts: attempts,
+			})
+			c.discardTemp(fileInfo, true)
+			c.stopOnNoSpace(c.tempPath(fileInfo), err)
+			return
+		}
+		c.addStrategy(strategy)
+		tracker.Set(fileInfo.FileInfo.Size)
+		if len(c.Verify) == 0 {
+			break
+		}
+		err = c.verifyTarget(fileInfo, sourceSum)
+		if err == nil {
+			break
+		}
+		if attempt >= c.VerifyRetry {
+			c.addFail(FailItem{
+				Path:     fileInfo.FileInfo.Path,
+				Reason:   err.Error(),
+				Type:     FailTypeVerify,
+				Attempts: attempts,
+			})
+			c.discardTemp(fileInfo, false)
+			return
+		}
+		log.Warn("%v, retry %v/%v", err, attempt+1, c.VerifyRetry)
+		offset = 0
+	}
+	if err := c.setMetadata(fileInfo, c.preserve()); err != nil {
+		c.addFailItem(fileInfo.FileInfo.Path, err)
+		c.discardTemp(fileInfo, false)
+		c.stopOnNoSpace(c.tempPath(fileInfo), err)
+		return
+	}
+	if err := c.commitTemp(fileInfo, todoFile); err != nil {
+		c.addFailItem(fileInfo.FileInfo.Path, err)
+		c.discardTemp(fileInfo, false)
+		c.stopOnNoSpace(c.tempPath(fileInfo), err)
+		return
+	}
+	c.journal.finish(todoFile)
+	c.dedupDone(todoFile)
+	copied = c.removeMoved(todoFile)
+}
+
+// discardTemp 复制失败后删除临时文件，避免在目标目录中留下隐藏文件。
+// resumable 为 true 且 journal 中有已经提交的进度时保留，下次 resume 从临时文件继续。
+// 流式复制在写完后直接提交到目标路径，校验或者设置元数据失败时通过目标存储删除已经提交的文件
+func (c *CopyFiles) discardTemp(fileInfo *TodoFile, resumable bool) {
+	if !c.local() {
+		if resumable {
+			return
+		}
+		if err := c.removeTarget(fileInfo.TargetPath); err != nil {
+			log.Warn("remove unverified target file %v error: %v", fileInfo.TargetPath, err)
+		}
+		return
+	}
+	if resumable && c.journal.started(fileInfo) {
+		return
+	}
+	if err := os.Remove(fileInfo.TargetPath); err != nil && !os.IsNotExist(err) {
+		log.Debug("remove temp file %v error: %v", fileInfo.TargetPath, err)
+	}
+}
+
+// preserve 复制后需要保留的元数据，同步模式依赖修改时间判断文件是否变化
+func (c *CopyFiles) preserve() Preserve {
+	preserve := c.Preserve
+	if c.Sync {
+		preserve.Times = true
+	}
+	return preserve
+}
+
+// copyWithRetry 复制文件内容，遇到暂时性错误时按照 Retry 退避后从 journal 中已经提交的位置继续，返回尝试的次数
+func (c *CopyFiles) copyWithRetry(fileInfo *TodoFile, offset int64, resume bool, tracker *progress.Tracker) ([]byte, CopyStrategy, int, error) {
+	var sourceSum []byte
+	var strategy CopyStrategy
+	attempts, err := c.Retry.Do(c.ctx, fmt.Sprintf("copy %v", fileInfo.FileInfo.Path), func(attempt int) error {
+		if attempt > 1 {
+			resume = true
+			offset = c.journal.offset(fileInfo)
+		}
+		var err error
+		if !c.local() {
+			sourceSum, strategy, err = c.streamContent(fileInfo, tracker)
+		} else if c.isChunked(fileInfo) {
+			sourceSum, strategy, err = c.chunkCopy(fileInfo, resume, tracker)
+		} else {
+			sourceSum, strategy, err = c.copyContent(fileInfo, offset, tracker)
+		}
+		return err
+	})
+	return sourceSum, strategy, attempts, err
+}
+
+// tempTodoFile 返回写入临时文件的 TodoFile，复制进度也记录在临时文件上。
+// 不在本地复制时存储的 Writer 提交前内容不可见，直接写入目标路径
+func (c *CopyFiles) tempTodoFile(todoFile *TodoFile) *TodoFile {
+	if !c.local() {
+		return todoFile
+	}
+	return &TodoFile{
+		FileInfo:   todoFile.FileInfo,
+		TargetPath: paths.TempPath(todoFile.TargetPath),
+	}
+}
+
+// tempPath 返回本地复制的临时文件路径，没有临时文件时返回空字符串
+func (c *CopyFiles) tempPath(fileInfo *TodoFile) string {
+	if !c.local() {
+		return ""
+	}
+	return fileInfo.TargetPath
+}
+
+// commitTemp 把写完的临时文件 rename 到目标路径，通过存储写入的文件已经提交
+func (c *CopyFiles) commitTemp(fileInfo, todoFile *TodoFile) error {
+	if !c.local() {
+		return nil
+	}
+	return paths.CommitFile(fileInfo.TargetPath, todoFile.TargetPath, c.Durable)
+}
+
+// copyContent 从 offset 开始复制文件内容，返回使用的复制策略，开启校验时还返回整个源文件的哈希
+func (c *CopyFiles) copyContent(fileInfo *TodoFile, offset int64, tracker *progress.Tracker) ([]byte, CopyStrategy, error) {
 	sourceFile, err := os.Open(fileInfo.FileInfo.Path)
 	if err != nil {
-		c.FailFiles = append(c.FailFiles, FailItem{
-			Path:   fileInfo.FileInfo.Path,
-			Reason: fmt.Sprintf("open source file error: %v ", err),
-		})
-		return
+		return nil, "", errors.Wrap(err, "open source file error")
 	}
 	defer func() {
 		if err := sourceFile.Close(); err != nil {
 			log.Debug(err.Error())
 		}
 	}()
-	destination, err := os.Create(fileInfo.TargetPath)
+	destination, err := os.OpenFile(fileInfo.TargetPath, os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
-		c.FailFiles = append(c.FailFiles, FailItem{
-			Path:   fileInfo.FileInfo.Path,
-			Reason: fmt.Sprintf("open target file path %v error: %v", fileInfo.TargetPath, err),
-		})
-		return
+		return nil, "", errors.Wrapf(err, "open target file path %v error", fileInfo.TargetPath)
 	}
 	defer func() {
 		if err := destination.Close(); err != nil {
 			log.Debug(err.Error())
 		}
 	}()
-	var cache []byte
-	if maxCacheSize > fileInfo.FileInfo.Size {
-		cache = make([]byte, fileInfo.FileInfo.Size+1)
-	} else {
-		cache = make([]byte, maxCacheSize)
+	// 丢弃上次提交位置之后可能只写了一半的内容
+	if err := destination.Truncate(offset); err != nil {
+		return nil, "", errors.Wrapf(err, "truncate target file %v error", fileInfo.TargetPath)
 	}
-	_, err = io.CopyBuffer(destination, sourceFile, cache)
-	if err != nil {
-		c.FailFiles = append(c.FailFiles, FailItem{
-			Path:   fileInfo.FileInfo.Path,
-			Reason: fmt.Sprintf("copy file error: %v", err),
-		})
-		return
+	if offset > 0 {
+		log.Debug("resume file %v from offset %v", fileInfo.FileInfo.Path, offset)
+	}
+	tracker.Resume(offset)
+	// 每段写完后提交进度，中断后可以从最后提交的位置继续，Durable 时提交前先落盘
+	commit := func(offset int64) error {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		if c.Durable {
+			if err := destination.Sync(); err != nil {
+				return errors.Wrapf(err, "sync target file %v error", fileInfo.TargetPath)
+			}
+		}
+		c.journal.commit(fileInfo, offset)
+		tracker.Set(offset)
+		return nil
+	}
+	// 校验需要在复制过程中计算源文件哈希，限速需要控制每次读写的大小，都只能经过用户态缓冲区
+	if len(c.Verify) == 0 && !c.Throttle.LimitsBytes() {
+		strategy, err := kernelCopy(destination, sourceFile, offset, commit, tracker)
+		if err != nil || strategy != StrategyBuffered {
+			return nil, strategy, err
+		}
+	}
+	reader := paths.ContextReader(c.ctx, c.Throttle.Reader(sourceFile))
+	var hasher hash.Hash
+	if len(c.Verify) > 0 {
+		if hasher, err = NewHash(c.Verify); err != nil {
+			return nil, "", err
+		}
+		reader = io.TeeReader(reader, hasher)
+	}
+	if offset > 0 {
+		// 断点之前的内容不再复制，但是校验需要整个文件的哈希
+		if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+			return nil, "", errors.Wrap(err, "read source file before offset error")
+		}
+		if _, err := destination.Seek(offset, io.SeekStart); err != nil {
+			return nil, "", errors.Wrapf(err, "seek target file %v error", fileInfo.TargetPath)
+		}
+	}
+	// 读取时更新进度，大文件在两次提交之间也能看到进度
+	if err := bufferedCopy(c.Throttle.Writer(destination), tracker.Reader(reader), offset, commit); err != nil {
+		return nil, "", err
+	}
+	if hasher == nil {
+		return nil, StrategyBuffered, nil
+	}
+	if err := dropCache(destination); err != nil {
+		return nil, "", errors.Wrapf(err, "flush target file %v error", fileInfo.TargetPath)
 	}
+	return hasher.Sum(nil), StrategyBuffered, nil
 }
@@ -1,23 +1,1613 @@
 package copy
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
-	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/progress"
+	"go_tools/report"
+	"go_tools/retry"
+	"go_tools/storage"
+	"go_tools/throttle"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestCopyV2(t *testing.T) {
-	handler, err := Get("/Volumes/tlz/mac/works", "/Volumes/tanlizhi/works_v5", 16)
+	sourceDir, targetDir := t.TempDir(), filepath.Join(t.TempDir(), "works")
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "dir", "empty"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aaa"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "b.txt"), bytes.Repeat([]byte("b"), 2*1024*1024), 0644))
+	handler, err := Get(sourceDir, targetDir, 16)
 	assert.Nil(t, err)
 	failItems, err := handler.Copy()
 	assert.Nil(t, err)
-	log.Info("copy process end: success dir number %v, success file number %v, failed number: %v", handler.DirNumber, handler.FileNumber, len(handler.FailFiles))
-	if len(failItems) > 0 {
-		log.Warn("copy failed files list\n")
-		for _, item := range failItems {
-			log.Warn("file: %v, reason: %v", item.Path, item.Reason)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(2), handler.FileNumber)
+	assert.Equal(t, int64(3), handler.DirNumber)
+	content, err := os.ReadFile(filepath.Join(targetDir, "dir", "b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 2*1024*1024), content)
+	info, err := os.Stat(filepath.Join(targetDir, "dir", "empty"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	target, err := storage.NewLocal(targetDir)
+	assert.Nil(t, err)
+	assertNoTemp(t, target)
+}
+
+// assertNoTemp 复制结束后目标中不能留下临时文件
+func assertNoTemp(t *testing.T, target storage.Storage) {
+	err := storage.Walk(context.Background(), target, "", nil, func(fileInfo *paths.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		assert.False(t, strings.HasSuffix(fileInfo.Path, ".co_tmp"), fileInfo.Path)
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestCopyMemory(t *testing.T) {
+	source := storage.NewMemory()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(t, source.WriteFile("works/a.txt", []byte("aaa"), modTime))
+	assert.Nil(t, source.WriteFile("works/dir/b.txt", bytes.Repeat([]byte("b"), 2*1024*1024), modTime))
+	assert.Nil(t, source.MkdirAll("works/empty"))
+	target := storage.NewMemory()
+	handler, err := Get(source.String(), target.String(), 16)
+	assert.Nil(t, err)
+	handler.SourceStorage, handler.TargetStorage = source, target
+	handler.Preserve.Times = true
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(2), handler.FileNumber)
+	assert.Equal(t, int64(4), handler.DirNumber)
+	content, err := target.ReadFile("works/dir/b.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("b"), 2*1024*1024), content)
+	info, err := target.Stat("works/empty")
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir)
+	info, err = target.Stat("works/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, modTime.Unix(), info.UpdatedAt)
+	// 目标存储通过 fs.FS 读取的结果和写入的一致
+	assert.Nil(t, fstest.TestFS(storage.FS(target), "works/a.txt", "works/dir/b.txt", "works/empty"))
+}
+
+func TestCopyFaults(t *testing.T) {
+	prepare := func(t *testing.T) (*storage.Memory, *storage.Memory, *CopyFiles) {
+		source := storage.NewMemory()
+		assert.Nil(t, source.WriteFile("a.txt", []byte("aaa"), time.Now()))
+		assert.Nil(t, source.WriteFile("dir/b.txt", bytes.Repeat([]byte("b"), 1024), time.Now()))
+		target := storage.NewMemory()
+		handler, err := Get(source.String(), target.String(), 1)
+		assert.Nil(t, err)
+		handler.SourceStorage, handler.TargetStorage = source, target
+		handler.Report = report.New("copy", source.String(), target.String())
+		return source, target, handler
+	}
+
+	t.Run("read error", func(t *testing.T) {
+		source, target, handler := prepare(t)
+		source.FailReadAt = 1
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Len(t, failItems, 1)
+		assert.Equal(t, report.FailTypeTransient, failItems[0].Type)
+		// 失败的文件不会留下写了一半的目标
+		_, err = target.Stat("a.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+		content, err := target.ReadFile("dir/b.txt")
+		assert.Nil(t, err)
+		assert.Len(t, content, 1024)
+		assertNoTemp(t, target)
+	})
+	t.Run("resume after read error", func(t *testing.T) {
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		source, target, handler := prepare(t)
+		source.FailReadAt = 1
+		handler.Resume = true
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Len(t, failItems, 1)
+		// 有失败文件时保留 journal，resume 只复制失败的文件
+		_, err = os.Stat(getJournalPath(handler.targetPath))
+		assert.Nil(t, err)
+		source.FailReadAt = 0
+		handler, err = Get(source.String(), target.String(), 1)
+		assert.Nil(t, err)
+		handler.SourceStorage, handler.TargetStorage = source, target
+		handler.Resume = true
+		failItems, err = handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		assert.Equal(t, int64(1), handler.FileNumber)
+		assert.Equal(t, int64(1), handler.SkipNumber)
+		content, err := target.ReadFile("a.txt")
+		assert.Nil(t, err)
+		assert.Equal(t, "aaa", string(content))
+		_, err = os.Stat(getJournalPath(handler.targetPath))
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("chunked read error", func(t *testing.T) {
+		source, target, handler := prepare(t)
+		source.FailReadAt = 1
+		// 存储之间不能分块复制，从头流式复制后重试
+		handler.ChunkThreshold, handler.ChunkSize = 512, 256
+		handler.Retry = &retry.Policy{Attempts: 2, BaseDelay: time.Millisecond}
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		assert.Equal(t, int64(2), handler.Strategies[StrategyStream])
+		assert.Equal(t, int64(0), handler.Strategies[StrategyChunked])
+		content, err := target.ReadFile("dir/b.txt")
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("b"), 1024), content)
+		assertNoTemp(t, target)
+	})
+	t.Run("read error retried", func(t *testing.T) {
+		source, target, handler := prepare(t)
+		source.FailReadAt = 1
+		handler.Retry = &retry.Policy{Attempts: 2, BaseDelay: time.Millisecond}
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		assert.Equal(t, int64(1), handler.Report.Totals.Retried)
+		content, err := target.ReadFile("a.txt")
+		assert.Nil(t, err)
+		assert.Equal(t, "aaa", string(content))
+	})
+	t.Run("no space preflight", func(t *testing.T) {
+		_, target, handler := prepare(t)
+		target.Capacity = 512
+		_, err := handler.Copy()
+		var spaceErr *paths.SpaceError
+		assert.True(t, errors.As(err, &spaceErr))
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		assert.Equal(t, int64(1027), spaceErr.Need)
+		assert.Equal(t, int64(512), spaceErr.Free)
+		assert.Equal(t, int64(0), handler.FileNumber)
+	})
+	t.Run("no space", func(t *testing.T) {
+		_, target, handler := prepare(t)
+		target.Capacity = 512
+		handler.Force = true
+		failItems, err := handler.Copy()
+		// 没有空间后停止复制，不再尝试剩下的文件
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		assert.False(t, errors.As(err, new(*paths.SpaceError)))
+		assert.NotEmpty(t, failItems)
+		assert.Equal(t, int64(1), handler.Report.Totals.FailTypes[report.FailTypeNoSpace])
+		_, err = target.Stat("dir/b.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+		assert.LessOrEqual(t, handler.CopiedBytes, int64(3))
+		assertNoTemp(t, target)
+	})
+	t.Run("no space on metadata", func(t *testing.T) {
+		_, target, handler := prepare(t)
+		handler.TargetStorage = &noSpaceMetadata{Memory: target}
+		handler.Preserve.Times = true
+		failItems, err := handler.Copy()
+		// 内容写完后设置元数据时没有空间也停止复制
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		assert.Len(t, failItems, 1)
+		assert.Equal(t, report.FailTypeNoSpace, failItems[0].Type)
+		assert.Equal(t, int64(1), handler.FileNumber)
+		assert.Equal(t, int64(0), handler.CopiedBytes)
+	})
+	t.Run("verify mismatch", func(t *testing.T) {
+		_, target, handler := prepare(t)
+		handler.TargetStorage = &corruptWrites{Memory: target}
+		handler.Verify = HashXXHash
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Len(t, failItems, 2)
+		assert.Equal(t, report.FailTypeVerify, failItems[0].Type)
+		// 校验失败的文件已经提交到目标路径，需要删除
+		_, err = target.Stat("a.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+		_, err = target.Stat("dir/b.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+	t.Run("slow write canceled", func(t *testing.T) {
+		_, target, handler := prepare(t)
+		target.WriteDelay = 50 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := handler.CopyWithContext(ctx)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.True(t, handler.Report.Canceled)
+		_, err = target.Stat("a.txt")
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+}
+
+// noSpaceMetadata 设置元数据时返回 ENOSPC 的内存存储
+type noSpaceMetadata struct {
+	*storage.Memory
+}
+
+func (s *noSpaceMetadata) SetMetadata(relPath string, _ os.FileMode, _ time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: relPath, Err: syscall.ENOSPC}
+}
+
+// corruptWrites 写入时改掉第一个字节的内存存储，模拟传输中损坏的数据
+type corruptWrites struct {
+	*storage.Memory
+}
+
+func (s *corruptWrites) Create(relPath string) (storage.Writer, error) {
+	writer, err := s.Memory.Create(relPath)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptWriter{Writer: writer}, nil
+}
+
+type corruptWriter struct {
+	storage.Writer
+	written bool
+}
+
+func (w *corruptWriter) Write(p []byte) (int, error) {
+	if !w.written && len(p) > 0 {
+		w.written = true
+		p = append([]byte{p[0] ^ 0xff}, p[1:]...)
+	}
+	return w.Writer.Write(p)
+}
+
+func TestCopyParallel(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	for i := 0; i < 50; i++ {
+		subDir := filepath.Join(sourceDir, fmt.Sprintf("dir_%v", i%5))
+		assert.Nil(t, os.MkdirAll(subDir, os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(subDir, fmt.Sprintf("file_%v.txt", i)), bytes.Repeat([]byte{byte(i)}, i*1024), 0644))
+	}
+	handler, err := Get(sourceDir, targetDir, 4)
+	assert.Nil(t, err)
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(50), handler.FileNumber)
+	assert.Equal(t, int64(6), handler.DirNumber)
+	for i := 0; i < 50; i++ {
+		content, err := os.ReadFile(filepath.Join(targetDir, fmt.Sprintf("dir_%v", i%5), fmt.Sprintf("file_%v.txt", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, i*1024), content)
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	doneContent := []byte("finished in last run")
+	partialContent := bytes.Repeat([]byte("0123456789"), 1024)
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "done.txt"), doneContent, 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "partial.txt"), partialContent, 0644))
+
+	// 模拟上次中断：done.txt 已经完成，partial.txt 的临时文件提交到 4000 字节，之后还写了一些脏数据
+	partialTemp := paths.TempPath(filepath.Join(targetDir, "partial.txt"))
+	assert.Nil(t, os.MkdirAll(targetDir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "done.txt"), []byte("FINISHED IN LAST RUN"), 0644))
+	assert.Nil(t, os.WriteFile(partialTemp, append(append([]byte{}, partialContent[:4000]...), "garbage"...), 0644))
+	doneInfo, err := paths.GetFileInfo(filepath.Join(sourceDir, "done.txt"))
+	assert.Nil(t, err)
+	partialInfo, err := paths.GetFileInfo(filepath.Join(sourceDir, "partial.txt"))
+	assert.Nil(t, err)
+	j, err := openJournal(getJournalPath(targetDir), false)
+	assert.Nil(t, err)
+	j.finish(&TodoFile{FileInfo: doneInfo, TargetPath: filepath.Join(targetDir, "done.txt")})
+	j.commit(&TodoFile{FileInfo: partialInfo, TargetPath: partialTemp}, 4000)
+	j.close(false)
+
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Resume = true
+	handler.Progress = progress.New("copy", 0)
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(1), handler.SkipNumber)
+	assert.Equal(t, int64(1), handler.FileNumber)
+	// 上次已经复制的部分计入跳过的字节，不计入速度
+	snapshot := handler.Progress.Snapshot()
+	assert.Equal(t, int64(len(partialContent)-4000), snapshot.DoneBytes)
+	assert.Equal(t, int64(len(doneContent)+4000), snapshot.SkippedBytes)
+	assert.Equal(t, float64(100), snapshot.Percent)
+	content, err := os.ReadFile(filepath.Join(targetDir, "done.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("FINISHED IN LAST RUN"), content)
+	content, err = os.ReadFile(filepath.Join(targetDir, "partial.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, partialContent, content)
+	_, err = os.Stat(partialTemp)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(getJournalPath(targetDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopySync(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "sub"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "sub", "b.txt"), []byte("b"), 0644))
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Sync = true
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), handler.FileNumber)
+
+	// 修改一个文件，新增一个目标端多余文件
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aa"), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(targetDir, "old"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "old", "c.txt"), []byte("c"), 0644))
+	handler, err = Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Sync = true
+	handler.Delete = true
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(1), handler.FileNumber)
+	assert.Equal(t, int64(1), handler.SkipNumber)
+	assert.Equal(t, int64(2), handler.DeleteNumber)
+	content, err := os.ReadFile(filepath.Join(targetDir, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aa"), content)
+	_, err = os.Stat(filepath.Join(targetDir, "old"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopyVerify(t *testing.T) {
+	sourceDir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), bytes.Repeat([]byte("verify"), 4096), 0644))
+	for _, algorithm := range []HashAlgorithm{HashCRC32C, HashSHA256, HashBLAKE3, HashXXHash} {
+		targetDir := filepath.Join(t.TempDir(), "target")
+		handler, err := Get(sourceDir, targetDir, 2)
+		assert.Nil(t, err)
+		handler.Verify = algorithm
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems, algorithm)
+
+		// 目标文件被破坏后校验需要失败
+		sourceSum, err := fileChecksum(filepath.Join(sourceDir, "a.txt"), algorithm)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "a.txt"), []byte("broken"), 0644))
+		err = handler.verifyTarget(&TodoFile{TargetPath: filepath.Join(targetDir, "a.txt")}, sourceSum)
+		assert.NotNil(t, err, algorithm)
+	}
+	_, err := NewHash("md4")
+	assert.NotNil(t, err)
+}
+
+func TestCopyPreserve(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	updatedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "sub"), 0750))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "sub", "a.sh"), []byte("echo a"), 0700))
+	assert.Nil(t, os.Chtimes(filepath.Join(sourceDir, "sub", "a.sh"), updatedAt, updatedAt))
+	assert.Nil(t, os.Chtimes(filepath.Join(sourceDir, "sub"), updatedAt, updatedAt))
+
+	preserve, err := ParsePreserve("mode,times")
+	assert.Nil(t, err)
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Preserve = preserve
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	fileInfo, err := os.Stat(filepath.Join(targetDir, "sub", "a.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), fileInfo.Mode().Perm())
+	assert.True(t, updatedAt.Equal(fileInfo.ModTime()))
+	dirInfo, err := os.Stat(filepath.Join(targetDir, "sub"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), dirInfo.Mode().Perm())
+	assert.True(t, updatedAt.Equal(dirInfo.ModTime()))
+
+	_, err = ParsePreserve("mode,acl")
+	assert.NotNil(t, err)
+}
+
+func TestCopyLinks(t *testing.T) {
+	sourceDir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "sub"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "sub", "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.Link(filepath.Join(sourceDir, "sub", "a.txt"), filepath.Join(sourceDir, "b.txt")))
+	assert.Nil(t, os.Symlink("sub/a.txt", filepath.Join(sourceDir, "link.txt")))
+	assert.Nil(t, os.Symlink("..", filepath.Join(sourceDir, "sub", "loop")))
+
+	targetDir := filepath.Join(t.TempDir(), "target")
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Hardlink = true
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	linkTarget, err := os.Readlink(filepath.Join(targetDir, "link.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "sub/a.txt", linkTarget)
+	aInfo, err := os.Stat(filepath.Join(targetDir, "sub", "a.txt"))
+	assert.Nil(t, err)
+	bInfo, err := os.Stat(filepath.Join(targetDir, "b.txt"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(aInfo, bInfo))
+	assert.Equal(t, int64(3), handler.LinkNumber)
+
+	// 跟随符号链接时 sub/loop 指向祖先目录，需要报告循环而不是无限递归
+	targetDir = filepath.Join(t.TempDir(), "target")
+	handler, err = Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Symlink = SymlinkFollow
+	failItems, err = handler.Copy()
+	assert.Nil(t, err)
+	assert.Len(t, failItems, 1)
+	assert.Contains(t, failItems[0].Reason, "symlink loop")
+	content, err := os.ReadFile(filepath.Join(targetDir, "link.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), content)
+
+	targetDir = filepath.Join(t.TempDir(), "target")
+	handler, err = Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Symlink = SymlinkSkip
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+	_, err = os.Lstat(filepath.Join(targetDir, "link.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestCopySFTPLinks SFTP 源中的符号链接按照链接策略处理
+func TestCopySFTPLinks(t *testing.T) {
+	sourceDir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "sub"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "sub", "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.Symlink("sub/a.txt", filepath.Join(sourceDir, "link.txt")))
+	assert.Nil(t, os.Symlink("..", filepath.Join(sourceDir, "sub", "loop")))
+
+	copySFTP := func(symlink SymlinkPolicy) (string, *CopyFiles, []FailItem) {
+		source := newTestSFTP(t, sourceDir)
+		targetDir := filepath.Join(t.TempDir(), "target")
+		handler, err := Get(source.String(), targetDir, 2)
+		assert.Nil(t, err)
+		handler.SourceStorage = source
+		handler.Symlink = symlink
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		return targetDir, handler, failItems
+	}
+
+	targetDir, handler, failItems := copySFTP(SymlinkCopyLink)
+	assert.Empty(t, failItems)
+	linkTarget, err := os.Readlink(filepath.Join(targetDir, "link.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "sub/a.txt", linkTarget)
+	linkTarget, err = os.Readlink(filepath.Join(targetDir, "sub", "loop"))
+	assert.Nil(t, err)
+	assert.Equal(t, "..", linkTarget)
+	assert.Equal(t, int64(2), handler.LinkNumber)
+
+	targetDir, _, failItems = copySFTP(SymlinkFollow)
+	assert.Len(t, failItems, 1)
+	assert.Contains(t, failItems[0].Reason, "symlink loop")
+	content, err := os.ReadFile(filepath.Join(targetDir, "link.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), content)
+
+	targetDir, _, failItems = copySFTP(SymlinkSkip)
+	assert.Empty(t, failItems)
+	_, err = os.Lstat(filepath.Join(targetDir, "link.txt"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(targetDir, "sub", "a.txt"))
+	assert.Nil(t, err)
+}
+
+func TestCopySparse(t *testing.T) {
+	sourceDir := t.TempDir()
+	sparsePath := filepath.Join(sourceDir, "sparse.img")
+	file, err := os.Create(sparsePath)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("head"), 0)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("middle"), 8*1024*1024)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Truncate(32*1024*1024))
+	assert.Nil(t, file.Close())
+
+	targetDir := filepath.Join(t.TempDir(), "target")
+	handler, err := Get(sourceDir, targetDir, 1)
+	assert.Nil(t, err)
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	sourceContent, err := os.ReadFile(sparsePath)
+	assert.Nil(t, err)
+	targetContent, err := os.ReadFile(filepath.Join(targetDir, "sparse.img"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(sourceContent, targetContent))
+	var copied int64
+	for _, number := range handler.Strategies {
+		copied += number
+	}
+	assert.Equal(t, int64(1), copied)
+	t.Logf("strategies: %v", handler.Strategies)
+}
+
+func TestCopyChunked(t *testing.T) {
+	sourceDir := t.TempDir()
+	content := make([]byte, 5*1024*1024+123)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "big.img"), content, 0644))
+	targetDir := filepath.Join(t.TempDir(), "target")
+	handler, err := Get(sourceDir, targetDir, 4)
+	assert.Nil(t, err)
+	handler.ChunkThreshold = 1024 * 1024
+	handler.ChunkSize = 1024 * 1024
+	handler.Verify = HashXXHash
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(1), handler.Strategies[StrategyChunked])
+	targetContent, err := os.ReadFile(filepath.Join(targetDir, "big.img"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(content, targetContent))
+
+	// 上次中断时第一个块已经完成，resume 时不再复制
+	bigInfo, err := paths.GetFileInfo(filepath.Join(sourceDir, "big.img"))
+	assert.Nil(t, err)
+	bigTemp := paths.TempPath(filepath.Join(targetDir, "big.img"))
+	copy(targetContent, "kept from last run")
+	assert.Nil(t, os.WriteFile(bigTemp, targetContent, 0644))
+	j, err := openJournal(getJournalPath(targetDir), false)
+	assert.Nil(t, err)
+	j.commitChunk(&TodoFile{FileInfo: bigInfo, TargetPath: bigTemp}, 0, 1024*1024)
+	j.close(false)
+	handler, err = Get(sourceDir, targetDir, 4)
+	assert.Nil(t, err)
+	handler.ChunkThreshold = 1024 * 1024
+	handler.ChunkSize = 1024 * 1024
+	handler.Resume = true
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+	targetContent, err = os.ReadFile(filepath.Join(targetDir, "big.img"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("kept from last run"), targetContent[:18])
+	assert.True(t, bytes.Equal(content[1024*1024:], targetContent[1024*1024:]))
+
+	t.Run("sparse resume", func(t *testing.T) {
+		sourceDir := t.TempDir()
+		sparsePath := filepath.Join(sourceDir, "sparse.img")
+		file, err := os.Create(sparsePath)
+		assert.Nil(t, err)
+		_, err = file.WriteAt([]byte("head"), 0)
+		assert.Nil(t, err)
+		_, err = file.WriteAt([]byte("tail"), 3*1024*1024)
+		assert.Nil(t, err)
+		assert.Nil(t, file.Truncate(4*1024*1024))
+		assert.Nil(t, file.Close())
+		sourceContent, err := os.ReadFile(sparsePath)
+		assert.Nil(t, err)
+		targetDir := filepath.Join(t.TempDir(), "target")
+		sparseTemp := paths.TempPath(filepath.Join(targetDir, "sparse.img"))
+		assert.Nil(t, os.MkdirAll(targetDir, 0755))
+		for _, doneChunk := range []bool{false, true} {
+			// 上次中断时留下的临时文件中空洞的位置有其他内容
+			stale := bytes.Repeat([]byte("x"), 4*1024*1024)
+			copy(stale, sourceContent[:1024*1024])
+			assert.Nil(t, os.WriteFile(sparseTemp, stale, 0644))
+			if doneChunk {
+				sparseInfo, err := paths.GetFileInfo(sparsePath)
+				assert.Nil(t, err)
+				j, err := openJournal(getJournalPath(targetDir), false)
+				assert.Nil(t, err)
+				j.commitChunk(&TodoFile{FileInfo: sparseInfo, TargetPath: sparseTemp}, 0, 1024*1024)
+				j.close(false)
+			}
+			handler, err := Get(sourceDir, targetDir, 4)
+			assert.Nil(t, err)
+			handler.ChunkThreshold = 1024 * 1024
+			handler.ChunkSize = 1024 * 1024
+			handler.Resume = true
+			failItems, err := handler.Copy()
+			assert.Nil(t, err)
+			assert.Empty(t, failItems)
+			targetContent, err := os.ReadFile(filepath.Join(targetDir, "sparse.img"))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(sourceContent, targetContent), "done chunk: %v", doneChunk)
+			assert.Nil(t, os.Remove(filepath.Join(targetDir, "sparse.img")))
 		}
-	} else {
-		log.Info("copy all files success")
+	})
+}
+
+func TestCopyFilter(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	for _, path := range []string{"a.txt", "b.tmp", ".git/HEAD"} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(sourceDir, path)), os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, path), []byte(path), 0644))
+	}
+	// 目标端被排除的文件在镜像模式下也不能删除
+	assert.Nil(t, os.MkdirAll(targetDir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "local.tmp"), []byte("local"), 0644))
+	filter, err := paths.NewFilter(nil, []string{".git/", "*.tmp"})
+	assert.Nil(t, err)
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Filter = filter
+	handler.Sync = true
+	handler.Delete = true
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(1), handler.FileNumber)
+	assert.Equal(t, int64(0), handler.DeleteNumber)
+	_, err = os.Stat(filepath.Join(targetDir, ".git"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(targetDir, "local.tmp"))
+	assert.Nil(t, err)
+}
+
+func TestCopyPlan(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "sub"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aaa"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "sub", "b.txt"), []byte("bbbb"), 0644))
+	assert.Nil(t, os.MkdirAll(targetDir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "a.txt"), []byte("old"), 0644))
+
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.DryRun = true
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+	plan := handler.Plan
+	assert.NotNil(t, plan)
+	assert.Equal(t, int64(2), plan.FileNumber)
+	assert.Equal(t, int64(1), plan.DirNumber)
+	assert.Equal(t, int64(7), plan.TotalBytes)
+	actions := map[string]PlanAction{}
+	for _, item := range plan.Items {
+		actions[item.TargetPath] = item.Action
+	}
+	assert.Equal(t, ActionOverwrite, actions[filepath.Join(targetDir, "a.txt")])
+	assert.Equal(t, ActionCopy, actions[filepath.Join(targetDir, "sub", "b.txt")])
+	// dry-run 不能修改目标路径
+	_, err = os.Stat(filepath.Join(targetDir, "sub"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(getJournalPath(targetDir))
+	assert.True(t, os.IsNotExist(err))
+	var table bytes.Buffer
+	assert.Nil(t, plan.WriteTable(&table))
+	assert.Contains(t, table.String(), string(ActionOverwrite))
+
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	assert.Nil(t, plan.Save(planPath))
+	loaded, err := LoadPlan(planPath)
+	assert.Nil(t, err)
+	assert.Equal(t, plan.Items, loaded.Items)
+	executor, err := Get(loaded.SourcePath, loaded.TargetPath, 2)
+	assert.Nil(t, err)
+	failItems, err := executor.ExecutePlan(loaded)
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(2), executor.FileNumber)
+	content, err := os.ReadFile(filepath.Join(targetDir, "sub", "b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bbbb", string(content))
+	content, err = os.ReadFile(filepath.Join(targetDir, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "aaa", string(content))
+
+	// 生成计划后源文件变化，执行时记录为失败；计划中不存在的 sub/b.txt 已经出现，不能覆盖
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("changed"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "sub", "b.txt"), []byte("mine"), 0644))
+	executor, err = Get(loaded.SourcePath, loaded.TargetPath, 2)
+	assert.Nil(t, err)
+	failItems, err = executor.ExecutePlan(loaded)
+	assert.Nil(t, err)
+	assert.Len(t, failItems, 2)
+	failTypes := map[string]FailType{}
+	for _, item := range failItems {
+		failTypes[item.Path] = item.Type
+	}
+	assert.Equal(t, FailTypeConflict, failTypes[filepath.Join(sourceDir, "sub", "b.txt")])
+	content, err = os.ReadFile(filepath.Join(targetDir, "sub", "b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "mine", string(content))
+
+	// 计划中的冲突执行时记录为失败
+	loaded.Items = append(loaded.Items, PlanItem{
+		Action:     ActionConflict,
+		SourcePath: filepath.Join(sourceDir, "c.txt"),
+		TargetPath: filepath.Join(targetDir, "c.txt"),
+		Reason:     "target exists, failed",
+	})
+	executor, err = Get(loaded.SourcePath, loaded.TargetPath, 2)
+	assert.Nil(t, err)
+	failItems, err = executor.ExecutePlan(loaded)
+	assert.Nil(t, err)
+	assert.Len(t, failItems, 3)
+	assert.Equal(t, FailTypeConflict, failItems[2].Type)
+	assert.Contains(t, failItems[2].Reason, "target exists, failed")
+}
+
+func TestCopyConflict(t *testing.T) {
+	sourceDir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("new"), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "dir"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "b.txt"), []byte("b"), 0644))
+	prepareTarget := func(t *testing.T) string {
+		targetDir := filepath.Join(t.TempDir(), "target")
+		assert.Nil(t, os.MkdirAll(targetDir, os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "a.txt"), []byte("old"), 0644))
+		// 源路径中是目录，目标路径中是文件
+		assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "dir"), []byte("file"), 0644))
+		return targetDir
+	}
+	readFile := func(path string) string {
+		content, _ := os.ReadFile(path)
+		return string(content)
+	}
+	copyWith := func(t *testing.T, targetDir string, policy ConflictPolicy) *CopyFiles {
+		handler, err := Get(sourceDir, targetDir, 2)
+		assert.Nil(t, err)
+		handler.Conflict = policy
+		_, err = handler.Copy()
+		assert.Nil(t, err)
+		assert.Len(t, handler.Conflicts, 2-int(handler.OverwriteNumber))
+		return handler
+	}
+
+	t.Run("overwrite", func(t *testing.T) {
+		targetDir := prepareTarget(t)
+		handler := copyWith(t, targetDir, ConflictOverwrite)
+		assert.Empty(t, handler.FailFiles)
+		// 只记录类型冲突，同类型的覆盖只计数
+		assert.Equal(t, int64(1), handler.OverwriteNumber)
+		assert.True(t, handler.Conflicts[0].TypeConflict)
+		assert.Equal(t, "new", readFile(filepath.Join(targetDir, "a.txt")))
+		assert.Equal(t, "b", readFile(filepath.Join(targetDir, "dir", "b.txt")))
+	})
+	t.Run("skip", func(t *testing.T) {
+		targetDir := prepareTarget(t)
+		handler := copyWith(t, targetDir, ConflictSkip)
+		assert.Empty(t, handler.FailFiles)
+		assert.Equal(t, "old", readFile(filepath.Join(targetDir, "a.txt")))
+		// 目录没有创建，其中的文件也不处理
+		assert.Equal(t, "file", readFile(filepath.Join(targetDir, "dir")))
+	})
+	t.Run("update-if-newer", func(t *testing.T) {
+		targetDir := prepareTarget(t)
+		future := time.Now().Add(time.Hour)
+		assert.Nil(t, os.Chtimes(filepath.Join(targetDir, "a.txt"), future, future))
+		handler := copyWith(t, targetDir, ConflictUpdateIfNewer)
+		assert.Equal(t, "old", readFile(filepath.Join(targetDir, "a.txt")))
+		assert.Equal(t, "b", readFile(filepath.Join(targetDir, "dir", "b.txt")))
+		assert.Equal(t, int64(1), handler.SkipNumber)
+	})
+	t.Run("rename-with-suffix", func(t *testing.T) {
+		targetDir := prepareTarget(t)
+		copyWith(t, targetDir, ConflictRename)
+		assert.Equal(t, "new", readFile(filepath.Join(targetDir, "a.txt")))
+		assert.Equal(t, "old", readFile(filepath.Join(targetDir, "a_1.txt")))
+		assert.Equal(t, "file", readFile(filepath.Join(targetDir, "dir_1")))
+	})
+	t.Run("backup-to-dir", func(t *testing.T) {
+		targetDir := prepareTarget(t)
+		handler := copyWith(t, targetDir, ConflictBackup)
+		assert.Equal(t, "new", readFile(filepath.Join(targetDir, "a.txt")))
+		assert.Equal(t, "old", readFile(filepath.Join(getBackupDir(targetDir), "a.txt")))
+		for _, item := range handler.Conflicts {
+			assert.Equal(t, ResolutionBackedUp, item.Resolution)
+			assert.NotEmpty(t, item.MovedTo)
+		}
+	})
+	t.Run("fail", func(t *testing.T) {
+		targetDir := prepareTarget(t)
+		handler := copyWith(t, targetDir, ConflictFail)
+		assert.Len(t, handler.FailFiles, 2)
+		for _, item := range handler.FailFiles {
+			assert.Equal(t, FailTypeConflict, item.Type)
+		}
+		assert.Equal(t, "old", readFile(filepath.Join(targetDir, "a.txt")))
+	})
+}
+
+func TestCopyDurable(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("new"), 0644))
+	// 上次中断留下的临时文件不能影响结果，也不能留在目标路径中
+	assert.Nil(t, os.MkdirAll(targetDir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(paths.TempPath(filepath.Join(targetDir, "a.txt")), []byte("garbage from crash"), 0644))
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Durable = true
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	entries, err := os.ReadDir(targetDir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	content, err := os.ReadFile(filepath.Join(targetDir, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(content))
+}
+
+func TestCopyProgress(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), bytes.Repeat([]byte("a"), 1000), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "b.txt"), bytes.Repeat([]byte("b"), 2000), 0644))
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Progress = progress.New("copy", time.Millisecond)
+	updates := handler.Progress.Updates()
+	var last progress.Snapshot
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for snapshot := range updates {
+			last = snapshot
+		}
+	}()
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	<-done
+	assert.True(t, last.Finished)
+	assert.Equal(t, int64(3000), last.TotalBytes)
+	assert.Equal(t, int64(3000), last.DoneBytes)
+	assert.Equal(t, int64(2), last.DoneFiles)
+	assert.Equal(t, float64(100), last.Percent)
+
+	// 第二次同步时所有文件都跳过，也要到达 100%
+	handler, err = Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Sync = true
+	handler.Progress = progress.New("sync", 0)
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+	snapshot := handler.Progress.Snapshot()
+	assert.Equal(t, int64(0), snapshot.DoneBytes)
+	assert.Equal(t, int64(3000), snapshot.SkippedBytes)
+	assert.Equal(t, float64(100), snapshot.Percent)
+}
+
+func TestCopyThrottle(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	content := bytes.Repeat([]byte("0123456789"), 10*1024)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, fmt.Sprintf("%v.txt", i)), content, 0644))
+	}
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	// 两个协程共享 400K/s 的读写限制，复制 200K 至少需要 0.5 秒
+	handler.Throttle = throttle.New(400*1024, 400*1024, 0)
+	startTime := time.Now()
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.GreaterOrEqual(t, time.Since(startTime), 400*time.Millisecond)
+	targetContent, err := os.ReadFile(filepath.Join(targetDir, "1.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, targetContent)
+
+	// 运行时取消限制后不再等待
+	handler, err = Get(sourceDir, filepath.Join(t.TempDir(), "target"), 2)
+	assert.Nil(t, err)
+	handler.Throttle = throttle.New(1024, 1024, 0)
+	handler.Throttle.SetRead(0)
+	handler.Throttle.SetWrite(0)
+	startTime = time.Now()
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(startTime), 5*time.Second)
+}
+
+func TestCopyCancel(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	content := bytes.Repeat([]byte("0123456789"), 100*1024)
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "big.txt"), content, 0644))
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	// 限速保证取消时文件还没有复制完
+	handler.Throttle = throttle.New(200*1024, 0, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	failItems, err := handler.CopyWithContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, failItems, 1)
+	assert.Equal(t, FailTypeCanceled, failItems[0].Type)
+	// 没有复制完的文件不会出现在目标路径，journal 保留用于 resume
+	_, err = os.Stat(filepath.Join(targetDir, "big.txt"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(getJournalPath(targetDir))
+	assert.Nil(t, err)
+
+	handler, err = Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Resume = true
+	failItems, err = handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	targetContent, err := os.ReadFile(filepath.Join(targetDir, "big.txt"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(content, targetContent))
+}
+
+func TestCopyReport(t *testing.T) {
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aaa"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "b.txt"), []byte("bbb"), 0644))
+	assert.Nil(t, os.MkdirAll(targetDir, os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "b.txt"), []byte("old"), 0644))
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Conflict = ConflictFail
+	handler.Report = report.New("copy", sourceDir, targetDir)
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+
+	result := handler.Report
+	assert.Len(t, result.Files, 1)
+	assert.Equal(t, filepath.Join(sourceDir, "a.txt"), result.Files[0].SourcePath)
+	assert.Equal(t, report.OutcomeCopied, result.Files[0].Outcome)
+	assert.NotEmpty(t, result.Files[0].Strategy)
+	assert.Equal(t, int64(1), result.Totals.Files)
+	assert.Equal(t, int64(3), result.Totals.Bytes)
+	assert.Equal(t, int64(1), result.Totals.Failed)
+	assert.Equal(t, int64(1), result.Totals.FailTypes[FailTypeConflict])
+	assert.Equal(t, filepath.Join(sourceDir, "b.txt"), result.Failures[0].Path)
+
+	reportDir := t.TempDir()
+	for _, name := range []string{"report.json", "report.csv", "report.html"} {
+		assert.Nil(t, result.Save(filepath.Join(reportDir, name)))
+	}
+	content, err := os.ReadFile(filepath.Join(reportDir, "report.json"))
+	assert.Nil(t, err)
+	var loaded report.Report
+	assert.Nil(t, json.Unmarshal(content, &loaded))
+	assert.Equal(t, result.Totals, loaded.Totals)
+	content, err = os.ReadFile(filepath.Join(reportDir, "report.csv"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "b.txt,,failed,,,,1,conflict,")
+	content, err = os.ReadFile(filepath.Join(reportDir, "report.html"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "a.txt")
+	assert.Error(t, result.Save(filepath.Join(reportDir, "report.txt")))
+}
+
+func TestCopyRetry(t *testing.T) {
+	policy := &retry.Policy{Attempts: 3, BaseDelay: time.Millisecond}
+	calls := 0
+	attempts, err := policy.Do(context.Background(), "transient", func(attempt int) error {
+		calls++
+		if attempt < 3 {
+			return errors.Wrap(syscall.EIO, "read error")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 3, calls)
+	// 不是暂时性的错误不重试
+	attempts, err = policy.Do(context.Background(), "permanent", func(attempt int) error {
+		return os.ErrNotExist
+	})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, report.FailTypeTransient, report.Classify(errors.Wrap(syscall.ESTALE, "stat error")))
+
+	sourceDir := t.TempDir()
+	targetDir := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aaa"), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "dir"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "b.txt"), []byte("bbb"), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(targetDir, "dir"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "dir", "b.txt"), []byte("old"), 0644))
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Conflict = ConflictFail
+	handler.Report = report.New("copy", sourceDir, targetDir)
+	_, err = handler.Copy()
+	assert.Nil(t, err)
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	assert.Nil(t, handler.Report.Save(reportPath))
+
+	// 处理冲突后只重新复制报告中失败的文件
+	assert.Nil(t, os.Remove(filepath.Join(targetDir, "dir", "b.txt")))
+	lastReport, err := report.Load(reportPath)
+	assert.Nil(t, err)
+	assert.Len(t, lastReport.Failures, 1)
+	handler, err = Get(lastReport.SourcePath, lastReport.TargetPath, 2)
+	assert.Nil(t, err)
+	handler.Report = report.New("copy", sourceDir, targetDir)
+	failItems, err := handler.RetryFailed(lastReport.Failures)
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(1), handler.FileNumber)
+	assert.Len(t, handler.Report.Files, 1)
+	content, err := os.ReadFile(filepath.Join(targetDir, "dir", "b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bbb", string(content))
+}
+
+func TestCopyMove(t *testing.T) {
+	prepareSource := func(t *testing.T, parent string) string {
+		sourceDir := filepath.Join(parent, "source")
+		assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "dir"), os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aaa"), 0644))
+		assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "b.txt"), []byte("bbb"), 0644))
+		assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "c.log"), []byte("ccc"), 0644))
+		return sourceDir
+	}
+	move := func(t *testing.T, sourceDir, targetDir string) *CopyFiles {
+		handler, err := Get(sourceDir, targetDir, 2)
+		assert.Nil(t, err)
+		handler.Move = true
+		handler.Filter, err = paths.NewFilter(nil, []string{"*.log"})
+		assert.Nil(t, err)
+		handler.Report = report.New("move", sourceDir, targetDir)
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		assert.Equal(t, int64(2), handler.Report.Totals.Outcomes[report.OutcomeMoved])
+		content, err := os.ReadFile(filepath.Join(targetDir, "dir", "b.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "bbb", string(content))
+		// 过滤掉的文件和所在的目录保留在源路径中，移空的目录删除
+		_, err = os.Stat(filepath.Join(sourceDir, "a.txt"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(sourceDir, "dir", "b.txt"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(sourceDir, "dir", "c.log"))
+		assert.Nil(t, err)
+		_, err = os.Stat(filepath.Join(targetDir, "dir", "c.log"))
+		assert.True(t, os.IsNotExist(err))
+		return handler
+	}
+
+	t.Run("rename", func(t *testing.T) {
+		parent := t.TempDir()
+		sourceDir := prepareSource(t, parent)
+		handler := move(t, sourceDir, filepath.Join(parent, "target"))
+		assert.Equal(t, int64(2), handler.Strategies[StrategyRename])
+	})
+	t.Run("cross filesystem", func(t *testing.T) {
+		parent := t.TempDir()
+		targetParent, err := os.MkdirTemp("/dev/shm", "co_move")
+		if err != nil || existingDev(targetParent) == existingDev(parent) {
+			t.Skip("no other filesystem to move to")
+		}
+		defer os.RemoveAll(targetParent)
+		sourceDir := prepareSource(t, parent)
+		handler := move(t, sourceDir, filepath.Join(targetParent, "target"))
+		assert.Zero(t, handler.Strategies[StrategyRename])
+		assert.Equal(t, HashXXHash, handler.Verify)
+	})
+	t.Run("resume with stale target", func(t *testing.T) {
+		parent := t.TempDir()
+		sourceDir := prepareSource(t, parent)
+		targetDir := filepath.Join(parent, "target")
+		// 上次复制完成后目标被改成了相同大小的其他内容，不能删除源文件
+		assert.Nil(t, os.MkdirAll(targetDir, os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(targetDir, "a.txt"), []byte("aaX"), 0644))
+		aInfo, err := paths.GetFileInfo(filepath.Join(sourceDir, "a.txt"))
+		assert.Nil(t, err)
+		j, err := openJournal(getJournalPath(targetDir), false)
+		assert.Nil(t, err)
+		j.finish(&TodoFile{FileInfo: aInfo, TargetPath: filepath.Join(targetDir, "a.txt")})
+		j.close(false)
+		handler, err := Get(sourceDir, targetDir, 2)
+		assert.Nil(t, err)
+		handler.Move = true
+		handler.Resume = true
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		assert.Zero(t, handler.SkipNumber)
+		content, err := os.ReadFile(filepath.Join(targetDir, "a.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "aaa", string(content))
+		_, err = os.Stat(filepath.Join(sourceDir, "a.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("empty source removed", func(t *testing.T) {
+		parent := t.TempDir()
+		sourceDir := filepath.Join(parent, "source")
+		assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "dir"), os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "b.txt"), []byte("bbb"), 0644))
+		handler, err := Get(sourceDir, filepath.Join(parent, "target"), 2)
+		assert.Nil(t, err)
+		handler.Move = true
+		_, err = handler.Copy()
+		assert.Nil(t, err)
+		_, err = os.Stat(sourceDir)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestCopyDedup(t *testing.T) {
+	parent := t.TempDir()
+	sourceDir := filepath.Join(parent, "source")
+	vendor := bytes.Repeat([]byte("vendor"), 1024)
+	for _, path := range []string{"a/vendor.js", "b/vendor.js", "c/copy.js"} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(sourceDir, path)), os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, path), vendor, 0644))
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "main.js"), []byte("main"), 0644))
+	targetDir := filepath.Join(parent, "target")
+	sameFile := func(path1, path2 string) bool {
+		info1, err := os.Stat(filepath.Join(targetDir, path1))
+		assert.Nil(t, err)
+		info2, err := os.Stat(filepath.Join(targetDir, path2))
+		assert.Nil(t, err)
+		return os.SameFile(info1, info2)
+	}
+
+	handler, err := Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Dedup = DedupHardlink
+	handler.Report = report.New("copy", sourceDir, targetDir)
+	failItems, err := handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(2), handler.FileNumber)
+	assert.Equal(t, int64(2), handler.DedupNumber)
+	assert.Equal(t, int64(2*len(vendor)), handler.DedupBytes)
+	assert.Equal(t, int64(2*len(vendor)), handler.Report.Totals.DedupBytes)
+	assert.True(t, sameFile("a/vendor.js", "b/vendor.js"))
+	assert.True(t, sameFile("a/vendor.js", "c/copy.js"))
+	_, err = os.Stat(getDedupIndexPath(targetDir))
+	assert.Nil(t, err)
+
+	// 再次复制时从索引中找到上次复制的内容，新的重复文件直接链接
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "d"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "d", "vendor.js"), vendor, 0644))
+	handler, err = Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Dedup = DedupHardlink
+	failItems, err = handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	// 目标中已经是相同内容的文件不再复制
+	assert.Zero(t, handler.FileNumber)
+	assert.Equal(t, int64(4), handler.SkipNumber)
+	assert.Equal(t, int64(1), handler.DedupNumber)
+	assert.True(t, sameFile("a/vendor.js", "d/vendor.js"))
+
+	// 不支持 reflink 的文件系统上复制内容，每个文件的元数据独立
+	targetDir = filepath.Join(parent, "reflink")
+	handler, err = Get(sourceDir, targetDir, 2)
+	assert.Nil(t, err)
+	handler.Dedup = DedupReflink
+	failItems, err = handler.Copy()
+	assert.Nil(t, err)
+	assert.Empty(t, failItems)
+	assert.Equal(t, int64(5), handler.FileNumber+handler.DedupNumber)
+	assert.False(t, sameFile("a/vendor.js", "b/vendor.js"))
+	content, err := os.ReadFile(filepath.Join(targetDir, "d", "vendor.js"))
+	assert.Nil(t, err)
+	assert.Equal(t, vendor, content)
+}
+
+func TestCopyChanged(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 16*1024)
+	// 限速让复制至少持续 0.5 秒，复制开始 100 毫秒后在源文件末尾追加内容
+	copyChanging := func(t *testing.T, policy paths.ChangePolicy) (*CopyFiles, []FailItem, string) {
+		sourceDir := t.TempDir()
+		sourcePath := filepath.Join(sourceDir, "a.txt")
+		assert.Nil(t, os.WriteFile(sourcePath, content, 0644))
+		targetDir := filepath.Join(t.TempDir(), "target")
+		handler, err := Get(sourceDir, targetDir, 2)
+		assert.Nil(t, err)
+		handler.OnChange = policy
+		handler.Throttle = throttle.New(256*1024, 256*1024, 0)
+		handler.Report = report.New("copy", sourceDir, targetDir)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			file, err := os.OpenFile(sourcePath, os.O_WRONLY|os.O_APPEND, 0644)
+			assert.Nil(t, err)
+			_, err = file.Write([]byte("appended"))
+			assert.Nil(t, err)
+			assert.Nil(t, file.Close())
+		}()
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		return handler, failItems, filepath.Join(targetDir, "a.txt")
+	}
+
+	t.Run("warn", func(t *testing.T) {
+		handler, failItems, targetPath := copyChanging(t, paths.ChangeWarn)
+		assert.Empty(t, failItems)
+		assert.Equal(t, int64(1), handler.ChangedNumber)
+		assert.Equal(t, int64(1), handler.Report.Totals.Changed)
+		assert.True(t, handler.Report.Files[0].Changed)
+		_, err := os.Stat(targetPath)
+		assert.Nil(t, err)
+	})
+	t.Run("retry", func(t *testing.T) {
+		handler, failItems, targetPath := copyChanging(t, paths.ChangeRetry)
+		assert.Empty(t, failItems)
+		assert.Zero(t, handler.ChangedNumber)
+		targetContent, err := os.ReadFile(targetPath)
+		assert.Nil(t, err)
+		assert.Equal(t, append(append([]byte{}, content...), "appended"...), targetContent)
+	})
+	t.Run("fail", func(t *testing.T) {
+		_, failItems, targetPath := copyChanging(t, paths.ChangeFail)
+		assert.Len(t, failItems, 1)
+		assert.Equal(t, report.FailTypeChanged, failItems[0].Type)
+		_, err := os.Stat(targetPath)
+		assert.True(t, os.IsNotExist(err))
+		assert.Empty(t, tempFiles(t, filepath.Dir(targetPath)))
+	})
+}
+
+// tempFiles 返回 dir 中留下的 *.co_tmp 临时文件
+func tempFiles(t *testing.T, dir string) []string {
+	var result []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".co_tmp") {
+			result = append(result, path)
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	return result
+}
+
+// newTestSFTP 通过内存管道连接进程内的 SFTP 服务器，服务器直接读写本地文件系统
+func newTestSFTP(t *testing.T, root string) *storage.SFTP {
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	assert.Nil(t, err)
+	go func() {
+		_ = server.Serve()
+	}()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	assert.Nil(t, err)
+	result := storage.NewSFTP(client, root)
+	t.Cleanup(func() {
+		_ = result.Close()
+		_ = server.Close()
+	})
+	return result
+}
+
+// newTestS3 只实现对象读写、分段上传和 ListObjectsV2 的 S3 替身，返回的存储使用 bucket 中的 prefix。
+// 测试结束时不能留下没有完成或者放弃的分段上传，修改时间随上传保存，不能通过复制对象自身修改
+func newTestS3(t *testing.T, prefix string) (*storage.S3, map[string][]byte) {
+	objects := map[string][]byte{}
+	// 对象保存的修改时间元数据
+	mtimes := map[string]string{}
+	uploads := map[string]map[int][]byte{}
+	uploadMtimes := map[string]string{}
+	selfCopies := 0
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !strings.HasPrefix(request.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, "/"), "/")
+		if bucket != "bucket" {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query := request.URL.Query()
+		switch {
+		case request.Method == http.MethodPost && query.Has("uploads"):
+			uploadID := strconv.Itoa(len(uploads) + 1)
+			uploads[uploadID] = map[int][]byte{}
+			uploadMtimes[uploadID] = request.Header.Get("x-amz-meta-mtime")
+			fmt.Fprintf(writer, "<InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>", uploadID)
+		case request.Method == http.MethodPut && query.Has("uploadId"):
+			parts, ok := uploads[query.Get("uploadId")]
+			partNumber, err := strconv.Atoi(query.Get("partNumber"))
+			if !ok || err != nil {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			content, err := io.ReadAll(request.Body)
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			parts[partNumber] = content
+			writer.Header().Set("ETag", fmt.Sprintf("\"%v\"", partNumber))
+		case request.Method == http.MethodPost && query.Has("uploadId"):
+			parts, ok := uploads[query.Get("uploadId")]
+			var complete struct {
+				Parts []struct {
+					PartNumber int
+					ETag       string
+				} `xml:"Part"`
+			}
+			if !ok || xml.NewDecoder(request.Body).Decode(&complete) != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var content []byte
+			for index, part := range complete.Parts {
+				if part.PartNumber != index+1 || part.ETag != fmt.Sprintf("\"%v\"", part.PartNumber) {
+					_, _ = writer.Write([]byte("<Error><Code>InvalidPart</Code></Error>"))
+					return
+				}
+				content = append(content, parts[part.PartNumber]...)
+			}
+			objects[key], mtimes[key] = content, uploadMtimes[query.Get("uploadId")]
+			delete(uploads, query.Get("uploadId"))
+			delete(uploadMtimes, query.Get("uploadId"))
+			_, _ = writer.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+		case request.Method == http.MethodDelete && query.Has("uploadId"):
+			delete(uploads, query.Get("uploadId"))
+			delete(uploadMtimes, query.Get("uploadId"))
+			writer.WriteHeader(http.StatusNoContent)
+		case request.Method == http.MethodGet && len(key) == 0:
+			listPrefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+			var keys []string
+			for name := range objects {
+				keys = append(keys, name)
+			}
+			sort.Strings(keys)
+			var body strings.Builder
+			body.WriteString("<ListBucketResult>")
+			prefixes := map[string]bool{}
+			for _, name := range keys {
+				if !strings.HasPrefix(name, listPrefix) {
+					continue
+				}
+				if index := strings.Index(name[len(listPrefix):], delimiter); len(delimiter) > 0 && index >= 0 {
+					commonPrefix := name[:len(listPrefix)+index+1]
+					if !prefixes[commonPrefix] {
+						prefixes[commonPrefix] = true
+						fmt.Fprintf(&body, "<CommonPrefixes><Prefix>%v</Prefix></CommonPrefixes>", commonPrefix)
+					}
+					continue
+				}
+				fmt.Fprintf(&body, "<Contents><Key>%v</Key><Size>%v</Size><LastModified>2024-01-01T00:00:00.000Z</LastModified></Contents>", name, len(objects[name]))
+			}
+			body.WriteString("<IsTruncated>false</IsTruncated></ListBucketResult>")
+			_, _ = writer.Write([]byte(body.String()))
+		case request.Method == http.MethodPut && len(request.Header.Get("x-amz-copy-source")) > 0:
+			sourceKey := strings.TrimPrefix(request.Header.Get("x-amz-copy-source"), "/bucket/")
+			content, ok := objects[sourceKey]
+			if !ok {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if sourceKey == key {
+				selfCopies++
+			}
+			mtime := mtimes[sourceKey]
+			if request.Header.Get("x-amz-metadata-directive") == "REPLACE" {
+				mtime = request.Header.Get("x-amz-meta-mtime")
+			}
+			objects[key], mtimes[key] = content, mtime
+			_, _ = writer.Write([]byte("<CopyObjectResult></CopyObjectResult>"))
+		case request.Method == http.MethodPut:
+			content, err := io.ReadAll(request.Body)
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			objects[key], mtimes[key] = content, request.Header.Get("x-amz-meta-mtime")
+		case request.Method == http.MethodGet || request.Method == http.MethodHead:
+			content, ok := objects[key]
+			if !ok {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			writer.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+			if mtime := mtimes[key]; len(mtime) > 0 {
+				writer.Header().Set("x-amz-meta-mtime", mtime)
+			}
+			if request.Method == http.MethodGet {
+				_, _ = writer.Write(content)
+			}
+		case request.Method == http.MethodDelete:
+			delete(objects, key)
+			delete(mtimes, key)
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		assert.Empty(t, uploads)
+		assert.Zero(t, selfCopies)
+	})
+	u, err := url.Parse(fmt.Sprintf("s3://bucket/%v?endpoint=%v&region=test", prefix, server.URL))
+	assert.Nil(t, err)
+	result, err := storage.NewS3FromURL(u)
+	assert.Nil(t, err)
+	result.AccessKey, result.SecretKey = "test", "secret"
+	return result, objects
+}
+
+func TestCopyStorage(t *testing.T) {
+	sourceDir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(sourceDir, "dir", "empty"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "a.txt"), []byte("aaa"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "b.txt"), bytes.Repeat([]byte("b"), 3*1024*1024), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(sourceDir, "dir", "c.log"), []byte("ccc"), 0644))
+	copyStorage := func(t *testing.T, source, target storage.Storage) *CopyFiles {
+		handler, err := Get(source.String(), target.String(), 2)
+		assert.Nil(t, err)
+		handler.SourceStorage, handler.TargetStorage = source, target
+		handler.Verify = HashXXHash
+		handler.Filter, err = paths.NewFilter(nil, []string{"*.log"})
+		assert.Nil(t, err)
+		handler.Report = report.New("copy", source.String(), target.String())
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		assert.Equal(t, int64(2), handler.Strategies[StrategyStream])
+		assert.Equal(t, int64(2), handler.Report.Totals.Outcomes[report.OutcomeCopied])
+		return handler
+	}
+	local, err := storage.NewLocal(sourceDir)
+	assert.Nil(t, err)
+	sftpDir := t.TempDir()
+	sftpStorage := newTestSFTP(t, sftpDir)
+	s3Storage, objects := newTestS3(t, "backup/2024")
+	// b.txt 分成三段上传
+	s3Storage.PartSize = 1024 * 1024
+	localDir := t.TempDir()
+	localTarget, err := storage.NewLocal(filepath.Join(localDir, "restored"))
+	assert.Nil(t, err)
+
+	t.Run("local to sftp", func(t *testing.T) {
+		copyStorage(t, local, sftpStorage)
+		content, err := os.ReadFile(filepath.Join(sftpDir, "a.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "aaa", string(content))
+		_, err = os.Stat(filepath.Join(sftpDir, "dir", "c.log"))
+		assert.True(t, os.IsNotExist(err))
+		// 空目录也需要创建，临时文件不能留下
+		info, err := os.Stat(filepath.Join(sftpDir, "dir", "empty"))
+		assert.Nil(t, err)
+		assert.True(t, info.IsDir())
+		_, err = os.Stat(paths.TempPath(filepath.Join(sftpDir, "a.txt")))
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("sftp to s3", func(t *testing.T) {
+		copyStorage(t, sftpStorage, s3Storage)
+		assert.Equal(t, []byte("aaa"), objects["backup/2024/a.txt"])
+		assert.Len(t, objects["backup/2024/dir/b.txt"], 3*1024*1024)
+	})
+	t.Run("s3 to local", func(t *testing.T) {
+		copyStorage(t, s3Storage, localTarget)
+		content, err := os.ReadFile(filepath.Join(localDir, "restored", "dir", "b.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("b"), 3*1024*1024), content)
+	})
+	t.Run("skip existing", func(t *testing.T) {
+		handler, err := Get(local.String(), s3Storage.String(), 2)
+		assert.Nil(t, err)
+		handler.SourceStorage, handler.TargetStorage = local, s3Storage
+		handler.Conflict = ConflictSkip
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		// c.log 没有被过滤
+		assert.Equal(t, int64(1), handler.FileNumber)
+		assert.Equal(t, int64(2), handler.SkipNumber)
+		assert.Equal(t, []byte("ccc"), objects["backup/2024/dir/c.log"])
+	})
+	copyRemote := func(t *testing.T, sourcePath string, target storage.Storage, configure func(handler *CopyFiles)) *CopyFiles {
+		handler, err := Get(sourcePath, target.String(), 2)
+		assert.Nil(t, err)
+		handler.TargetStorage = target
+		handler.Filter, err = paths.NewFilter(nil, []string{"*.log"})
+		assert.Nil(t, err)
+		configure(handler)
+		failItems, err := handler.Copy()
+		assert.Nil(t, err)
+		assert.Empty(t, failItems)
+		return handler
 	}
+	t.Run("resume and sync", func(t *testing.T) {
+		// 远程目标的 journal 保存在缓存目录中
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+		remote, remoteObjects := newTestS3(t, "mirror")
+		// dir/b.txt 分段上传，修改时间在开始分段上传时保存
+		remote.PartSize = 1024 * 1024
+		handler := copyRemote(t, sourceDir, remote, func(handler *CopyFiles) {
+			handler.Resume, handler.Sync = true, true
+		})
+		assert.Equal(t, int64(2), handler.FileNumber)
+		assert.Equal(t, []byte("aaa"), remoteObjects["mirror/a.txt"])
+		_, err := os.Stat(getJournalPath(handler.TargetPath))
+		assert.True(t, os.IsNotExist(err))
+		// 修改时间保存在对象的元数据中，没有变化的文件不再复制
+		handler = copyRemote(t, sourceDir, remote, func(handler *CopyFiles) {
+			handler.Sync = true
+		})
+		assert.Equal(t, int64(0), handler.FileNumber)
+		assert.Equal(t, int64(2), handler.SkipNumber)
+		writer, err := remote.Create("dir/old.txt")
+		assert.Nil(t, err)
+		_, err = writer.Write([]byte("old"))
+		assert.Nil(t, err)
+		assert.Nil(t, writer.Commit())
+		handler = copyRemote(t, sourceDir, remote, func(handler *CopyFiles) {
+			handler.Sync, handler.Delete = true, true
+		})
+		assert.Equal(t, int64(1), handler.DeleteNumber)
+		assert.NotContains(t, remoteObjects, "mirror/dir/old.txt")
+	})
+	t.Run("conflict policies", func(t *testing.T) {
+		remote, remoteObjects := newTestS3(t, "conflict")
+		// 备份目录根据目标路径打开，密钥和地址从环境变量中读取
+		t.Setenv("AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		t.Setenv("AWS_ENDPOINT_URL", remote.Endpoint)
+		copyRemote(t, sourceDir, remote, func(handler *CopyFiles) {})
+		handler := copyRemote(t, sourceDir, remote, func(handler *CopyFiles) {
+			handler.Conflict = ConflictRename
+		})
+		assert.Len(t, handler.Conflicts, 2)
+		assert.Equal(t, []byte("aaa"), remoteObjects["conflict/a_1.txt"])
+		assert.Equal(t, []byte("aaa"), remoteObjects["conflict/a.txt"])
+		handler = copyRemote(t, sourceDir, remote, func(handler *CopyFiles) {
+			handler.Conflict = ConflictBackup
+		})
+		assert.Len(t, handler.Conflicts, 2)
+		assert.Equal(t, []byte("aaa"), remoteObjects["conflict.co_backup/a.txt"])
+		assert.Len(t, remoteObjects["conflict.co_backup/dir/b.txt"], 3*1024*1024)
+	})
+	t.Run("move", func(t *testing.T) {
+		moveDir := t.TempDir()
+		assert.Nil(t, os.MkdirAll(filepath.Join(moveDir, "dir"), os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(moveDir, "dir", "d.txt"), []byte("ddd"), 0644))
+		remote, remoteObjects := newTestS3(t, "moved")
+		handler := copyRemote(t, moveDir, remote, func(handler *CopyFiles) {
+			handler.Move = true
+		})
+		assert.Equal(t, int64(1), handler.FileNumber)
+		assert.Equal(t, []byte("ddd"), remoteObjects["moved/dir/d.txt"])
+		_, err := os.Stat(filepath.Join(moveDir, "dir"))
+		assert.True(t, os.IsNotExist(err))
+	})
 }
@@ -0,0 +1,304 @@
+package copy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/report"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+type DedupMode string
+
+const (
+	DedupHardlink DedupMode = "hardlink" // 重复内容硬链接到已有的目标文件，和它共享元数据
+	DedupReflink  DedupMode = "reflink"  // 重复内容在写时复制文件系统上和已有的目标文件共享数据块，元数据独立
+)
+
+const (
+	dedupIndexSuffix = ".co_copy.dedup"
+	dedupHash        = HashBLAKE3
+)
+
+func checkDedupMode(mode DedupMode) error {
+	switch mode {
+	case DedupHardlink, DedupReflink:
+		return nil
+	default:
+		return fmt.Errorf("unknown dedup mode: %v", mode)
+	}
+}
+
+// getDedupIndexPath 没有指定 DedupIndex 时索引保存在目标路径旁边的 <target>.co_copy.dedup
+func getDedupIndexPath(targetPath string) string {
+	return filepath.Clean(targetPath) + dedupIndexSuffix
+}
+
+// DedupEntry 目标路径中具有某个内容的文件，文件大小或修改时间变化后这条记录失效
+type DedupEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"` // 纳秒
+}
+
+// stat 记录仍然有效时返回目标文件的信息
+func (e *DedupEntry) stat() (os.FileInfo, bool) {
+	info, err := os.Stat(e.Path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != e.Size || info.ModTime().UnixNano() != e.ModTime {
+		return nil, false
+	}
+	return info, true
+}
+
+// dedupIndex 内容哈希和大小到目标文件的索引，复制结束后保存，下次复制到同一个目标时复用
+type dedupIndex struct {
+	path      string
+	Algorithm HashAlgorithm          `json:"algorithm"`
+	Entries   map[string]*DedupEntry `json:"entries"`
+	// 本次复制中每种内容第一个复制的文件，以及已经提交到目标路径的源文件
+	firsts    map[string]*TodoFile
+	committed map[string]bool
+	links     []dedupLink
+	sync.Mutex
+}
+
+// dedupLink 一个等待所有文件复制完成后再链接到相同内容的目标文件的重复文件
+type dedupLink struct {
+	todoFile TodoFile
+	first    *TodoFile   // 本次复制的第一个文件，为空时链接到索引中已有的目标文件
+	existing os.FileInfo // 索引中的目标文件在查找时的信息，链接前确认它没有被替换或修改
+}
+
+// loadDedupIndex 加载已有的索引，索引不存在、损坏或者哈希算法不同时重新建立
+func loadDedupIndex(path string) (*dedupIndex, error) {
+	index := &dedupIndex{
+		path:      path,
+		Algorithm: dedupHash,
+		Entries:   map[string]*DedupEntry{},
+		firsts:    map[string]*TodoFile{},
+		committed: map[string]bool{},
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, errors.Wrapf(err, "read dedup index %v error", path)
+	}
+	var saved dedupIndex
+	if err := json.Unmarshal(content, &saved); err != nil {
+		log.Warn("dedup index %v is broken, rebuild it: %v", path, err)
+		return index, nil
+	}
+	if saved.Algorithm != dedupHash || saved.Entries == nil {
+		log.Info("dedup index %v uses hash %v, rebuild it with %v", path, saved.Algorithm, dedupHash)
+		return index, nil
+	}
+	index.Entries = saved.Entries
+	log.Info("load dedup index %v, entries: %v", path, len(index.Entries))
+	return index, nil
+}
+
+func (d *dedupIndex) save(durable bool) error {
+	content, err := json.Marshal(d)
+	if err != nil {
+		return errors.Wrap(err, "encode dedup index error")
+	}
+	tempPath := paths.TempPath(d.path)
+	if err := os.WriteFile(tempPath, content, 0644); err != nil {
+		return errors.Wrapf(err, "write dedup index %v error", tempPath)
+	}
+	return paths.CommitFile(tempPath, d.path, durable)
+}
+
+// dedupFile 计算源文件内容的哈希，已经有相同内容的目标文件时记录为等待链接的重复文件并返回 true，否则由调用方复制
+func (c *CopyFiles) dedupFile(todoFile *TodoFile) bool {
+	if c.dedup == nil || todoFile.FileInfo.Size == 0 {
+		return false
+	}
+	sum, err := fileChecksum(todoFile.FileInfo.Path, dedupHash)
+	if err != nil {
+		// 正常复制，读取失败时由复制记录失败原因
+		log.Debug("hash %v for dedup error: %v", todoFile.FileInfo.Path, err)
+		return false
+	}
+	key := fmt.Sprintf("%x-%d", sum, todoFile.FileInfo.Size)
+	d := c.dedup
+	d.Lock()
+	defer d.Unlock()
+	if first, ok := d.firsts[key]; ok {
+		todoFile.LinkTarget = first.TargetPath
+		d.links = append(d.links, dedupLink{todoFile: *todoFile, first: first})
+		return true
+	}
+	if entry, ok := d.Entries[key]; ok {
+		if existing, valid := entry.stat(); valid {
+			todoFile.LinkTarget = entry.Path
+			d.links = append(d.links, dedupLink{todoFile: *todoFile, existing: existing})
+			return true
+		}
+		delete(d.Entries, key)
+	}
+	d.firsts[key] = todoFile
+	return false
+}
+
+// dedupDone 文件已经完整写入目标路径，相同内容的文件可以链接到它
+func (c *CopyFiles) dedupDone(todoFile *TodoFile) {
+	if c.dedup == nil {
+		return
+	}
+	c.dedup.Lock()
+	c.dedup.committed[todoFile.FileInfo.Path] = true
+	c.dedup.Unlock()
+}
+
+// createDedupLinks 所有文件复制完成后把重复文件链接到相同内容的目标文件，再把本次复制的文件加入索引并保存。
+// 链接和不能链接时的复制都通过协程池并发执行，全部完成后才更新索引
+func (c *CopyFiles) createDedupLinks() {
+	if c.dedup == nil {
+		return
+	}
+	d := c.dedup
+	for i := range d.links {
+		if c.ctx.Err() != nil {
+			break
+		}
+		link := &d.links[i]
+		c.pool.Add(1)
+		go func() {
+			defer c.pool.Done()
+			if c.ctx.Err() != nil {
+				return
+			}
+			todoFile := &link.todoFile
+			if !d.linkable(link) {
+				// 第一个文件没有写入，或者索引中的文件已经被这次复制替换，单独复制
+				log.Debug("dedup target %v of %v is not available, copy directly", todoFile.LinkTarget, todoFile.FileInfo.Path)
+				todoFile.LinkTarget = ""
+				c.copyDirectly(todoFile)
+				return
+			}
+			if err := c.createDedupLink(todoFile); err != nil {
+				c.addFailItem(todoFile.FileInfo.Path, err)
+			}
+		}()
+	}
+	c.pool.Wait()
+	for key, first := range d.firsts {
+		if !d.committed[first.FileInfo.Path] {
+			continue
+		}
+		info, err := os.Stat(first.TargetPath)
+		if err != nil {
+			continue
+		}
+		d.Entries[key] = &DedupEntry{Path: first.TargetPath, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	}
+	if err := d.save(c.Durable); err != nil {
+		log.Warn("save dedup index error: %v", err)
+	}
+}
+
+func (d *dedupIndex) linkable(link *dedupLink) bool {
+	if link.first != nil {
+		// 单独复制的重复文件会同时通过 dedupDone 修改 committed
+		d.Lock()
+		defer d.Unlock()
+		return d.committed[link.first.FileInfo.Path]
+	}
+	info, err := os.Stat(link.todoFile.LinkTarget)
+	return err == nil && os.SameFile(info, link.existing) && info.Size() == link.existing.Size() &&
+		info.ModTime().Equal(link.existing.ModTime())
+}
+
+// copyDirectly 不能链接的重复文件按照冲突策略处理已有目标后复制内容
+func (c *CopyFiles) copyDirectly(todoFile *TodoFile) {
+	ok, err := c.resolveConflict(todoFile)
+	if err != nil {
+		c.addFailItem(todoFile.FileInfo.Path, err)
+		return
+	}
+	if ok {
+		atomic.AddInt64(&c.FileNumber, 1)
+		c.copyItem(todoFile)
+	}
+}
+
+func (c *CopyFiles) createDedupLink(todoFile *TodoFile) error {
+	if targetInfo, err := os.Lstat(todoFile.TargetPath); err == nil {
+		// 上次复制时已经链接过，或者目标就是索引中的文件
+		if linkInfo, err := os.Lstat(todoFile.LinkTarget); err == nil && os.SameFile(targetInfo, linkInfo) {
+			c.addSkip(todoFile.FileInfo.Path, todoFile.TargetPath, todoFile.FileInfo.Size)
+			c.removeMoved(todoFile)
+			return nil
+		}
+		if ok, err := c.replaceTarget(todoFile); err != nil || !ok {
+			return err
+		}
+	}
+	var err error
+	if c.Dedup == DedupReflink {
+		err = c.cloneFile(todoFile)
+	} else {
+		err = os.Link(todoFile.LinkTarget, todoFile.TargetPath)
+	}
+	if err != nil {
+		// 跨文件系统、硬链接数量达到上限或者不支持 reflink 时复制内容
+		log.Debug("dedup %v to %v error: %v, copy instead", todoFile.TargetPath, todoFile.LinkTarget, err)
+		todoFile.LinkTarget = ""
+		atomic.AddInt64(&c.FileNumber, 1)
+		c.copyItem(todoFile)
+		return nil
+	}
+	atomic.AddInt64(&c.DedupNumber, 1)
+	atomic.AddInt64(&c.DedupBytes, todoFile.FileInfo.Size)
+	c.Report.Add(report.FileItem{
+		SourcePath: todoFile.FileInfo.Path,
+		TargetPath: todoFile.TargetPath,
+		Outcome:    report.OutcomeDeduped,
+		Bytes:      todoFile.FileInfo.Size,
+		Strategy:   string(c.Dedup),
+	})
+	c.removeMoved(todoFile)
+	return nil
+}
+
+// cloneFile 把 LinkTarget 的数据块克隆到临时文件，设置源文件的元数据后提交到目标路径
+func (c *CopyFiles) cloneFile(todoFile *TodoFile) error {
+	source, err := os.Open(todoFile.LinkTarget)
+	if err != nil {
+		return errors.Wrapf(err, "open dedup target %v error", todoFile.LinkTarget)
+	}
+	defer func() {
+		if err := source.Close(); err != nil {
+			log.Debug(err.Error())
+		}
+	}()
+	tempPath := paths.TempPath(todoFile.TargetPath)
+	destination, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "open target file path %v error", tempPath)
+	}
+	err = reflink(destination, source)
+	if closeErr := destination.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "close target file %v error", tempPath)
+	}
+	if err == nil {
+		err = applyMetadata(todoFile.FileInfo.Path, tempPath, c.preserve())
+	}
+	if err == nil {
+		err = paths.CommitFile(tempPath, todoFile.TargetPath, c.Durable)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Debug("remove temp file %v error: %v", tempPath, removeErr)
+		}
+	}
+	return err
+}
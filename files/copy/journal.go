@@ -0,0 +1,281 @@
+package copy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/storage"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	journalSuffix = ".co_copy.journal"
+	// 大文件每复制这么多字节提交一次进度
+	journalCommitSize = 64 * 1024 * 1024
+)
+
+// journal 记录复制进度，每行一条 JournalRecord
+type journal struct {
+	path string
+	// 返回目标文件的信息，判断上次复制的目标文件是否还在
+	stat     func(path string) (*paths.FileInfo, error)
+	file     *os.File
+	encoder  *json.Encoder
+	done     map[string]*TodoFile
+	progress map[string]JournalRecord
+	chunks   map[string][]JournalRecord
+	fails    map[string]*FailItem
+	sync.Mutex
+}
+
+// getJournalPath 本地目标的 journal 保存在目标路径旁边。其他存储不能追加写入，保存在本地缓存目录中按目标路径区分的文件里
+func getJournalPath(targetPath string) string {
+	if !storage.IsRemote(targetPath) {
+		return filepath.Clean(targetPath) + journalSuffix
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "go_tools", "copy", fmt.Sprintf("%016x%v", xxhash.Sum64String(targetPath), journalSuffix))
+}
+
+// openJournal 打开目标路径对应的 journal
+func (c *CopyFiles) openJournal(resume bool) error {
+	j, err := openJournal(getJournalPath(c.targetPath), resume)
+	if err != nil {
+		return err
+	}
+	j.stat = c.statTarget
+	c.journal = j
+	return nil
+}
+
+// openJournal 打开日志文件，resume 为 true 时先加载已有记录，否则清空重新记录
+func openJournal(path string, resume bool) (*journal, error) {
+	j := newJournal(path)
+	if resume {
+		if err := j.load(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, errors.Wrapf(err, "make journal dir %v error", filepath.Dir(path))
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		flag |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open journal %v error", path)
+	}
+	j.file = file
+	j.encoder = json.NewEncoder(file)
+	return j, nil
+}
+
+// loadJournal 只读加载已有记录，不打开日志文件写入，dry run 时使用
+func loadJournal(path string) (*journal, error) {
+	j := newJournal(path)
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func newJournal(path string) *journal {
+	return &journal{
+		path:     path,
+		stat:     paths.GetFileInfo,
+		done:     map[string]*TodoFile{},
+		progress: map[string]JournalRecord{},
+		chunks:   map[string][]JournalRecord{},
+		fails:    map[string]*FailItem{},
+	}
+}
+
+func (j *journal) load() error {
+	file, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Info("journal %v not exist, copy from scratch", j.path)
+			return nil
+		}
+		return errors.Wrapf(err, "open journal %v error", j.path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close journal %v error: %v", j.path, err)
+		}
+	}()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record JournalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// 最后一行可能在中断时只写了一半
+			log.Debug("skip broken journal line: %v", err)
+			continue
+		}
+		j.apply(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "read journal %v error", j.path)
+	}
+	log.Info("load journal %v, done files: %v, partial files: %v, chunked files: %v, failed files: %v", j.path, len(j.done), len(j.progress), len(j.chunks), len(j.fails))
+	return nil
+}
+
+// apply 把一条记录合并到内存中的状态
+func (j *journal) apply(record JournalRecord) {
+	switch record.Type {
+	case JournalDone:
+		if record.TodoFile != nil {
+			j.done[record.TodoFile.FileInfo.Path] = record.TodoFile
+			delete(j.progress, record.TodoFile.FileInfo.Path)
+			delete(j.chunks, record.TodoFile.FileInfo.Path)
+			delete(j.fails, record.TodoFile.FileInfo.Path)
+		}
+	case JournalProgress:
+		if record.TodoFile != nil {
+			j.progress[record.TodoFile.FileInfo.Path] = record
+		}
+	case JournalChunk:
+		if record.TodoFile != nil {
+			j.chunks[record.TodoFile.FileInfo.Path] = append(j.chunks[record.TodoFile.FileInfo.Path], record)
+		}
+	case JournalFail:
+		if record.FailItem != nil {
+			j.fails[record.FailItem.Path] = record.FailItem
+		}
+	}
+}
+
+func (j *journal) write(record JournalRecord) {
+	j.Lock()
+	defer j.Unlock()
+	if err := j.encoder.Encode(record); err != nil {
+		log.Warn("write journal %v error: %v", j.path, err)
+	}
+	// 运行中也记录文件的复制进度，重试时从已经提交的位置继续。完成的文件只需要清理进度，不再保存
+	switch record.Type {
+	case JournalProgress, JournalChunk:
+		j.apply(record)
+	case JournalDone:
+		delete(j.progress, record.TodoFile.FileInfo.Path)
+		delete(j.chunks, record.TodoFile.FileInfo.Path)
+	}
+}
+
+// isDone 文件在上次运行中已经完整复制，而且源文件和目标文件都没有变化
+func (j *journal) isDone(todoFile *TodoFile) bool {
+	j.Lock()
+	record, ok := j.done[todoFile.FileInfo.Path]
+	j.Unlock()
+	if !ok || !sameTodoFile(record, todoFile) {
+		return false
+	}
+	targetInfo, err := j.stat(todoFile.TargetPath)
+	return err == nil && targetInfo.Size == todoFile.FileInfo.Size
+}
+
+// offset 返回文件上次已经提交的复制位置，没有记录或者文件发生变化时返回 0
+func (j *journal) offset(todoFile *TodoFile) int64 {
+	j.Lock()
+	record, ok := j.progress[todoFile.FileInfo.Path]
+	j.Unlock()
+	if !ok || !sameTodoFile(record.TodoFile, todoFile) {
+		return 0
+	}
+	targetInfo, err := j.stat(todoFile.TargetPath)
+	if err != nil || targetInfo.Size < record.Offset {
+		return 0
+	}
+	return record.Offset
+}
+
+// started 文件上次已经复制了一部分，目标文件是自己写入的，不算冲突
+func (j *journal) started(todoFile *TodoFile) bool {
+	return j.offset(todoFile) > 0 || len(j.doneChunks(todoFile)) > 0
+}
+
+// doneChunks 返回上次分块复制中已经完成的块，key 为块的起始位置，value 为块大小
+func (j *journal) doneChunks(todoFile *TodoFile) map[int64]int64 {
+	result := map[int64]int64{}
+	j.Lock()
+	records := j.chunks[todoFile.FileInfo.Path]
+	j.Unlock()
+	if len(records) == 0 {
+		return result
+	}
+	targetInfo, err := j.stat(todoFile.TargetPath)
+	if err != nil || targetInfo.Size != todoFile.FileInfo.Size {
+		return result
+	}
+	for _, record := range records {
+		if sameTodoFile(record.TodoFile, todoFile) {
+			result[record.Offset] = record.Length
+		}
+	}
+	return result
+}
+
+func (j *journal) commitChunk(todoFile *TodoFile, offset, length int64) {
+	j.write(JournalRecord{
+		Type:     JournalChunk,
+		TodoFile: todoFile,
+		Offset:   offset,
+		Length:   length,
+	})
+}
+
+func (j *journal) commit(todoFile *TodoFile, offset int64) {
+	j.write(JournalRecord{
+		Type:     JournalProgress,
+		TodoFile: todoFile,
+		Offset:   offset,
+	})
+}
+
+func (j *journal) finish(todoFile *TodoFile) {
+	j.write(JournalRecord{
+		Type:     JournalDone,
+		TodoFile: todoFile,
+	})
+}
+
+func (j *journal) fail(item FailItem) {
+	j.write(JournalRecord{
+		Type:     JournalFail,
+		FailItem: &item,
+	})
+}
+
+// close 关闭日志文件，remove 为 true 时删除日志（所有文件都复制成功）
+func (j *journal) close(remove bool) {
+	if err := j.file.Sync(); err != nil {
+		log.Debug("sync journal %v error: %v", j.path, err)
+	}
+	if err := j.file.Close(); err != nil {
+		log.Debug("close journal %v error: %v", j.path, err)
+	}
+	if remove {
+		if err := os.Remove(j.path); err != nil {
+			log.Debug("remove journal %v error: %v", j.path, err)
+		}
+	}
+}
+
+func sameTodoFile(record, todoFile *TodoFile) bool {
+	return record != nil && record.FileInfo != nil &&
+		record.TargetPath == todoFile.TargetPath &&
+		record.FileInfo.Size == todoFile.FileInfo.Size &&
+		record.FileInfo.UpdatedAt == todoFile.FileInfo.UpdatedAt
+}
@@ -0,0 +1,129 @@
+package copy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"os"
+	"sync/atomic"
+)
+
+type SymlinkPolicy string
+
+const (
+	SymlinkCopyLink SymlinkPolicy = "copy-link" // 在目标路径重新创建相同内容的符号链接
+	SymlinkFollow   SymlinkPolicy = "follow"    // 复制链接指向的文件或目录，指向祖先目录的循环链接会记录为失败
+	SymlinkSkip     SymlinkPolicy = "skip"      // 忽略符号链接
+)
+
+func checkSymlinkPolicy(policy SymlinkPolicy) error {
+	switch policy {
+	case SymlinkCopyLink, SymlinkFollow, SymlinkSkip:
+		return nil
+	default:
+		return fmt.Errorf("unknown symlink policy: %v", policy)
+	}
+}
+
+type hardlinkKey struct {
+	dev   uint64
+	inode uint64
+}
+
+// copySymlink 在目标路径创建和源链接内容相同的符号链接
+func (c *CopyFiles) copySymlink(todoFile *TodoFile) error {
+	if !c.localTarget() {
+		return fmt.Errorf("target %v does not support symlinks", c.target)
+	}
+	linkTarget, err := c.readlink(todoFile.FileInfo.Path)
+	if err != nil {
+		return errors.Wrapf(err, "read symlink %v error", todoFile.FileInfo.Path)
+	}
+	if targetInfo, err := os.Lstat(todoFile.TargetPath); err == nil {
+		if targetInfo.Mode()&os.ModeSymlink != 0 {
+			if existLinkTarget, err := os.Readlink(todoFile.TargetPath); err == nil && existLinkTarget == linkTarget {
+				c.addSkip(todoFile.FileInfo.Path, todoFile.TargetPath, 0)
+				c.removeMoved(todoFile)
+				return nil
+			}
+		}
+		if ok, err := c.replaceTarget(todoFile); err != nil || !ok {
+			return err
+		}
+	}
+	if err := os.Symlink(linkTarget, todoFile.TargetPath); err != nil {
+		return errors.Wrapf(err, "create symlink %v error", todoFile.TargetPath)
+	}
+	c.addLink(todoFile)
+	c.removeMoved(todoFile)
+	return nil
+}
+
+// addHardlink 同一个硬链接组中第一个遇到的文件正常复制，后面的文件等复制结束后链接到第一个文件的目标路径
+func (c *CopyFiles) addHardlink(todoFile *TodoFile) bool {
+	key := hardlinkKey{dev: todoFile.FileInfo.Dev, inode: todoFile.FileInfo.Inode}
+	first, ok := c.hardlinks[key]
+	if !ok {
+		c.hardlinks[key] = todoFile
+		return false
+	}
+	todoFile.LinkTarget = first.TargetPath
+	c.pendingLinks = append(c.pendingLinks, *todoFile)
+	return true
+}
+
+func (c *CopyFiles) createHardlinks() {
+	failed := map[string]bool{}
+	c.RLock()
+	for _, item := range c.FailFiles {
+		failed[item.Path] = true
+	}
+	c.RUnlock()
+	for i := range c.pendingLinks {
+		todoFile := &c.pendingLinks[i]
+		first := c.hardlinks[hardlinkKey{dev: todoFile.FileInfo.Dev, inode: todoFile.FileInfo.Inode}]
+		// 执行计划时第一个文件可能因为未变化而跳过，此时直接链接到已有的目标文件
+		if first != nil && failed[first.FileInfo.Path] {
+			// 第一个文件复制失败，没有可以链接的目标，单独复制
+			log.Debug("hardlink source %v failed, copy %v directly", first.FileInfo.Path, todoFile.FileInfo.Path)
+			todoFile.LinkTarget = ""
+			atomic.AddInt64(&c.FileNumber, 1)
+			c.copyItem(todoFile)
+			continue
+		}
+		if err := c.createHardlink(todoFile); err != nil {
+			c.addFailItem(todoFile.FileInfo.Path, err)
+		}
+	}
+}
+
+func (c *CopyFiles) createHardlink(todoFile *TodoFile) error {
+	if targetInfo, err := os.Lstat(todoFile.TargetPath); err == nil {
+		if linkInfo, err := os.Lstat(todoFile.LinkTarget); err == nil && os.SameFile(targetInfo, linkInfo) {
+			c.addSkip(todoFile.FileInfo.Path, todoFile.TargetPath, 0)
+			c.removeMoved(todoFile)
+			return nil
+		}
+		if ok, err := c.replaceTarget(todoFile); err != nil || !ok {
+			return err
+		}
+	}
+	if err := os.Link(todoFile.LinkTarget, todoFile.TargetPath); err != nil {
+		return errors.Wrapf(err, "create hardlink %v to %v error", todoFile.TargetPath, todoFile.LinkTarget)
+	}
+	c.addLink(todoFile)
+	c.removeMoved(todoFile)
+	return nil
+}
+
+// replaceTarget 创建链接前按照冲突策略处理已有目标，需要创建链接时删除仍然存在的目标
+func (c *CopyFiles) replaceTarget(todoFile *TodoFile) (bool, error) {
+	ok, err := c.resolveConflict(todoFile)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := os.Remove(todoFile.TargetPath); err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrapf(err, "remove target %v error", todoFile.TargetPath)
+	}
+	return true, nil
+}
@@ -0,0 +1,85 @@
+package copy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+)
+
+// Preserve 复制内容后需要保留的源文件元数据
+type Preserve struct {
+	Mode  bool `json:"mode"`
+	Times bool `json:"times"`
+	Owner bool `json:"owner"`
+	Xattr bool `json:"xattr"`
+}
+
+// ParsePreserve 解析 mode,times,owner,xattr 格式的参数，all 表示保留全部元数据
+func ParsePreserve(value string) (Preserve, error) {
+	var preserve Preserve
+	for _, item := range strings.Split(value, ",") {
+		switch strings.TrimSpace(item) {
+		case "":
+		case "mode":
+			preserve.Mode = true
+		case "times":
+			preserve.Times = true
+		case "owner":
+			preserve.Owner = true
+		case "xattr":
+			preserve.Xattr = true
+		case "all":
+			preserve = Preserve{Mode: true, Times: true, Owner: true, Xattr: true}
+		default:
+			return preserve, fmt.Errorf("unknown preserve attribute: %v", item)
+		}
+	}
+	return preserve, nil
+}
+
+func (p Preserve) isEmpty() bool {
+	return !p.Mode && !p.Times && !p.Owner && !p.Xattr
+}
+
+// applyMetadata 把源文件元数据写到目标文件上。chown 会清除 setuid 位，所以顺序为 xattr、owner、mode，最后是时间
+func applyMetadata(sourcePath, targetPath string, preserve Preserve) error {
+	if preserve.isEmpty() {
+		return nil
+	}
+	sourceInfo, err := os.Lstat(sourcePath)
+	if err != nil {
+		return errors.Wrapf(err, "get source file %v info error", sourcePath)
+	}
+	if preserve.Xattr {
+		if err := copyXattr(sourcePath, targetPath); err != nil {
+			return errors.Wrapf(err, "copy xattr to %v error", targetPath)
+		}
+	}
+	if preserve.Owner {
+		if err := copyOwner(sourceInfo, targetPath); err != nil {
+			return errors.Wrapf(err, "change owner of %v error", targetPath)
+		}
+	}
+	if preserve.Mode {
+		mode := sourceInfo.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(targetPath, mode); err != nil {
+			return errors.Wrapf(err, "change mode of %v error", targetPath)
+		}
+	}
+	if preserve.Times {
+		if err := os.Chtimes(targetPath, getAccessTime(sourceInfo), sourceInfo.ModTime()); err != nil {
+			return errors.Wrapf(err, "change times of %v error", targetPath)
+		}
+	}
+	return nil
+}
+
+// applyDirMetadata 目录的时间在写入子文件时会变化，需要在所有子文件复制完成后从最深的目录开始设置
+func (c *CopyFiles) applyDirMetadata(preserve Preserve) {
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		if err := c.setMetadata(&c.dirs[i], preserve); err != nil {
+			c.addFailItem(c.dirs[i].FileInfo.Path, err)
+		}
+	}
+}
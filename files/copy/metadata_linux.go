@@ -0,0 +1,10 @@
+package copy
+
+import (
+	"syscall"
+	"time"
+)
+
+func accessTime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Atim.Unix())
+}
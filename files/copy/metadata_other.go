@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd
+
+package copy
+
+import (
+	"os"
+	"time"
+)
+
+// 其他平台没有 uid/gid 和 xattr，只保留 mode 和修改时间
+
+func copyOwner(sourceInfo os.FileInfo, targetPath string) error {
+	return nil
+}
+
+func copyXattr(sourcePath, targetPath string) error {
+	return nil
+}
+
+func getAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
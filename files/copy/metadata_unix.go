@@ -0,0 +1,96 @@
+//go:build linux || darwin || freebsd
+
+package copy
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func copyOwner(sourceInfo os.FileInfo, targetPath string) error {
+	stat, ok := sourceInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := os.Lchown(targetPath, int(stat.Uid), int(stat.Gid)); err != nil {
+		if !errors.Is(err, unix.EPERM) {
+			return err
+		}
+		// 和 cp -p 一样，非 root 用户不能把文件交给其他用户，只跳过属主
+		log.Warn("skip owner %v:%v of %v: %v", stat.Uid, stat.Gid, targetPath, err)
+	}
+	return nil
+}
+
+func copyXattr(sourcePath, targetPath string) error {
+	names, err := listXattr(sourcePath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(sourcePath, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(targetPath, name, value, 0); err != nil {
+			if !skippableXattrError(err) {
+				return err
+			}
+			// 目标文件系统不支持 xattr，或者非 root 用户不能写 security.* 和 trusted.*，只跳过这个属性
+			log.Warn("skip xattr %v of %v: %v", name, targetPath, err)
+		}
+	}
+	return nil
+}
+
+func skippableXattrError(err error) bool {
+	return err == unix.ENOTSUP || err == unix.EOPNOTSUPP || err == unix.EPERM || err == unix.EACCES
+}
+
+func listXattr(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+func getAccessTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return accessTime(stat)
+}
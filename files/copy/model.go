@@ -2,14 +2,50 @@ package copy
 
 import (
 	"go_tools/paths"
+	"go_tools/report"
 )
 
-type FailItem struct {
-	Path   string `json:"path"`
-	Reason string `json:"reason"`
+// FailType 和 FailItem 与压缩解压共用，定义在 report 包中
+type FailType = report.FailType
+
+const (
+	FailTypeVerify   = report.FailTypeVerify
+	FailTypeConflict = report.FailTypeConflict
+	FailTypeCanceled = report.FailTypeCanceled
+)
+
+type FailItem = report.FailItem
+
+// ConflictItem 一个已经存在的目标路径的冲突处理结果
+type ConflictItem struct {
+	SourcePath   string             `json:"source_path"`
+	TargetPath   string             `json:"target_path"`
+	TypeConflict bool               `json:"type_conflict"` // 源和目标一个是目录一个不是目录
+	Policy       ConflictPolicy     `json:"policy"`
+	Resolution   ConflictResolution `json:"resolution"`
+	MovedTo      string             `json:"moved_to,omitempty"` // 重命名或者备份后已有目标的新位置
 }
 
 type TodoFile struct {
 	FileInfo   *paths.FileInfo `json:"file_info"`
 	TargetPath string          `json:"target_path"`
+	LinkTarget string          `json:"link_target,omitempty"` // 硬链接到这个已经复制的目标文件，不再复制内容
+}
+
+type JournalType string
+
+const (
+	JournalDone     JournalType = "done"     // 文件已经完整复制
+	JournalProgress JournalType = "progress" // 文件已经复制到 Offset 位置
+	JournalFail     JournalType = "fail"     // 文件复制失败，下次 resume 时重试
+	JournalChunk    JournalType = "chunk"    // 大文件分块复制时 [Offset, Offset+Length) 已经复制完成
+)
+
+// JournalRecord 断点续传日志中的一行记录
+type JournalRecord struct {
+	Type     JournalType `json:"type"`
+	TodoFile *TodoFile   `json:"todo_file,omitempty"`
+	Offset   int64       `json:"offset,omitempty"`
+	Length   int64       `json:"length,omitempty"`
+	FailItem *FailItem   `json:"fail_item,omitempty"`
 }
@@ -0,0 +1,125 @@
+package copy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/report"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	StrategyRename CopyStrategy = "rename" // 移动时源和目标在同一个文件系统中，直接 rename
+)
+
+// prepareMove 移动前检查参数。跨文件系统时源文件在目标文件校验并落盘之后才删除，中断也不会丢失数据
+func (c *CopyFiles) prepareMove() error {
+	if !c.Move {
+		return nil
+	}
+	// 跟随链接会删除源路径以外的文件
+	if c.Symlink == SymlinkFollow {
+		return fmt.Errorf("symlink policy %v is not supported when moving", SymlinkFollow)
+	}
+	if len(c.Verify) == 0 {
+		c.Verify = HashXXHash
+	}
+	c.Durable = true
+	if !c.local() {
+		// 不同的存储之间只能复制后删除源文件
+		c.renameable.Store(false)
+		return nil
+	}
+	sourceInfo, err := paths.GetFileInfo(c.sourcePath)
+	if err != nil {
+		return err
+	}
+	targetDev := existingDev(c.targetPath)
+	// 不能获取设备号的平台先尝试 rename，失败后再复制
+	c.renameable.Store(sourceInfo.Dev == 0 || targetDev == 0 || sourceInfo.Dev == targetDev)
+	if sourceInfo.Dev != 0 && sourceInfo.Dev == targetDev {
+		// rename 保留了硬链接，不需要重建硬链接组
+		c.Hardlink = false
+	}
+	return nil
+}
+
+// existingDev 返回 path 或者离它最近的已经存在的上级目录所在的设备
+func existingDev(path string) uint64 {
+	for {
+		if info, err := paths.GetFileInfo(path); err == nil {
+			return info.Dev
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0
+		}
+		path = parent
+	}
+}
+
+// renameFile 源和目标在同一个文件系统中时直接 rename，返回 false 时需要复制
+func (c *CopyFiles) renameFile(todoFile *TodoFile) bool {
+	if !c.Move || !c.renameable.Load() {
+		return false
+	}
+	if err := os.Rename(todoFile.FileInfo.Path, todoFile.TargetPath); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			c.renameable.Store(false)
+		}
+		log.Debug("rename %v to %v error: %v, copy instead", todoFile.FileInfo.Path, todoFile.TargetPath, err)
+		return false
+	}
+	atomic.AddInt64(&c.FileNumber, 1)
+	atomic.AddInt64(&c.CopiedBytes, todoFile.FileInfo.Size)
+	c.dedupDone(todoFile)
+	c.addStrategy(StrategyRename)
+	c.Progress.Add(todoFile.FileInfo.Size)
+	c.Progress.FileDone()
+	c.Report.Add(report.FileItem{
+		SourcePath: todoFile.FileInfo.Path,
+		TargetPath: todoFile.TargetPath,
+		Outcome:    report.OutcomeMoved,
+		Bytes:      todoFile.FileInfo.Size,
+		Strategy:   string(StrategyRename),
+	})
+	return true
+}
+
+// verifyMoved journal 只比较了目标文件的大小，移动时删除源文件前重新比较源文件和目标文件的哈希
+func (c *CopyFiles) verifyMoved(todoFile *TodoFile) error {
+	if !c.Move {
+		return nil
+	}
+	sourceSum, err := checksum(c.source, todoFile.FileInfo.Path, c.Verify)
+	if err != nil {
+		return errors.Wrap(err, "verify moved source error")
+	}
+	return c.verifyTarget(todoFile, sourceSum)
+}
+
+// removeMoved 目标已经完整写入后删除移动的源文件
+func (c *CopyFiles) removeMoved(todoFile *TodoFile) bool {
+	if !c.Move {
+		return true
+	}
+	if err := c.removeSource(todoFile.FileInfo.Path); err != nil {
+		c.addFailItem(todoFile.FileInfo.Path, errors.Wrap(err, "remove moved source error"))
+		return false
+	}
+	return true
+}
+
+// removeMovedDirs 从最深的目录开始删除已经移空的源目录，过滤掉或者移动失败的文件所在的目录保留
+func (c *CopyFiles) removeMovedDirs() {
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		path := c.dirs[i].FileInfo.Path
+		if err := c.removeSource(path); err != nil {
+			log.Debug("keep source dir %v: %v", path, err)
+		}
+	}
+}
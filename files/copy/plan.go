@@ -0,0 +1,366 @@
+package copy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/units"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+type PlanAction string
+
+const (
+	ActionCreateDir PlanAction = "create_dir"
+	ActionCopy      PlanAction = "copy"
+	ActionOverwrite PlanAction = "overwrite"
+	ActionSymlink   PlanAction = "symlink"
+	ActionHardlink  PlanAction = "hardlink"
+	ActionDelete    PlanAction = "delete"
+	ActionSkip      PlanAction = "skip"
+	ActionConflict  PlanAction = "conflict" // 冲突策略为 fail 或者无法判断的目标，执行计划时不会处理
+)
+
+// PlanItem 计划中对一个路径的操作
+type PlanItem struct {
+	Action     PlanAction `json:"action"`
+	SourcePath string     `json:"source_path,omitempty"`
+	TargetPath string     `json:"target_path"`
+	LinkTarget string     `json:"link_target,omitempty"` // 符号链接的内容，或者硬链接指向的目标文件
+	Size       int64      `json:"size"`
+	UpdatedAt  int64      `json:"updated_at"`
+	Reason     string     `json:"reason,omitempty"`
+	// 生成计划时已有目标的大小和修改时间，执行时目标变化的文件不再按计划覆盖
+	TargetSize      int64 `json:"target_size,omitempty"`
+	TargetUpdatedAt int64 `json:"target_updated_at,omitempty"`
+}
+
+// Plan dry-run 生成的复制计划，保存后可以通过 ExecutePlan 原样执行
+type Plan struct {
+	SourcePath     string         `json:"source_path"`
+	TargetPath     string         `json:"target_path"`
+	CreatedAt      int64          `json:"created_at"`
+	Conflict       ConflictPolicy `json:"conflict"` // 生成计划时的冲突策略，执行时使用相同的策略
+	Items          []PlanItem     `json:"items"`
+	TotalBytes     int64          `json:"total_bytes"` // 需要复制的字节数
+	FileNumber     int64          `json:"file_number"` // 需要复制或覆盖的文件数
+	DirNumber      int64          `json:"dir_number"`  // 需要创建的目录数
+	LinkNumber     int64          `json:"link_number"`
+	DeleteNumber   int64          `json:"delete_number"`
+	SkipNumber     int64          `json:"skip_number"`
+	ConflictNumber int64          `json:"conflict_number"`
+}
+
+func (p *Plan) add(item PlanItem) {
+	p.Items = append(p.Items, item)
+	switch item.Action {
+	case ActionCreateDir:
+		p.DirNumber += 1
+	case ActionCopy, ActionOverwrite:
+		p.FileNumber += 1
+		p.TotalBytes += item.Size
+	case ActionSymlink, ActionHardlink:
+		p.LinkNumber += 1
+	case ActionDelete:
+		p.DeleteNumber += 1
+	case ActionSkip:
+		p.SkipNumber += 1
+	case ActionConflict:
+		p.ConflictNumber += 1
+	}
+}
+
+func (p *Plan) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "create plan file %v error", path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close plan file %v error: %v", path, err)
+		}
+	}()
+	return p.WriteJSON(file)
+}
+
+func LoadPlan(path string) (*Plan, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read plan file %v error", path)
+	}
+	var plan Plan
+	if err := json.Unmarshal(content, &plan); err != nil {
+		return nil, errors.Wrapf(err, "decode plan file %v error", path)
+	}
+	return &plan, nil
+}
+
+func (p *Plan) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+func (p *Plan) WriteTable(writer io.Writer) error {
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "ACTION\tSIZE\tSOURCE\tTARGET\tREASON")
+	for _, item := range p.Items {
+		_, _ = fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\n", item.Action, units.FormatSize(item.Size), item.SourcePath, item.TargetPath, item.Reason)
+	}
+	_, _ = fmt.Fprintf(table, "\ntotal: %v to copy, files: %v, dirs: %v, links: %v, delete: %v, skip: %v, conflict: %v\n",
+		units.FormatSize(p.TotalBytes), p.FileNumber, p.DirNumber, p.LinkNumber, p.DeleteNumber, p.SkipNumber, p.ConflictNumber)
+	return table.Flush()
+}
+
+// buildPlan 遍历源路径，判断每个路径需要的操作，不修改目标路径
+func (c *CopyFiles) buildPlan() (*Plan, error) {
+	plan := &Plan{
+		SourcePath: c.sourcePath,
+		TargetPath: c.targetPath,
+		CreatedAt:  time.Now().Unix(),
+		Conflict:   c.Conflict,
+	}
+	if c.Resume {
+		journal, err := loadJournal(getJournalPath(c.targetPath))
+		if err != nil {
+			return nil, err
+		}
+		journal.stat = c.statTarget
+		c.journal = journal
+	}
+	err := c.walkSource(func(fileInfo *paths.FileInfo, targetPath string) error {
+		plan.add(c.planItem(fileInfo, targetPath))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.Sync && c.Delete {
+		extraneous, err := c.findExtraneous(c.targetPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range extraneous {
+			plan.add(PlanItem{
+				Action:     ActionDelete,
+				TargetPath: path,
+			})
+		}
+	}
+	return plan, nil
+}
+
+func (c *CopyFiles) planItem(fileInfo *paths.FileInfo, targetPath string) PlanItem {
+	item := PlanItem{
+		SourcePath: fileInfo.Path,
+		TargetPath: targetPath,
+		UpdatedAt:  fileInfo.UpdatedAt,
+	}
+	targetInfo, targetErr := c.statTarget(targetPath)
+	if targetErr != nil && !errors.Is(targetErr, os.ErrNotExist) {
+		item.Action = ActionConflict
+		item.Reason = targetErr.Error()
+		return item
+	}
+	targetExist := targetErr == nil
+	if fileInfo.IsDir {
+		switch {
+		case !targetExist:
+			item.Action = ActionCreateDir
+		case targetInfo.IsDir:
+			item.Action = ActionSkip
+			item.Reason = "directory exists"
+		default:
+			c.planConflict(&item, fileInfo, targetInfo, ActionCreateDir)
+			if item.Action != ActionCreateDir {
+				c.skippedDirs = append(c.skippedDirs, targetPath)
+			}
+		}
+		return item
+	}
+	if fileInfo.IsSymlink {
+		if c.Symlink == SymlinkSkip {
+			item.Action = ActionSkip
+			item.Reason = "symlink skipped"
+			return item
+		}
+		item.Action = ActionSymlink
+		item.LinkTarget, _ = c.readlink(fileInfo.Path)
+		return item
+	}
+	item.Size = fileInfo.Size
+	todoFile := TodoFile{
+		FileInfo:   fileInfo,
+		TargetPath: targetPath,
+	}
+	if c.Hardlink && fileInfo.Links > 1 && c.addHardlink(&todoFile) {
+		item.Action = ActionHardlink
+		item.LinkTarget = todoFile.LinkTarget
+		return item
+	}
+	if c.Resume && c.journal.isDone(&todoFile) {
+		item.Action = ActionSkip
+		item.Reason = "finished in journal"
+		return item
+	}
+	if !targetExist {
+		item.Action = ActionCopy
+		return item
+	}
+	if c.Sync && !targetInfo.IsDir {
+		need, err := c.needCopy(&todoFile)
+		if err != nil {
+			item.Action = ActionConflict
+			item.Reason = err.Error()
+			return item
+		}
+		if !need {
+			item.Action = ActionSkip
+			item.Reason = "unchanged"
+			return item
+		}
+	}
+	c.planConflict(&item, fileInfo, targetInfo, ActionOverwrite)
+	return item
+}
+
+// planConflict 按照冲突策略决定已经存在的目标需要的操作，需要写入目标时使用 action
+func (c *CopyFiles) planConflict(item *PlanItem, fileInfo *paths.FileInfo, targetInfo *paths.FileInfo, action PlanAction) {
+	resolution := c.decideConflict(fileInfo, targetInfo.IsDir, targetInfo.UpdatedAt)
+	item.Reason = fmt.Sprintf("target exists, %v", resolution)
+	if fileInfo.IsDir != targetInfo.IsDir {
+		item.Reason = fmt.Sprintf("type conflict, %v", resolution)
+	}
+	switch resolution {
+	case ResolutionSkipped:
+		item.Action = ActionSkip
+	case ResolutionFailed:
+		item.Action = ActionConflict
+	default:
+		item.Action = action
+		item.TargetSize, item.TargetUpdatedAt = targetInfo.Size, targetInfo.UpdatedAt
+	}
+}
+
+// ExecutePlan 按照 dry-run 生成的计划执行，源文件在生成计划后发生变化时记录为失败
+func (c *CopyFiles) ExecutePlan(plan *Plan) ([]FailItem, error) {
+	return c.ExecutePlanWithContext(context.Background(), plan)
+}
+
+// ExecutePlanWithContext ctx 取消后不再执行剩下的操作，正在复制的文件和 CopyWithContext 一样停止
+func (c *CopyFiles) ExecutePlanWithContext(ctx context.Context, plan *Plan) ([]FailItem, error) {
+	defer c.begin(ctx)()
+	c.SourcePath = plan.SourcePath
+	c.TargetPath = plan.TargetPath
+	if len(plan.Conflict) > 0 {
+		c.Conflict = plan.Conflict
+	}
+	if err := c.prepare(); err != nil {
+		return nil, err
+	}
+	if err := c.openJournal(false); err != nil {
+		return nil, err
+	}
+	// 计划中已经有需要复制的总大小，不需要再扫描
+	stop := c.startProgress(func() {
+		c.Progress.AddTotal(plan.TotalBytes, plan.FileNumber)
+	})
+	defer stop()
+	for i := range plan.Items {
+		if c.ctx.Err() != nil {
+			break
+		}
+		if err := c.executePlanItem(&plan.Items[i]); err != nil {
+			c.addFailItem(plan.Items[i].SourcePath, err)
+		}
+	}
+	return c.finish(nil, false)
+}
+
+func (c *CopyFiles) executePlanItem(item *PlanItem) error {
+	switch item.Action {
+	case ActionSkip:
+		c.addSkip(item.SourcePath, item.TargetPath, item.Size)
+		return nil
+	case ActionConflict:
+		c.addFail(FailItem{
+			Path:   item.SourcePath,
+			Reason: fmt.Sprintf("target %v conflicts: %v", item.TargetPath, item.Reason),
+			Type:   FailTypeConflict,
+		})
+		return nil
+	case ActionDelete:
+		if err := c.removeTarget(item.TargetPath); err != nil {
+			return errors.Wrapf(err, "delete target %v error", item.TargetPath)
+		}
+		c.addDelete(item.TargetPath)
+		return nil
+	}
+	fileInfo, err := c.statSource(item.SourcePath)
+	if err != nil {
+		return err
+	}
+	todoFile := TodoFile{
+		FileInfo:   fileInfo,
+		TargetPath: item.TargetPath,
+	}
+	switch item.Action {
+	case ActionCreateDir:
+		return c.makeDir(&todoFile)
+	case ActionSymlink:
+		return c.copySymlink(&todoFile)
+	case ActionHardlink:
+		todoFile.LinkTarget = item.LinkTarget
+		c.pendingLinks = append(c.pendingLinks, todoFile)
+	case ActionCopy, ActionOverwrite:
+		if fileInfo.Size != item.Size || fileInfo.UpdatedAt != item.UpdatedAt {
+			return fmt.Errorf("source file %v changed after plan was created", item.SourcePath)
+		}
+		if err := c.checkPlanTarget(item); err != nil {
+			if errors.Is(err, errTargetChanged) {
+				c.addFail(FailItem{
+					Path:   item.SourcePath,
+					Reason: err.Error(),
+					Type:   FailTypeConflict,
+				})
+				return nil
+			}
+			return err
+		}
+		if c.Hardlink && fileInfo.Links > 1 {
+			c.hardlinks[hardlinkKey{dev: fileInfo.Dev, inode: fileInfo.Inode}] = &todoFile
+		}
+		c.submit(&todoFile)
+	default:
+		return fmt.Errorf("unknown plan action: %v", item.Action)
+	}
+	return nil
+}
+
+var errTargetChanged = errors.New("target changed after plan was created")
+
+// checkPlanTarget 复制前重新检查目标，copy 要求目标仍然不存在，overwrite 要求目标的大小和修改时间没有变化，
+// 否则返回 errTargetChanged，不能用当前的冲突策略处理计划之外的目标
+func (c *CopyFiles) checkPlanTarget(item *PlanItem) error {
+	targetInfo, err := c.statTarget(item.TargetPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "get target %v info error", item.TargetPath)
+	}
+	exists := err == nil
+	switch {
+	case item.Action == ActionCopy && exists:
+		return errors.Wrapf(errTargetChanged, "target %v exists", item.TargetPath)
+	case item.Action == ActionOverwrite && !exists:
+		return errors.Wrapf(errTargetChanged, "target %v was removed", item.TargetPath)
+	case item.Action == ActionOverwrite && item.TargetUpdatedAt > 0 &&
+		(targetInfo.Size != item.TargetSize || targetInfo.UpdatedAt != item.TargetUpdatedAt):
+		return errors.Wrapf(errTargetChanged, "target %v was modified", item.TargetPath)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package copy
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/storage"
+	"sort"
+	"strings"
+)
+
+// RetryFailed 只重新复制 failures 中的源路径，failures 通常来自上一次运行的报告
+func (c *CopyFiles) RetryFailed(failures []FailItem) ([]FailItem, error) {
+	return c.RetryFailedWithContext(context.Background(), failures)
+}
+
+// RetryFailedWithContext 上一次失败的文件可能留下了临时文件和 journal 中的进度，按照 resume 从断点继续。
+// 失败的路径已经通过了上一次的过滤规则，不再过滤
+func (c *CopyFiles) RetryFailedWithContext(ctx context.Context, failures []FailItem) ([]FailItem, error) {
+	defer c.begin(ctx)()
+	c.Resume = true
+	c.Filter = nil
+	if err := c.prepare(); err != nil {
+		return nil, err
+	}
+	roots := c.failedRoots(failures)
+	if err := c.openJournal(c.Resume); err != nil {
+		return nil, err
+	}
+	stop := c.startProgress(func() {
+		for _, root := range roots {
+			c.scanPath(root)
+		}
+	})
+	defer stop()
+	for _, root := range roots {
+		if c.ctx.Err() != nil {
+			break
+		}
+		// 上级目录可能也没有创建成功，源路径本身由遍历创建
+		relPath, err := storage.RelPath(c.source, root)
+		if err == nil && len(relPath) > 0 {
+			err = c.target.MkdirAll(storage.Join(relPath, ".."))
+		}
+		if err != nil {
+			c.addFailItem(root, errors.Wrapf(err, "make parent dir of %v error", storage.Location(c.target, relPath)))
+			continue
+		}
+		if err := c.walkPath(root, c.doCopy); err != nil {
+			c.addFailItem(root, err)
+		}
+	}
+	return c.finish(nil, false)
+}
+
+// failedRoots 返回需要重新复制的源路径，去掉重复的路径、已经包含在失败目录中的路径和不在源路径中的路径
+func (c *CopyFiles) failedRoots(failures []FailItem) []string {
+	var candidates []string
+	for _, item := range failures {
+		relPath, err := storage.RelPath(c.source, item.Path)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			// 例如镜像模式下删除失败的目标文件
+			log.Warn("skip failed path %v, not in source path %v", item.Path, c.sourcePath)
+			continue
+		}
+		candidates = append(candidates, relPath)
+	}
+	// 排序后上级目录在子路径之前
+	sort.Strings(candidates)
+	var roots []string
+	added := map[string]bool{}
+	for _, relPath := range candidates {
+		if !added[relPath] && !underAdded(relPath, added) {
+			roots = append(roots, storage.Location(c.source, relPath))
+		}
+		added[relPath] = true
+	}
+	return roots
+}
+
+// underAdded 相对路径 relPath 的某个上级目录已经需要重新复制
+func underAdded(relPath string, added map[string]bool) bool {
+	for len(relPath) > 0 {
+		relPath = storage.Join(relPath, "..")
+		if added[relPath] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package copy
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/storage"
+	"go_tools/units"
+	"os"
+	"syscall"
+)
+
+// checkSpace 复制前统计还需要写入目标的字节数，目标文件系统的可用空间不够时拒绝开始复制。
+// 会被覆盖的目标文件只计算增加的部分，同一个硬链接组只计算一次
+func (c *CopyFiles) checkSpace() error {
+	if c.Force {
+		return nil
+	}
+	if !c.local() {
+		return c.checkRemoteSpace()
+	}
+	if c.Move {
+		// 同一个文件系统中 rename 不占用新的空间
+		if sourceInfo, err := paths.GetFileInfo(c.sourcePath); err == nil && sourceInfo.Dev != 0 && sourceInfo.Dev == existingDev(c.targetPath) {
+			return nil
+		}
+	}
+	var need int64
+	links := map[hardlinkKey]bool{}
+	_, err := paths.DoIterPathWithOption(c.sourcePath, func(fileInfo *paths.FileInfo, iterErr error) error {
+		if iterErr != nil || fileInfo.IsDir || fileInfo.IsSymlink {
+			return nil
+		}
+		if c.Hardlink && fileInfo.Links > 1 {
+			key := hardlinkKey{dev: fileInfo.Dev, inode: fileInfo.Inode}
+			if links[key] {
+				return nil
+			}
+			links[key] = true
+		}
+		size := fileInfo.Size
+		if targetPath, err := c.targetOf(fileInfo.Path); err == nil {
+			if targetInfo, err := os.Lstat(targetPath); err == nil && targetInfo.Mode().IsRegular() {
+				size -= targetInfo.Size()
+			}
+		}
+		if size > 0 {
+			need += size
+		}
+		return nil
+	}, paths.IterOption{
+		IgnoreErr:     true,
+		FollowSymlink: c.Symlink == SymlinkFollow,
+		Filter:        c.Filter,
+		Context:       c.ctx,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "count source size of %v error", c.sourcePath)
+	}
+	return paths.CheckSpace(c.targetPath, need)
+}
+
+// checkRemoteSpace 目标存储可以查询剩余空间时，复制前比较源文件的总大小
+func (c *CopyFiles) checkRemoteSpace() error {
+	free, err := storage.FreeSpace(c.target)
+	if err != nil {
+		log.Debug("skip space check: %v", err)
+		return nil
+	}
+	var need int64
+	err = storage.Walk(c.ctx, c.source, "", c.Filter, func(fileInfo *paths.FileInfo, walkErr error) error {
+		if walkErr == nil && !fileInfo.IsDir {
+			need += fileInfo.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "count source size of %v error", c.source)
+	}
+	if need > free {
+		return &paths.SpaceError{Path: c.target.String(), Need: need, Free: free}
+	}
+	log.Debug("space check of %v passed, need: %v, free: %v", c.target, units.FormatSize(need), units.FormatSize(free))
+	return nil
+}
+
+// stopOnNoSpace 目标没有空间时后面的文件也写不进去，删除写了一半的临时文件释放空间并停止整个复制，
+// 已经完成的文件保留，journal 中的进度可以在清理空间后 resume 继续
+func (c *CopyFiles) stopOnNoSpace(tempPath string, err error) {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return
+	}
+	if len(tempPath) > 0 {
+		if removeErr := os.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Debug("remove temp file %v error: %v", tempPath, removeErr)
+		}
+	}
+	if c.stop != nil {
+		c.stop(errors.Wrap(err, "no space left on target, copy stopped"))
+	}
+}
@@ -0,0 +1,327 @@
+package copy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/progress"
+	"go_tools/storage"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	StrategyStream CopyStrategy = "stream" // 源或目标不在本地文件系统，通过存储接口流式复制
+)
+
+// openStorages 打开没有传入的源和目标存储，本地路径使用 storage.Local
+func (c *CopyFiles) openStorages() error {
+	c.source, c.target = c.SourceStorage, c.TargetStorage
+	if c.source == nil {
+		source, err := storage.Open(c.SourcePath)
+		if err != nil {
+			return errors.Wrapf(err, "open source %v error", c.SourcePath)
+		}
+		c.source = source
+		c.opened = append(c.opened, source)
+	}
+	if c.target == nil {
+		target, err := storage.Open(c.TargetPath)
+		if err != nil {
+			return errors.Wrapf(err, "open target %v error", c.TargetPath)
+		}
+		c.target = target
+		c.opened = append(c.opened, target)
+	}
+	return nil
+}
+
+// closeStorages 关闭复制时打开的存储
+func (c *CopyFiles) closeStorages() {
+	for _, item := range c.opened {
+		if err := item.Close(); err != nil {
+			log.Debug("close storage %v error: %v", item, err)
+		}
+	}
+	c.opened = nil
+}
+
+func (c *CopyFiles) localSource() bool {
+	_, ok := c.source.(*storage.Local)
+	return ok
+}
+
+func (c *CopyFiles) localTarget() bool {
+	_, ok := c.target.(*storage.Local)
+	return ok
+}
+
+// local 源和目标都在本地文件系统中，可以使用内核复制、分块、临时文件断点续传和链接
+func (c *CopyFiles) local() bool {
+	return c.localSource() && c.localTarget()
+}
+
+// targetOf 返回源路径中的 sourcePath 对应的目标路径
+func (c *CopyFiles) targetOf(sourcePath string) (string, error) {
+	relPath, err := storage.RelPath(c.source, sourcePath)
+	if err != nil {
+		return "", err
+	}
+	return storage.Location(c.target, relPath), nil
+}
+
+// isUnder path 在目录 dir 中。本地遍历得到的路径使用 / 拼接，两种分隔符都要判断
+func isUnder(path, dir string) bool {
+	return strings.HasPrefix(path, dir+"/") || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// iterSource 使用复制的遍历参数遍历源路径中的 root，本地源路径保留符号链接和硬链接信息
+func (c *CopyFiles) iterSource(root string, doFunc paths.DoFunc) error {
+	if c.localSource() {
+		_, err := paths.DoIterPathWithOption(root, doFunc, paths.IterOption{
+			IgnoreErr:     true,
+			FollowSymlink: c.Symlink == SymlinkFollow,
+			Filter:        c.Filter,
+			Context:       c.ctx,
+		})
+		return err
+	}
+	return c.iterStorage(c.source, root, c.Symlink == SymlinkFollow, doFunc)
+}
+
+// iterTarget 遍历目标路径中的 root，不跟随符号链接
+func (c *CopyFiles) iterTarget(root string, doFunc paths.DoFunc) error {
+	if c.localTarget() {
+		_, err := paths.DoIterPathWithOption(root, doFunc, paths.IterOption{
+			IgnoreErr: true,
+			Filter:    c.Filter,
+			Context:   c.ctx,
+		})
+		return err
+	}
+	return c.iterStorage(c.target, root, false, doFunc)
+}
+
+// iterStorage 遍历存储中的 root，交给 doFunc 的 FileInfo.Path 和本地遍历一样是完整路径。
+// 支持符号链接的存储在 followSymlink 时跟随链接，否则链接交给复制的符号链接策略处理
+func (c *CopyFiles) iterStorage(s storage.Storage, root string, followSymlink bool, doFunc paths.DoFunc) error {
+	relPath, err := storage.RelPath(s, root)
+	if err != nil {
+		return err
+	}
+	return storage.WalkWithOption(s, relPath, paths.IterOption{
+		IgnoreErr:     true,
+		FollowSymlink: followSymlink,
+		Filter:        c.Filter,
+		Context:       c.ctx,
+	}, func(fileInfo *paths.FileInfo, walkErr error) error {
+		// 继续遍历时还需要使用存储中的相对路径，不能修改原来的 FileInfo
+		info := *fileInfo
+		info.Path = storage.Location(s, fileInfo.Path)
+		return doFunc(&info, walkErr)
+	})
+}
+
+// readlink 返回源路径中符号链接的内容
+func (c *CopyFiles) readlink(path string) (string, error) {
+	if c.localSource() {
+		return os.Readlink(path)
+	}
+	symlinker, ok := c.source.(storage.Symlinker)
+	if !ok {
+		return "", fmt.Errorf("source %v does not support symlinks", c.source)
+	}
+	relPath, err := storage.RelPath(c.source, path)
+	if err != nil {
+		return "", err
+	}
+	return symlinker.Readlink(relPath)
+}
+
+// statLocation 返回存储中完整路径 path 的信息
+func statLocation(s storage.Storage, path string) (*paths.FileInfo, error) {
+	relPath, err := storage.RelPath(s, path)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := s.Stat(relPath)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo.Path = path
+	return fileInfo, nil
+}
+
+// statSource 返回源路径本身的信息，本地源路径不跟随符号链接
+func (c *CopyFiles) statSource(path string) (*paths.FileInfo, error) {
+	if c.localSource() {
+		return paths.GetFileInfo(path)
+	}
+	return statLocation(c.source, path)
+}
+
+// statTarget 返回目标路径本身的信息，本地目标不跟随符号链接，不存在时返回的错误包含 os.ErrNotExist
+func (c *CopyFiles) statTarget(path string) (*paths.FileInfo, error) {
+	if c.localTarget() {
+		return paths.GetFileInfo(path)
+	}
+	return statLocation(c.target, path)
+}
+
+func (c *CopyFiles) targetExists(path string) bool {
+	_, err := c.statTarget(path)
+	return err == nil
+}
+
+// sourceState 返回判断源文件是否变化的状态，其他存储中只有大小和修改时间
+func (c *CopyFiles) sourceState(path string) (paths.FileState, error) {
+	if c.localSource() {
+		return paths.StatFile(path)
+	}
+	fileInfo, err := statLocation(c.source, path)
+	if err != nil {
+		return paths.FileState{}, errors.Wrapf(err, "get file %v info error", path)
+	}
+	return paths.FileState{Size: fileInfo.Size, ModTime: time.Unix(fileInfo.UpdatedAt, 0)}, nil
+}
+
+func (c *CopyFiles) mkdirTarget(path string) error {
+	relPath, err := storage.RelPath(c.target, path)
+	if err == nil {
+		err = c.target.MkdirAll(relPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "make dir %v error", path)
+	}
+	return nil
+}
+
+// removeTarget 删除目标文件或者整个目录
+func (c *CopyFiles) removeTarget(path string) error {
+	if c.localTarget() {
+		return os.RemoveAll(path)
+	}
+	relPath, err := storage.RelPath(c.target, path)
+	if err != nil {
+		return err
+	}
+	return storage.RemoveAll(c.target, relPath)
+}
+
+// removeSource 删除源文件或者空目录，不存在时不返回错误
+func (c *CopyFiles) removeSource(path string) error {
+	relPath, err := storage.RelPath(c.source, path)
+	if err != nil {
+		return err
+	}
+	if err := c.source.Remove(relPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// renameTarget 在目标存储中移动已有的目标，newPath 已经存在时不覆盖，返回 os.ErrExist。
+// 本地目标原子地检查和移动，其他存储没有不覆盖的移动，只能先检查
+func (c *CopyFiles) renameTarget(oldPath, newPath string) error {
+	if c.localTarget() {
+		return paths.RenameNoReplace(oldPath, newPath)
+	}
+	if c.targetExists(newPath) {
+		return errors.Wrapf(os.ErrExist, "target %v", newPath)
+	}
+	oldRel, err := storage.RelPath(c.target, oldPath)
+	if err != nil {
+		return err
+	}
+	newRel, err := storage.RelPath(c.target, newPath)
+	if err != nil {
+		return err
+	}
+	return storage.Rename(c.target, oldRel, newRel)
+}
+
+// setMetadata 本地复制保留所有元数据，其他存储只能设置权限和修改时间
+func (c *CopyFiles) setMetadata(todoFile *TodoFile, preserve Preserve) error {
+	if c.local() {
+		return applyMetadata(todoFile.FileInfo.Path, todoFile.TargetPath, preserve)
+	}
+	var mode os.FileMode
+	var modTime time.Time
+	if preserve.Mode {
+		mode = todoFile.FileInfo.Mode.Perm()
+	}
+	if preserve.Times {
+		modTime = time.Unix(todoFile.FileInfo.UpdatedAt, 0)
+	}
+	if mode == 0 && modTime.IsZero() {
+		return nil
+	}
+	relPath, err := storage.RelPath(c.target, todoFile.TargetPath)
+	if err == nil {
+		err = c.target.SetMetadata(relPath, mode, modTime)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "set metadata of %v error", todoFile.TargetPath)
+	}
+	return nil
+}
+
+// streamContent 通过存储接口从头复制文件内容，写入的内容提交后才可见，出错时丢弃，开启校验时还返回源文件的哈希。
+// 存储中不能从断点继续写入，journal 只记录完成的文件
+func (c *CopyFiles) streamContent(todoFile *TodoFile, tracker *progress.Tracker) ([]byte, CopyStrategy, error) {
+	sourceRel, err := storage.RelPath(c.source, todoFile.FileInfo.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	targetRel, err := storage.RelPath(c.target, todoFile.TargetPath)
+	if err != nil {
+		return nil, "", err
+	}
+	source, err := c.source.Open(sourceRel)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "open source file error")
+	}
+	defer func() {
+		if err := source.Close(); err != nil {
+			log.Debug(err.Error())
+		}
+	}()
+	target, err := c.target.Create(targetRel)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "create target file %v error", todoFile.TargetPath)
+	}
+	// 对象存储提交后修改时间只能通过复制对象修改，随内容一起上传
+	if writer, ok := target.(storage.ModTimeWriter); ok && c.preserve().Times {
+		writer.SetModTime(time.Unix(todoFile.FileInfo.UpdatedAt, 0))
+	}
+	reader := paths.ContextReader(c.ctx, c.Throttle.Reader(source))
+	var hasher hash.Hash
+	if len(c.Verify) > 0 {
+		if hasher, err = NewHash(c.Verify); err != nil {
+			return nil, "", err
+		}
+		reader = io.TeeReader(reader, hasher)
+	}
+	tracker.Set(0)
+	err = bufferedCopy(c.Throttle.Writer(target), tracker.Reader(reader), 0, func(int64) error {
+		return c.ctx.Err()
+	})
+	if err != nil {
+		if abortErr := target.Abort(); abortErr != nil {
+			log.Debug("abort target file %v error: %v", todoFile.TargetPath, abortErr)
+		}
+		return nil, "", err
+	}
+	if err := target.Commit(); err != nil {
+		return nil, "", errors.Wrapf(err, "commit target file %v error", todoFile.TargetPath)
+	}
+	if hasher == nil {
+		return nil, StrategyStream, nil
+	}
+	return hasher.Sum(nil), StrategyStream, nil
+}
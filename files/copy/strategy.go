@@ -0,0 +1,65 @@
+package copy
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/progress"
+	"io"
+	"os"
+	"sync"
+)
+
+type CopyStrategy string
+
+const (
+	StrategyCopyFileRange CopyStrategy = "copy_file_range" // 内核中直接复制，不经过用户态
+	StrategyReflink       CopyStrategy = "reflink"         // 写时复制文件系统上共享数据块
+	StrategySparse        CopyStrategy = "sparse"          // 只复制数据段，保留稀疏文件中的空洞
+	StrategyBuffered      CopyStrategy = "buffered"        // 通过用户态缓冲区读写
+)
+
+const copyBufferSize = 1024 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+// commitFunc 前 offset 字节已经复制完成
+type commitFunc func(offset int64) error
+
+// noCommit 分块复制时每个块完成后单独提交，复制过程中不提交
+func noCommit(offset int64) error {
+	return nil
+}
+
+// bufferedCopy 从 reader 当前位置复制到 writer 当前位置，每复制 journalCommitSize 提交一次
+func bufferedCopy(writer io.Writer, reader io.Reader, offset int64, commit commitFunc) error {
+	buffer := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buffer)
+	// 屏蔽 ReaderFrom/WriterTo，保证确实经过用户态缓冲区，统计的策略才准确
+	writer = struct{ io.Writer }{writer}
+	for {
+		written, err := io.CopyBuffer(writer, io.LimitReader(reader, journalCommitSize), *buffer)
+		if err != nil {
+			return errors.Wrap(err, "copy file error")
+		}
+		offset += written
+		if written < journalCommitSize {
+			return nil
+		}
+		if err := commit(offset); err != nil {
+			return err
+		}
+	}
+}
+
+// bufferedRange 通过用户态缓冲区复制 [start, start+length) 范围，tracker 不为空时读取时更新进度
+func bufferedRange(destination, source *os.File, start, length int64, commit commitFunc, tracker *progress.Tracker) error {
+	var reader io.Reader = io.NewSectionReader(source, start, length)
+	if tracker != nil {
+		reader = tracker.Reader(reader)
+	}
+	return bufferedCopy(io.NewOffsetWriter(destination, start), reader, start, commit)
+}
@@ -0,0 +1,189 @@
+package copy
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/progress"
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+// kernelCopy 从头复制时先尝试 FICLONE，再依次尝试稀疏复制和 copy_file_range，都不支持时返回 StrategyBuffered，由调用方用缓冲区复制
+func kernelCopy(destination, source *os.File, offset int64, commit commitFunc, tracker *progress.Tracker) (CopyStrategy, error) {
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		return "", errors.Wrap(err, "get source file info error")
+	}
+	// 共享数据块不需要复制内容，也保留了空洞，只能克隆整个文件
+	if offset == 0 {
+		err = reflink(destination, source)
+		if err == nil {
+			return StrategyReflink, nil
+		}
+		if !isUnsupported(err) {
+			return StrategyReflink, errors.Wrap(err, "reflink error")
+		}
+	}
+	if isSparse(sourceInfo) {
+		return StrategySparse, sparseCopy(destination, source, offset, sourceInfo.Size(), commit, tracker)
+	}
+	copied, err := copyFileRange(destination, source, offset, sourceInfo.Size()-offset, commit, tracker)
+	if err == nil {
+		return StrategyCopyFileRange, nil
+	}
+	if copied > 0 || !isUnsupported(err) {
+		return StrategyCopyFileRange, errors.Wrap(err, "copy_file_range error")
+	}
+	return StrategyBuffered, nil
+}
+
+// copyFileRangeSize 每次 copy_file_range 复制的最大字节数，每次调用后更新进度
+const copyFileRangeSize = 16 * 1024 * 1024
+
+// errNoProgress 还有数据没有复制时 copy_file_range 第一次调用就返回 0，一些 FUSE 和 proc 类文件系统不会真正复制，
+// 和标准库一样当作不支持，改用缓冲区复制
+var errNoProgress = errors.New("copy_file_range copied nothing")
+
+// copyFileRange 复制 [offset, offset+length) 范围，返回复制的字节数。tracker 不为空时每次调用后更新进度
+func copyFileRange(destination, source *os.File, offset, length int64, commit commitFunc, tracker *progress.Tracker) (int64, error) {
+	sourceOffset, targetOffset := offset, offset
+	committed := offset
+	var copied int64
+	for copied < length {
+		size := copyFileRangeSize
+		if length-copied < int64(size) {
+			size = int(length - copied)
+		}
+		written, err := unix.CopyFileRange(int(source.Fd()), &sourceOffset, int(destination.Fd()), &targetOffset, size, 0)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return copied, err
+		}
+		if written == 0 {
+			if copied == 0 {
+				return 0, errNoProgress
+			}
+			// 复制过程中源文件变短，由修改检测处理
+			break
+		}
+		copied += int64(written)
+		if tracker != nil {
+			tracker.Add(int64(written))
+		}
+		if targetOffset-committed >= journalCommitSize {
+			if err := commit(targetOffset); err != nil {
+				return copied, err
+			}
+			committed = targetOffset
+		}
+	}
+	return copied, nil
+}
+
+// sparseCopy 通过 SEEK_DATA/SEEK_HOLE 只复制数据段，最后截断到源文件大小保留末尾的空洞
+func sparseCopy(destination, source *os.File, offset, size int64, commit commitFunc, tracker *progress.Tracker) error {
+	if err := sparseRange(destination, source, offset, size, commit, tracker); err != nil {
+		return err
+	}
+	if err := destination.Truncate(size); err != nil {
+		return errors.Wrap(err, "truncate target file error")
+	}
+	return nil
+}
+
+// sparseRange 只复制 [offset, end) 中的数据段，空洞部分不写入
+func sparseRange(destination, source *os.File, offset, end int64, commit commitFunc, tracker *progress.Tracker) error {
+	fd := int(source.Fd())
+	for offset < end {
+		dataStart, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err != nil {
+			if err == unix.ENXIO { // offset 之后只有空洞
+				break
+			}
+			return errors.Wrap(err, "seek data error")
+		}
+		if dataStart >= end {
+			break
+		}
+		holeStart, err := unix.Seek(fd, dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return errors.Wrap(err, "seek hole error")
+		}
+		if holeStart > end {
+			holeStart = end
+		}
+		if err := copyRange(destination, source, dataStart, holeStart-dataStart, commit, tracker); err != nil {
+			return err
+		}
+		offset = holeStart
+	}
+	return nil
+}
+
+// copyRange 复制 [start, start+length) 范围，优先使用 copy_file_range
+func copyRange(destination, source *os.File, start, length int64, commit commitFunc, tracker *progress.Tracker) error {
+	copied, err := copyFileRange(destination, source, start, length, commit, tracker)
+	if err == nil {
+		return nil
+	}
+	if copied > 0 || !isUnsupported(err) {
+		return errors.Wrap(err, "copy_file_range error")
+	}
+	return bufferedRange(destination, source, start, length, commit, tracker)
+}
+
+// chunkRange 分块复制时复制一个块，稀疏文件只复制块中的数据段。
+// resume 时目标中这个块可能有上次写了一半的内容，先把整个块清空，空洞部分才是 0
+func chunkRange(destination, source *os.File, start, length int64, sparse bool) error {
+	if sparse {
+		if err := clearRange(destination, start, length); err != nil {
+			return err
+		}
+		return sparseRange(destination, source, start, start+length, noCommit, nil)
+	}
+	return copyRange(destination, source, start, length, noCommit, nil)
+}
+
+// clearRange 在目标文件中打洞清空 [start, start+length)，文件系统不支持打洞时写入 0
+func clearRange(destination *os.File, start, length int64) error {
+	err := unix.Fallocate(int(destination.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, start, length)
+	if err == nil {
+		return nil
+	}
+	if !isUnsupported(err) {
+		return errors.Wrapf(err, "punch hole in target file %v error", destination.Name())
+	}
+	zero := make([]byte, copyBufferSize)
+	for written := int64(0); written < length; {
+		size := int64(len(zero))
+		if length-written < size {
+			size = length - written
+		}
+		if _, err := destination.WriteAt(zero[:size], start+written); err != nil {
+			return errors.Wrapf(err, "zero target file %v error", destination.Name())
+		}
+		written += size
+	}
+	return nil
+}
+
+// reflink 通过 FICLONE 让 destination 和 source 共享数据块
+func reflink(destination, source *os.File) error {
+	return unix.IoctlFileClone(int(destination.Fd()), int(source.Fd()))
+}
+
+func isSparse(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Blocks*512 < stat.Size
+}
+
+// isUnsupported 文件系统或者内核不支持对应的复制方式
+func isUnsupported(err error) bool {
+	switch err {
+	case errNoProgress, unix.ENOSYS, unix.EXDEV, unix.EINVAL, unix.EOPNOTSUPP, unix.ENOTTY, unix.EBADF, unix.EPERM, unix.ETXTBSY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package copy
+
+import (
+	"errors"
+	"go_tools/progress"
+	"os"
+)
+
+// 其他平台没有内核复制接口，统一使用缓冲区复制
+func kernelCopy(destination, source *os.File, offset int64, commit commitFunc, tracker *progress.Tracker) (CopyStrategy, error) {
+	return StrategyBuffered, nil
+}
+
+func chunkRange(destination, source *os.File, start, length int64, sparse bool) error {
+	return bufferedRange(destination, source, start, length, noCommit, nil)
+}
+
+func reflink(destination, source *os.File) error {
+	return errors.New("reflink is not supported on this platform")
+}
+
+func isSparse(info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,97 @@
+package copy
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"os"
+)
+
+// needCopy 同步模式下判断目标文件是否需要更新：大小、修改时间不同（开启 Checksum 时还要比较内容）
+func (c *CopyFiles) needCopy(todoFile *TodoFile) (bool, error) {
+	targetInfo, err := c.statTarget(todoFile.TargetPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return true, nil
+		}
+		return false, errors.Wrapf(err, "get target file %v info error", todoFile.TargetPath)
+	}
+	if !targetInfo.Mode.IsRegular() ||
+		targetInfo.Size != todoFile.FileInfo.Size ||
+		targetInfo.UpdatedAt != todoFile.FileInfo.UpdatedAt {
+		return true, nil
+	}
+	if !c.Checksum {
+		return false, nil
+	}
+	algorithm := c.Verify
+	if len(algorithm) == 0 {
+		algorithm = HashXXHash
+	}
+	sourceSum, err := checksum(c.source, todoFile.FileInfo.Path, algorithm)
+	if err != nil {
+		return false, err
+	}
+	targetSum, err := checksum(c.target, todoFile.TargetPath, algorithm)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(sourceSum, targetSum), nil
+}
+
+// findExtraneous 返回目标路径中源路径已经不存在的文件和目录
+func (c *CopyFiles) findExtraneous(targetPath string) ([]string, error) {
+	if _, err := c.statTarget(targetPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "get target path %v info error", targetPath)
+	}
+	var extraneous []string
+	var walkErr error
+	// 使用相同的过滤规则，被排除的目标文件不会删除
+	err := c.iterTarget(targetPath, func(fileInfo *paths.FileInfo, iterErr error) error {
+		if iterErr != nil {
+			if walkErr == nil {
+				walkErr = iterErr
+			}
+			return nil
+		}
+		if _, ok := c.sourceTargets[fileInfo.Path]; !ok {
+			extraneous = append(extraneous, fileInfo.Path)
+		}
+		return nil
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "iter target path %v error", targetPath)
+	}
+	return extraneous, nil
+}
+
+// deleteExtraneous 镜像模式下删除目标路径中源路径已经不存在的文件和目录
+func (c *CopyFiles) deleteExtraneous(targetPath string) error {
+	extraneous, err := c.findExtraneous(targetPath)
+	if err != nil {
+		return err
+	}
+	var removedDir string
+	for _, path := range extraneous {
+		// 父目录已经整体删除
+		if len(removedDir) > 0 && isUnder(path, removedDir) {
+			c.addDelete(path)
+			continue
+		}
+		if err := c.removeTarget(path); err != nil {
+			c.addFailItem(path, errors.Wrap(err, "delete extraneous target error"))
+			continue
+		}
+		log.Debug("delete extraneous target %v", path)
+		removedDir = path
+		c.addDelete(path)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package copy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
+	"go_tools/log"
+	"go_tools/storage"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+type HashAlgorithm string
+
+const (
+	HashCRC32C HashAlgorithm = "crc32c"
+	HashSHA256 HashAlgorithm = "sha256"
+	HashBLAKE3 HashAlgorithm = "blake3"
+	HashXXHash HashAlgorithm = "xxhash"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func NewHash(algorithm HashAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case HashCRC32C:
+		return crc32.New(crc32cTable), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(), nil
+	case HashXXHash:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm: %v", algorithm)
+	}
+}
+
+func fileChecksum(path string, algorithm HashAlgorithm) ([]byte, error) {
+	hasher, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file %v error", path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close file %v error: %v", path, err)
+		}
+	}()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, errors.Wrapf(err, "read file %v error", path)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// checksum 计算存储中完整路径 path 的文件的哈希，本地文件直接读取
+func checksum(s storage.Storage, path string, algorithm HashAlgorithm) ([]byte, error) {
+	if _, ok := s.(*storage.Local); ok {
+		return fileChecksum(path, algorithm)
+	}
+	hasher, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	relPath, err := storage.RelPath(s, path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.Open(relPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file %v error", path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close file %v error: %v", path, err)
+		}
+	}()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, errors.Wrapf(err, "read file %v error", path)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// verifyTarget 重新读取目标文件计算哈希，和复制时计算的源文件哈希比较
+func (c *CopyFiles) verifyTarget(todoFile *TodoFile, sourceSum []byte) error {
+	targetSum, err := checksum(c.target, todoFile.TargetPath, c.Verify)
+	if err != nil {
+		return errors.Wrap(err, "verify target file error")
+	}
+	if !bytes.Equal(sourceSum, targetSum) {
+		return fmt.Errorf("verify target file %v error: %v mismatch, source %v, target %v",
+			todoFile.TargetPath, c.Verify, hex.EncodeToString(sourceSum), hex.EncodeToString(targetSum))
+	}
+	return nil
+}
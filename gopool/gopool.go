@@ -34,6 +34,17 @@ func (p *Pool) Add(delta int) {
 	p.wg.Add(delta)
 }
 
+// TryAdd 有空闲位置时占用一个并返回 true，没有时立即返回 false
+func (p *Pool) TryAdd() bool {
+	select {
+	case p.queue <- 1:
+		p.wg.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
 // Done 执行完成减一
 func (p *Pool) Done() {
 	<-p.queue
@@ -0,0 +1,57 @@
+package paths
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+)
+
+const tempSuffix = ".co_tmp"
+
+// TempPath 返回和 path 在同一目录下的隐藏临时文件路径，写完后再 rename 到 path，中断时不会留下看起来完整的半个文件
+func TempPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+tempSuffix)
+}
+
+// CommitFile 把写完的临时文件 rename 到最终路径，durable 为 true 时 rename 前后分别把文件和所在目录落盘
+func CommitFile(tempPath, path string, durable bool) error {
+	if durable {
+		if err := SyncFile(tempPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return errors.Wrapf(err, "rename %v to %v error", tempPath, path)
+	}
+	if durable {
+		return SyncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// RenameNoReplace 把 oldPath 移动到 newPath，newPath 已经存在时不覆盖，返回的错误满足 errors.Is(err, os.ErrExist)
+func RenameNoReplace(oldPath, newPath string) error {
+	if err := renameNoReplace(oldPath, newPath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// linkNoReplace 不支持原子不覆盖 rename 时的做法：文件先创建硬链接再删除原来的名字，link 在目标存在时失败；
+// 目录和不支持硬链接的文件系统只能先检查再 rename，检查和 rename 之间仍然可能被其他进程抢先
+func linkNoReplace(oldPath, newPath string) error {
+	linkErr := os.Link(oldPath, newPath)
+	if linkErr == nil {
+		return os.Remove(oldPath)
+	}
+	if errors.Is(linkErr, os.ErrExist) {
+		return os.ErrExist
+	}
+	if _, err := os.Lstat(newPath); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
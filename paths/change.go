@@ -0,0 +1,72 @@
+package paths
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// ChangePolicy 读取过程中源文件被修改时的处理策略
+type ChangePolicy string
+
+const (
+	ChangeWarn  ChangePolicy = "warn"  // 输出警告并在结果中标记，保留读取到的内容
+	ChangeRetry ChangePolicy = "retry" // 重新读取，多次读取都在变化时按 fail 处理
+	ChangeFail  ChangePolicy = "fail"  // 记录为失败
+)
+
+// ErrFileChanged 文件在读取过程中被修改，读取到的内容可能不一致
+var ErrFileChanged = errors.New("file changed while reading")
+
+func CheckChangePolicy(policy ChangePolicy) error {
+	switch policy {
+	case ChangeWarn, ChangeRetry, ChangeFail:
+		return nil
+	default:
+		return fmt.Errorf("unknown change policy: %v", policy)
+	}
+}
+
+// FileState 读取文件前后比较的状态，写入内容会改变大小和修改时间，修改时间被改回时 ctime 仍然会变化
+type FileState struct {
+	Size       int64
+	ModTime    time.Time
+	ChangeTime time.Time // 不支持的平台和存储上为零值
+}
+
+func NewFileState(info os.FileInfo) FileState {
+	return FileState{
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		ChangeTime: changeTime(info),
+	}
+}
+
+// StatFile 返回跟随符号链接后 path 的状态
+func StatFile(path string) (FileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileState{}, errors.Wrapf(err, "get file %v info error", path)
+	}
+	return NewFileState(info), nil
+}
+
+// Compare 返回 after 和读取前相比变化的地方，没有变化时返回 nil，返回的错误可以用 ErrFileChanged 判断
+func (s FileState) Compare(after FileState) error {
+	var changes []string
+	if s.Size != after.Size {
+		changes = append(changes, fmt.Sprintf("size %v -> %v", s.Size, after.Size))
+	}
+	if !s.ModTime.Equal(after.ModTime) {
+		changes = append(changes, fmt.Sprintf("mtime %v -> %v", s.ModTime.Format(time.RFC3339Nano), after.ModTime.Format(time.RFC3339Nano)))
+	}
+	if !s.ChangeTime.Equal(after.ChangeTime) {
+		changes = append(changes, fmt.Sprintf("ctime %v -> %v", s.ChangeTime.Format(time.RFC3339Nano), after.ChangeTime.Format(time.RFC3339Nano)))
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return errors.Wrap(ErrFileChanged, strings.Join(changes, ", "))
+}
@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package paths
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func changeTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(stat.Ctimespec.Sec), int64(stat.Ctimespec.Nsec))
+}
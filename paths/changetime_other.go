@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package paths
+
+import (
+	"os"
+	"time"
+)
+
+// 这些平台的 os.FileInfo 不包含 ctime，只比较大小和修改时间
+func changeTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
@@ -0,0 +1,23 @@
+package paths
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReader 返回 ctx 取消后读取时返回取消原因的 Reader，用于中断正在处理的大文件
+func ContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, reader: reader}
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
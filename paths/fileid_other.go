@@ -0,0 +1,10 @@
+//go:build windows || plan9 || js || wasip1
+
+package paths
+
+import "os"
+
+// 这些平台的 os.FileInfo 不包含 inode 和链接数，不识别硬链接
+func fileId(info os.FileInfo) (dev, inode, links uint64) {
+	return 0, 0, 0
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !plan9 && !js && !wasip1
+
+package paths
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileId(info os.FileInfo) (dev, inode, links uint64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), uint64(stat.Nlink)
+}
@@ -0,0 +1,285 @@
+package paths
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Filter 遍历时的过滤规则。Excludes 和忽略文件使用 .gitignore 语法，后出现的规则优先，"!" 开头表示重新包含；
+// 被排除的目录不会读取子文件。Includes、大小和修改时间条件只作用于文件，目录总是会继续遍历
+type Filter struct {
+	Includes    []string  `json:"includes"`
+	Excludes    []string  `json:"excludes"`
+	IgnoreFiles []string  `json:"ignore_files"` // 每个目录中按 .gitignore 语法读取的忽略文件名，例如 .gitignore
+	MinSize     int64     `json:"min_size"`     // 为 0 时不限制
+	MaxSize     int64     `json:"max_size"`     // 为 0 时不限制
+	NewerThan   time.Time `json:"newer_than"`   // 只保留修改时间晚于这个时间的文件，零值时不限制
+	OlderThan   time.Time `json:"older_than"`   // 只保留修改时间早于这个时间的文件，零值时不限制
+	includes    []filterRule
+	excludes    []filterRule
+}
+
+type filterRule struct {
+	base    string // 规则所在目录相对遍历根目录的路径，命令行规则为空
+	negate  bool
+	dirOnly bool
+	regexp  *regexp.Regexp
+}
+
+func NewFilter(includes, excludes []string) (*Filter, error) {
+	filter := &Filter{}
+	for _, pattern := range includes {
+		rule, ok, err := compileRule(pattern, "")
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			filter.Includes = append(filter.Includes, pattern)
+			filter.includes = append(filter.includes, rule)
+		}
+	}
+	for _, pattern := range excludes {
+		if err := filter.addExclude(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func (f *Filter) addExclude(pattern string) error {
+	rule, ok, err := compileRule(pattern, "")
+	if err != nil {
+		return err
+	}
+	if ok {
+		f.Excludes = append(f.Excludes, pattern)
+		f.excludes = append(f.excludes, rule)
+	}
+	return nil
+}
+
+// AddExcludeFrom 从文件中按 .gitignore 语法读取排除规则
+func (f *Filter) AddExcludeFrom(path string) error {
+	patterns, err := readPatterns(path)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range patterns {
+		if err := f.addExclude(pattern); err != nil {
+			return errors.Wrapf(err, "parse %v error", path)
+		}
+	}
+	return nil
+}
+
+// Match relPath 是相对遍历根目录、以 / 分隔的路径，返回 false 表示需要跳过
+func (f *Filter) Match(relPath string, isDir bool, size int64, updatedAt time.Time) bool {
+	return f.match(f.excludes, relPath, isDir, size, updatedAt)
+}
+
+func (f *Filter) match(excludes []filterRule, relPath string, isDir bool, size int64, updatedAt time.Time) bool {
+	excluded := false
+	for i := range excludes {
+		if excludes[i].matches(relPath, isDir) {
+			excluded = !excludes[i].negate
+		}
+	}
+	if excluded {
+		return false
+	}
+	if isDir {
+		return true
+	}
+	if len(f.includes) > 0 {
+		included := false
+		for i := range f.includes {
+			if f.includes[i].matches(relPath, isDir) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	if f.MinSize > 0 && size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return false
+	}
+	if !f.NewerThan.IsZero() && !updatedAt.After(f.NewerThan) {
+		return false
+	}
+	if !f.OlderThan.IsZero() && !updatedAt.Before(f.OlderThan) {
+		return false
+	}
+	return true
+}
+
+// dirRules 读取目录中的忽略文件，返回追加了这些规则的新规则列表，read 读取目录中指定名称的忽略文件
+func (f *Filter) dirRules(rules []filterRule, relDir string, read func(name string) ([]string, error)) []filterRule {
+	result := rules
+	for _, name := range f.IgnoreFiles {
+		patterns, err := read(name)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Warn("read ignore file error: %v", err)
+			}
+			continue
+		}
+		for _, pattern := range patterns {
+			rule, ok, err := compileRule(pattern, relDir)
+			if err != nil {
+				log.Warn("parse ignore file %v error: %v", path.Join(relDir, name), err)
+				continue
+			}
+			if ok {
+				// 复制一份，避免修改父目录的规则列表
+				result = append(result[:len(result):len(result)], rule)
+			}
+		}
+	}
+	return result
+}
+
+func (r *filterRule) matches(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if len(r.base) > 0 {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return false
+		}
+		relPath = relPath[len(r.base)+1:]
+	}
+	return r.regexp.MatchString(relPath)
+}
+
+func readPatterns(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open ignore file %v error", path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close file %v error: %v", path, err)
+		}
+	}()
+	return scanPatterns(file, path)
+}
+
+// readFSPatterns 读取 fsys 中的规则文件
+func readFSPatterns(fsys fs.FS, name string) ([]string, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open ignore file %v error", name)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close file %v error: %v", name, err)
+		}
+	}()
+	return scanPatterns(file, name)
+}
+
+func scanPatterns(reader io.Reader, path string) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read ignore file %v error", path)
+	}
+	return patterns, nil
+}
+
+// compileRule 把 .gitignore 语法的规则转换成正则，空行和注释返回 false
+func compileRule(pattern, base string) (filterRule, bool, error) {
+	rule := filterRule{base: base}
+	pattern = strings.TrimRight(pattern, " \r")
+	if len(pattern) == 0 || strings.HasPrefix(pattern, "#") {
+		return rule, false, nil
+	}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if len(pattern) == 0 {
+		return rule, false, nil
+	}
+	// 包含 / 的规则相对所在目录匹配，否则匹配任意层级的文件名
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	expr := globToRegexp(pattern)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "(^|/)" + expr + "$"
+	}
+	compiled, err := regexp.Compile(expr)
+	if err != nil {
+		return rule, false, errors.Wrapf(err, "invalid pattern %q", pattern)
+	}
+	rule.regexp = compiled
+	return rule, true, nil
+}
+
+func globToRegexp(pattern string) string {
+	var builder strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		char := pattern[i]
+		switch char {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// **/ 匹配零个或多个目录
+					i++
+					builder.WriteString("(.*/)?")
+				} else {
+					builder.WriteString(".*")
+				}
+			} else {
+				builder.WriteString("[^/]*")
+			}
+		case '?':
+			builder.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				builder.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			builder.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				builder.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	return builder.String()
+}
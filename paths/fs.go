@@ -0,0 +1,160 @@
+package paths
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// RealPathFS 可以解析出跟随所有符号链接后的路径的 fs.FS，DoIterFS 跟随符号链接时用来发现指向祖先目录的循环
+type RealPathFS interface {
+	fs.FS
+	RealPath(name string) (string, error)
+}
+
+// DoIterFS 按照 DoIterPathWithOption 的规则遍历 fsys 中的 root，root 为 "." 时遍历整个 fsys，FileInfo.Path 是 fsys 中以 / 分隔的路径。
+// ReadDir 返回的符号链接在 FollowSymlink 时跟随，指向祖先目录的链接通过文件标识或者 RealPathFS 发现，忽略文件从 fsys 中读取。
+// doFunc 返回错误时停止遍历并返回这个错误，IgnoreErr 时列目录的错误交给 doFunc 处理后继续遍历
+func DoIterFS(fsys fs.FS, root string, doFunc DoFunc, option IterOption) (*FileInfo, error) {
+	rootInfo, err := fs.Stat(fsys, root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get path %v info error", root)
+	}
+	result := newFSFileInfo(root, rootInfo, nil)
+	if doFunc == nil {
+		doFunc = func(fileInfo *FileInfo, iterErr error) error {
+			return nil
+		}
+	}
+	if err := doFunc(result, nil); err != nil {
+		return nil, err
+	}
+	if rootInfo.IsDir() {
+		var rules []filterRule
+		if option.Filter != nil {
+			rules = option.Filter.dirRules(option.Filter.excludes, "", fsPatterns(fsys, root))
+		}
+		if err := walkFS(fsys, result, "", doFunc, option, rules, []fsAncestor{{path: root, info: rootInfo}}); err != nil {
+			return result, err
+		}
+	}
+	if canceled(option) {
+		return result, option.Context.Err()
+	}
+	return result, nil
+}
+
+// fsAncestor 当前路径上的一个祖先目录
+type fsAncestor struct {
+	path string
+	info fs.FileInfo
+}
+
+// walkFS 遍历目录 parent 中的子路径，relDir 是 parent 相对遍历根目录的路径，ancestors 是包括 parent 在内的所有祖先目录
+func walkFS(fsys fs.FS, parent *FileInfo, relDir string, doFunc DoFunc, option IterOption, rules []filterRule, ancestors []fsAncestor) error {
+	entries, err := fs.ReadDir(fsys, parent.Path)
+	if err != nil {
+		err = errors.Wrapf(err, "list %v sub files error", parent.Path)
+		if !option.IgnoreErr {
+			return err
+		}
+		return doFunc(parent, err)
+	}
+	for _, entry := range entries {
+		if canceled(option) {
+			return nil
+		}
+		childPath := path.Join(parent.Path, entry.Name())
+		relPath := path.Join(relDir, entry.Name())
+		info, err := entry.Info()
+		followed := false
+		if err == nil && option.FollowSymlink && info.Mode()&fs.ModeSymlink != 0 {
+			info, err = fs.Stat(fsys, childPath)
+			followed = true
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "get file %v info error", childPath)
+			if !option.IgnoreErr {
+				return err
+			}
+			if err := doFunc(&FileInfo{Path: childPath}, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if option.Filter != nil && !option.Filter.match(rules, relPath, info.IsDir(), info.Size(), info.ModTime()) {
+			continue
+		}
+		result := newFSFileInfo(childPath, info, parent)
+		if followed && info.IsDir() && fsLoop(fsys, childPath, info, ancestors) {
+			if err := doFunc(result, fmt.Errorf("symlink loop detected: %v links to its ancestor directory", childPath)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := doFunc(result, nil); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			subRules := rules
+			if option.Filter != nil {
+				subRules = option.Filter.dirRules(rules, relPath, fsPatterns(fsys, childPath))
+			}
+			subAncestors := append(ancestors[:len(ancestors):len(ancestors)], fsAncestor{path: childPath, info: info})
+			if err := walkFS(fsys, result, relPath, doFunc, option, subRules, subAncestors); err != nil {
+				return err
+			}
+		}
+		if option.IncludeItems {
+			parent.Includes[info.Name()] = result
+		}
+	}
+	return nil
+}
+
+// fsLoop 跟随符号链接得到的目录 path 是不是某个祖先目录。本地文件比较文件标识，
+// 其他 fs.FS 没有文件标识，比较解析链接后的路径
+func fsLoop(fsys fs.FS, path string, info fs.FileInfo, ancestors []fsAncestor) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor.info, info) {
+			return true
+		}
+	}
+	realFS, ok := fsys.(RealPathFS)
+	if !ok {
+		return false
+	}
+	realPath, err := realFS.RealPath(path)
+	if err != nil {
+		return false
+	}
+	for _, ancestor := range ancestors {
+		if ancestorPath, err := realFS.RealPath(ancestor.path); err == nil && ancestorPath == realPath {
+			return true
+		}
+	}
+	return false
+}
+
+// fsPatterns 读取 fsys 中目录 dir 的忽略文件
+func fsPatterns(fsys fs.FS, dir string) func(name string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		return readFSPatterns(fsys, path.Join(dir, name))
+	}
+}
+
+func newFSFileInfo(path string, fileInfo fs.FileInfo, parent *FileInfo) *FileInfo {
+	return &FileInfo{
+		Name:      fileInfo.Name(),
+		Path:      path,
+		Size:      fileInfo.Size(),
+		IsDir:     fileInfo.IsDir(),
+		IsSymlink: fileInfo.Mode()&fs.ModeSymlink != 0,
+		Mode:      fileInfo.Mode(),
+		UpdatedAt: fileInfo.ModTime().Unix(),
+		Parent:    parent,
+		Includes:  map[string]*FileInfo{},
+	}
+}
@@ -1,13 +1,33 @@
 package paths
 
+import (
+	"context"
+	"os"
+)
+
 type FileInfo struct {
 	Name      string               `json:"name"`
 	Path      string               `json:"path"`
 	Size      int64                `json:"size"`
 	IsDir     bool                 `json:"is_dir"`
+	IsSymlink bool                 `json:"is_symlink"` // 没有跟随的符号链接本身
+	Mode      os.FileMode          `json:"mode"`
 	UpdatedAt int64                `json:"updated_at"`
+	Dev       uint64               `json:"dev,omitempty"`   // 文件所在设备，和 Inode 一起识别硬链接
+	Inode     uint64               `json:"inode,omitempty"` // 不支持的平台上为 0
+	Links     uint64               `json:"links,omitempty"` // 硬链接数量
 	Parent    *FileInfo            `json:"-"`
 	Includes  map[string]*FileInfo `json:"includes"`
 }
 
 type DoFunc func(fileInfo *FileInfo, iterErr error) error
+
+// IterOption 遍历参数
+type IterOption struct {
+	IncludeItems  bool    `json:"include_items"`  // 结果中保存子文件树
+	IgnoreErr     bool    `json:"ignore_err"`     // 遍历出错时交给 DoFunc 处理后继续遍历
+	FollowSymlink bool    `json:"follow_symlink"` // 跟随符号链接，指向祖先目录的链接会作为循环错误交给 DoFunc
+	Filter        *Filter `json:"filter"`         // 被过滤的文件不会交给 DoFunc，被排除的目录不会读取子文件
+	// 取消后不再遍历新的路径，DoIterPathWithOption 返回取消的原因
+	Context context.Context `json:"-"`
+}
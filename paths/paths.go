@@ -7,52 +7,83 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 )
 
 func DoIterPath(path string, doFunc DoFunc, includeItems, ignoreErr bool) (result *FileInfo, err error) {
+	return DoIterPathWithOption(path, doFunc, IterOption{
+		IncludeItems: includeItems,
+		IgnoreErr:    ignoreErr,
+	})
+}
+
+func DoIterPathWithOption(path string, doFunc DoFunc, option IterOption) (result *FileInfo, err error) {
 	path, err = filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := os.Stat(path); err != nil {
-		return nil, errors.Wrapf(err, "get path %v info error", path)
-	}
-	fileInfo, err := os.Lstat(path)
+	rootInfo, err := os.Stat(path)
 	if err != nil {
-		return nil, errors.Wrapf(err, "get file %v info error", path)
+		return nil, errors.Wrapf(err, "get path %v info error", path)
 	}
-	result = &FileInfo{
-		Name:      fileInfo.Name(),
-		Path:      path,
-		Size:      fileInfo.Size(),
-		IsDir:     fileInfo.IsDir(),
-		UpdatedAt: fileInfo.ModTime().Unix(),
-		Parent:    nil,
-		Includes:  map[string]*FileInfo{},
+	fileInfo := rootInfo
+	if !option.FollowSymlink {
+		fileInfo, err = os.Lstat(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get file %v info error", path)
+		}
 	}
+	result = newFileInfo(path, fileInfo, nil)
 
-	if doFunc != nil {
-		if err = doFunc(result, nil); err != nil {
-			return nil, err
+	if doFunc == nil {
+		doFunc = func(fileInfo *FileInfo, iterErr error) error {
+			return nil
 		}
 	}
+	if err = doFunc(result, nil); err != nil {
+		return nil, err
+	}
 	if fileInfo.IsDir() {
 		files, err := readDirNames(path)
 		if err != nil {
 			return nil, errors.Wrap(err, "list sub files error")
 		}
 		if len(files) > 0 {
+			state := walkState{
+				root:      path,
+				ancestors: []os.FileInfo{fileInfo},
+			}
+			if option.Filter != nil {
+				state.rules = option.Filter.dirRules(option.Filter.excludes, "", localPatterns(path))
+			}
 			for i := range files {
-				walk(result, fmt.Sprintf("%v/%v", path, files[i]), 1, doFunc, includeItems, ignoreErr)
+				walk(result, fmt.Sprintf("%v/%v", path, files[i]), 1, doFunc, option, state)
 			}
 		}
 	}
+	if canceled(option) {
+		return result, option.Context.Err()
+	}
 	return result, nil
 }
 
-func walk(parent *FileInfo, path string, depth int, doFunc DoFunc, includeItems, ignoreErr bool) {
+func canceled(option IterOption) bool {
+	return option.Context != nil && option.Context.Err() != nil
+}
+
+// walkState 遍历到当前路径时的状态
+type walkState struct {
+	root      string
+	ancestors []os.FileInfo // 当前路径上所有祖先目录的信息，跟随符号链接时用来发现循环
+	rules     []filterRule  // 命令行排除规则加上各级祖先目录忽略文件中的规则
+}
+
+func walk(parent *FileInfo, path string, depth int, doFunc DoFunc, option IterOption, state walkState) {
+	if canceled(option) {
+		return
+	}
 	defer func() {
-		if ignoreErr {
+		if option.IgnoreErr {
 			if err := recover(); err != nil {
 				_ = doFunc(parent, fmt.Errorf("iter path %v error: %v", path, err))
 				//log.Warn("iter path %v error: %v", path, err)
@@ -60,6 +91,9 @@ func walk(parent *FileInfo, path string, depth int, doFunc DoFunc, includeItems,
 		}
 	}()
 	fileInfo, err := os.Lstat(path)
+	if err == nil && option.FollowSymlink && fileInfo.Mode()&os.ModeSymlink != 0 {
+		fileInfo, err = os.Stat(path)
+	}
 	if err != nil {
 		if err := doFunc(&FileInfo{
 			Path: path,
@@ -67,36 +101,78 @@ func walk(parent *FileInfo, path string, depth int, doFunc DoFunc, includeItems,
 			panic(err)
 		}
 	} else {
-		var result = FileInfo{
-			Name:      fileInfo.Name(),
-			Path:      path,
-			Size:      fileInfo.Size(),
-			IsDir:     fileInfo.IsDir(),
-			UpdatedAt: fileInfo.ModTime().Unix(),
-			Parent:    parent,
-			Includes:  map[string]*FileInfo{},
+		var relPath string
+		if option.Filter != nil {
+			relPath = filepath.ToSlash(strings.TrimPrefix(path, state.root+"/"))
+			if !option.Filter.match(state.rules, relPath, fileInfo.IsDir(), fileInfo.Size(), fileInfo.ModTime()) {
+				return
+			}
 		}
-		if err = doFunc(&result, nil); err != nil {
+		var result = newFileInfo(path, fileInfo, parent)
+		if fileInfo.IsDir() {
+			for _, ancestor := range state.ancestors {
+				if os.SameFile(ancestor, fileInfo) {
+					if err := doFunc(result, fmt.Errorf("symlink loop detected: %v links to its ancestor directory", path)); err != nil {
+						panic(err)
+					}
+					return
+				}
+			}
+		}
+		if err = doFunc(result, nil); err != nil {
 			panic(fmt.Sprintf("do func error: %v", err))
 		}
 		if fileInfo.IsDir() {
 			names, err := readDirNames(path)
 			if err != nil {
-				if err := doFunc(&result, errors.Wrapf(err, "list %v sub files error", path)); err != nil {
+				if err := doFunc(result, errors.Wrapf(err, "list %v sub files error", path)); err != nil {
 					panic(err)
 				}
 			}
+			subState := walkState{
+				root:      state.root,
+				ancestors: append(state.ancestors[:len(state.ancestors):len(state.ancestors)], fileInfo),
+				rules:     state.rules,
+			}
+			if option.Filter != nil {
+				subState.rules = option.Filter.dirRules(state.rules, relPath, localPatterns(path))
+			}
 			for i := range names {
 				var iterName = names[i]
-				walk(&result, fmt.Sprintf("%v/%v", path, iterName), depth+1, doFunc, includeItems, ignoreErr)
+				walk(result, fmt.Sprintf("%v/%v", path, iterName), depth+1, doFunc, option, subState)
 			}
 		}
-		if includeItems {
-			parent.Includes[fileInfo.Name()] = &result
+		if option.IncludeItems {
+			parent.Includes[fileInfo.Name()] = result
 		}
 	}
 }
 
+// localPatterns 读取本地目录 dirPath 中的忽略文件
+func localPatterns(dirPath string) func(name string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		return readPatterns(filepath.Join(dirPath, name))
+	}
+}
+
+func newFileInfo(path string, fileInfo os.FileInfo, parent *FileInfo) *FileInfo {
+	dev, inode, links := fileId(fileInfo)
+	return &FileInfo{
+		Name:      fileInfo.Name(),
+		Path:      path,
+		Size:      fileInfo.Size(),
+		IsDir:     fileInfo.IsDir(),
+		IsSymlink: fileInfo.Mode()&os.ModeSymlink != 0,
+		Mode:      fileInfo.Mode(),
+		UpdatedAt: fileInfo.ModTime().Unix(),
+		Dev:       dev,
+		Inode:     inode,
+		Links:     links,
+		Parent:    parent,
+		Includes:  map[string]*FileInfo{},
+	}
+}
+
 func readDirNames(dirname string) ([]string, error) {
 	f, err := os.Open(dirname)
 	defer func(f *os.File) {
@@ -126,16 +202,7 @@ func GetFileInfo(path string) (*FileInfo, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "get file %v info error", absPath)
 	}
-	result := &FileInfo{
-		Name:      fileInfo.Name(),
-		Path:      absPath,
-		Size:      fileInfo.Size(),
-		IsDir:     fileInfo.IsDir(),
-		UpdatedAt: fileInfo.ModTime().Unix(),
-		Parent:    nil,
-		Includes:  map[string]*FileInfo{},
-	}
-	return result, nil
+	return newFileInfo(absPath, fileInfo, nil), nil
 }
 
 func CreateFile(path string) (*os.File, error) {
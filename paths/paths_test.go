@@ -2,14 +2,191 @@ package paths
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestGetIterPath(t *testing.T) {
-	files, err := DoIterPath("/Users/tlz/Downloads", nil, true, false)
+	root := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "dir", "empty"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("aaa"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "dir", "b.txt"), []byte("bb"), 0644))
+	files, err := DoIterPath(root, nil, true, false)
 	assert.Nil(t, err)
+	assert.True(t, files.IsDir)
+	assert.Len(t, files.Includes, 2)
+	assert.Equal(t, int64(3), files.Includes["a.txt"].Size)
+	assert.Equal(t, int64(2), files.Includes["dir"].Includes["b.txt"].Size)
+	assert.True(t, files.Includes["dir"].Includes["empty"].IsDir)
 	bytes, err := json.Marshal(files)
 	assert.Nil(t, err)
 	t.Logf("%v", string(bytes))
 }
+
+func TestIterFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":               {Data: []byte("a.txt")},
+		"b.tmp":               {Data: []byte("b.tmp")},
+		"node_modules/x/y.js": {Data: []byte("y.js")},
+		"sub/.ignore":         {Data: []byte("*.log\n!inner/e.log\n")},
+		"sub/c.txt":           {Data: []byte("c.txt")},
+		"sub/d.log":           {Data: []byte("d.log")},
+		"sub/inner/e.log":     {Data: []byte("e.log")},
+	}
+	filter, err := NewFilter(nil, []string{"node_modules/", "*.tmp"})
+	assert.Nil(t, err)
+	filter.IgnoreFiles = []string{".ignore"}
+	var visited []string
+	result, err := DoIterFS(fsys, ".", func(fileInfo *FileInfo, iterErr error) error {
+		assert.Nil(t, iterErr)
+		visited = append(visited, fileInfo.Path)
+		return nil
+	}, IterOption{Filter: filter, IncludeItems: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{".", "a.txt", "sub", "sub/.ignore", "sub/c.txt", "sub/inner", "sub/inner/e.log"}, visited)
+	assert.Equal(t, int64(5), result.Includes["sub"].Includes["inner"].Includes["e.log"].Size)
+
+	// doFunc 返回的错误停止遍历
+	stop := errors.New("stop")
+	_, err = DoIterFS(fsys, "sub", func(fileInfo *FileInfo, iterErr error) error {
+		if fileInfo.Name == "c.txt" {
+			return stop
+		}
+		return nil
+	}, IterOption{})
+	assert.Equal(t, stop, err)
+	_, err = DoIterFS(fsys, "missing", nil, IterOption{})
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestIterFSSymlink(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), os.ModePerm))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.Symlink("..", filepath.Join(dir, "sub", "loop")))
+	fsys := os.DirFS(dir)
+
+	// 不跟随时链接作为符号链接返回
+	var links []string
+	_, err := DoIterFS(fsys, ".", func(fileInfo *FileInfo, iterErr error) error {
+		assert.Nil(t, iterErr)
+		if fileInfo.IsSymlink {
+			links = append(links, fileInfo.Path)
+		}
+		return nil
+	}, IterOption{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sub/loop"}, links)
+
+	// 跟随时指向祖先目录的链接报告循环，不会无限递归
+	var loops []string
+	_, err = DoIterFS(fsys, ".", func(fileInfo *FileInfo, iterErr error) error {
+		if iterErr != nil {
+			assert.Contains(t, iterErr.Error(), "symlink loop")
+			loops = append(loops, fileInfo.Path)
+		}
+		return nil
+	}, IterOption{FollowSymlink: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sub/loop"}, loops)
+}
+
+func TestFilter(t *testing.T) {
+	filter, err := NewFilter([]string{"*.go", "*.md"}, []string{"node_modules/", "*.tmp", "/build", "docs/**/draft_*", "!keep.tmp"})
+	assert.Nil(t, err)
+	now := time.Now()
+	assert.True(t, filter.Match("main.go", false, 1, now))
+	assert.True(t, filter.Match("a/b/c.go", false, 1, now))
+	assert.False(t, filter.Match("a/b/c.txt", false, 1, now))
+	assert.False(t, filter.Match("node_modules", true, 0, now))
+	assert.False(t, filter.Match("web/node_modules", true, 0, now))
+	assert.True(t, filter.Match("node_modules.go", false, 1, now))
+	assert.False(t, filter.Match("x.tmp", false, 1, now))
+	assert.False(t, filter.Match("build", true, 0, now))
+	assert.True(t, filter.Match("src/build", true, 0, now))
+	assert.False(t, filter.Match("docs/draft_a.md", false, 1, now))
+	assert.False(t, filter.Match("docs/a/b/draft_a.md", false, 1, now))
+	assert.True(t, filter.Match("docs/a/b/final.md", false, 1, now))
+
+	filter, err = NewFilter(nil, nil)
+	assert.Nil(t, err)
+	filter.MaxSize = 100
+	filter.NewerThan = now.Add(-time.Hour)
+	assert.True(t, filter.Match("a", false, 100, now))
+	assert.False(t, filter.Match("a", false, 101, now))
+	assert.False(t, filter.Match("a", false, 1, now.Add(-2*time.Hour)))
+}
+
+func TestIterPathWithFilter(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"a.txt", "b.tmp", "node_modules/x/y.js", "sub/c.txt", "sub/d.log", "sub/inner/e.log"} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(root, path)), os.ModePerm))
+		assert.Nil(t, os.WriteFile(filepath.Join(root, path), []byte(path), 0644))
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "sub", ".ignore"), []byte("*.log\n!inner/e.log\n"), 0644))
+	filter, err := NewFilter(nil, []string{"node_modules/", "*.tmp"})
+	assert.Nil(t, err)
+	filter.IgnoreFiles = []string{".ignore"}
+	var visited []string
+	_, err = DoIterPathWithOption(root, func(fileInfo *FileInfo, iterErr error) error {
+		assert.Nil(t, iterErr)
+		if fileInfo.Path != root {
+			rel, _ := filepath.Rel(root, fileInfo.Path)
+			visited = append(visited, filepath.ToSlash(rel))
+		}
+		return nil
+	}, IterOption{Filter: filter})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.txt", "sub", "sub/.ignore", "sub/c.txt", "sub/inner", "sub/inner/e.log"}, visited)
+}
+
+func TestCheckSpace(t *testing.T) {
+	root := t.TempDir()
+	// 还不存在的目标路径使用已经存在的上级目录所在的文件系统
+	free, err := FreeSpace(filepath.Join(root, "not", "exist"))
+	assert.Nil(t, err)
+	assert.Greater(t, free, int64(0))
+	assert.Nil(t, CheckSpace(root, 0))
+	err = CheckSpace(root, 1<<62)
+	var spaceErr *SpaceError
+	assert.True(t, errors.As(err, &spaceErr))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+	assert.Equal(t, int64(1<<62), spaceErr.Need)
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "a_1.txt"), []byte("a_1"), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "dir"), os.ModePerm))
+	for name, rename := range map[string]func(oldPath, newPath string) error{
+		"rename": RenameNoReplace,
+		"link":   linkNoReplace,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// 已经存在的文件和目录不能被覆盖
+			err := rename(filepath.Join(root, "a.txt"), filepath.Join(root, "a_1.txt"))
+			assert.True(t, errors.Is(err, os.ErrExist))
+			err = rename(filepath.Join(root, "a.txt"), filepath.Join(root, "dir"))
+			assert.True(t, errors.Is(err, os.ErrExist))
+			content, err := os.ReadFile(filepath.Join(root, "a_1.txt"))
+			assert.Nil(t, err)
+			assert.Equal(t, "a_1", string(content))
+
+			assert.Nil(t, rename(filepath.Join(root, "a.txt"), filepath.Join(root, "a_2.txt")))
+			assert.Nil(t, rename(filepath.Join(root, "a_2.txt"), filepath.Join(root, "a.txt")))
+			content, err = os.ReadFile(filepath.Join(root, "a.txt"))
+			assert.Nil(t, err)
+			assert.Equal(t, "a", string(content))
+			assert.Nil(t, rename(filepath.Join(root, "dir"), filepath.Join(root, "dir_1")))
+			assert.Nil(t, rename(filepath.Join(root, "dir_1"), filepath.Join(root, "dir")))
+		})
+	}
+}
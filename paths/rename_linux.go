@@ -0,0 +1,21 @@
+package paths
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// renameNoReplace 使用 renameat2 的 RENAME_NOREPLACE，文件系统不支持时退回到 linkNoReplace
+func renameNoReplace(oldPath, newPath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE)
+	switch err {
+	case nil:
+		return nil
+	case unix.EEXIST:
+		return os.ErrExist
+	case unix.EINVAL, unix.ENOSYS, unix.EOPNOTSUPP:
+		return linkNoReplace(oldPath, newPath)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package paths
+
+// renameNoReplace 其他平台没有原子不覆盖的 rename
+func renameNoReplace(oldPath, newPath string) error {
+	return linkNoReplace(oldPath, newPath)
+}
@@ -0,0 +1,58 @@
+package paths
+
+import (
+	"fmt"
+	"go_tools/log"
+	"go_tools/units"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// SpaceError 目标文件系统的可用空间小于需要写入的大小，errors.Is(err, syscall.ENOSPC) 为 true
+type SpaceError struct {
+	Path string
+	Need int64
+	Free int64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("not enough space on %v: need %v, free %v", e.Path, units.FormatSize(e.Need), units.FormatSize(e.Free))
+}
+
+func (e *SpaceError) Unwrap() error {
+	return syscall.ENOSPC
+}
+
+// FreeSpace 返回 path 所在文件系统中普通用户可以使用的字节数，path 还不存在时使用最近的已经存在的上级目录
+func FreeSpace(path string) (int64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	return freeSpace(path)
+}
+
+// CheckSpace path 所在文件系统的可用空间小于 need 时返回 *SpaceError，不能获取可用空间时只输出警告
+func CheckSpace(path string, need int64) error {
+	free, err := FreeSpace(path)
+	if err != nil {
+		log.Warn("get free space of %v error: %v, skip space check", path, err)
+		return nil
+	}
+	if need > free {
+		return &SpaceError{Path: path, Need: need, Free: free}
+	}
+	log.Debug("space check of %v passed, need: %v, free: %v", path, units.FormatSize(need), units.FormatSize(free))
+	return nil
+}
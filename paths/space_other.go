@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package paths
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func freeSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("get free space is not supported on %v", runtime.GOOS)
+}
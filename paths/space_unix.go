@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package paths
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func freeSpace(path string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, errors.Wrapf(err, "statfs %v error", path)
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
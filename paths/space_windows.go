@@ -0,0 +1,20 @@
+//go:build windows
+
+package paths
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+func freeSpace(path string) (int64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, nil, nil); err != nil {
+		return 0, errors.Wrapf(err, "get free space of %v error", path)
+	}
+	return int64(free), nil
+}
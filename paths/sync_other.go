@@ -0,0 +1,31 @@
+//go:build windows || plan9 || js || wasip1
+
+package paths
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"os"
+)
+
+// SyncFile 这些平台需要可写的句柄才能把文件内容落盘
+func SyncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "open %v error", path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close %v error: %v", path, err)
+		}
+	}()
+	if err := file.Sync(); err != nil {
+		return errors.Wrapf(err, "sync %v error", path)
+	}
+	return nil
+}
+
+// SyncDir 这些平台不能打开目录落盘，rename 由文件系统自己保证
+func SyncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !windows && !plan9 && !js && !wasip1
+
+package paths
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"os"
+)
+
+// SyncFile 把文件内容落盘，只读打开的文件描述符也可以 fsync
+func SyncFile(path string) error {
+	return syncPath(path)
+}
+
+// SyncDir 把目录项落盘，保证 rename 之后的文件名在断电后仍然存在
+func SyncDir(path string) error {
+	return syncPath(path)
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "open %v error", path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close %v error: %v", path, err)
+		}
+	}()
+	if err := file.Sync(); err != nil {
+		return errors.Wrapf(err, "sync %v error", path)
+	}
+	return nil
+}
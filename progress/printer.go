@@ -0,0 +1,66 @@
+package progress
+
+import (
+	"fmt"
+	"go_tools/log"
+	"go_tools/units"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	barWidth  = 30
+	clearLine = "\r\033[K"
+)
+
+// Printer 输出进度的回调，file 是终端时在同一行刷新进度条并在结束时清除，否则定期输出日志
+func Printer(file *os.File) Callback {
+	if !IsTerminal(file) {
+		return func(snapshot Snapshot) {
+			log.Info("%v", Format(snapshot))
+		}
+	}
+	return func(snapshot Snapshot) {
+		if snapshot.Finished {
+			// 结束后由调用方输出汇总，不保留进度条
+			_, _ = fmt.Fprint(file, clearLine)
+			return
+		}
+		// 先清除整行，新的进度比上一次短时不会留下旧的字符
+		_, _ = fmt.Fprintf(file, "%v%v %v", clearLine, bar(snapshot), Format(snapshot))
+	}
+}
+
+// IsTerminal file 是否是字符设备，重定向到文件或者管道时返回 false
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Format 把进度格式化为一行文字
+func Format(snapshot Snapshot) string {
+	done := snapshot.DoneBytes + snapshot.SkippedBytes
+	total := "?"
+	if snapshot.Scanned {
+		total = units.FormatSize(snapshot.TotalBytes)
+	}
+	result := fmt.Sprintf("%v %5.1f%% %v/%v files %v/%v %v/s",
+		snapshot.Name, snapshot.Percent, units.FormatSize(done), total,
+		snapshot.DoneFiles, snapshot.TotalFiles, units.FormatSize(int64(snapshot.Speed)))
+	if snapshot.Finished {
+		return result + fmt.Sprintf(" cost %v", snapshot.Elapsed.Round(time.Second))
+	}
+	if snapshot.ETA > 0 {
+		result += fmt.Sprintf(" ETA %v", snapshot.ETA.Round(time.Second))
+	}
+	return result
+}
+
+func bar(snapshot Snapshot) string {
+	filled := int(snapshot.Percent * barWidth / 100)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled) + "]"
+}
@@ -0,0 +1,293 @@
+package progress
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot 某一时刻的进度
+type Snapshot struct {
+	Name         string        `json:"name"`
+	TotalBytes   int64         `json:"total_bytes"`   // 预扫描得到的总字节数，扫描结束前会不断增长
+	DoneBytes    int64         `json:"done_bytes"`    // 实际处理的字节数
+	SkippedBytes int64         `json:"skipped_bytes"` // 不需要处理而跳过的字节数，计入百分比但不计入速度
+	TotalFiles   int64         `json:"total_files"`
+	DoneFiles    int64         `json:"done_files"` // 处理完成和跳过的文件数
+	Scanned      bool          `json:"scanned"`    // 预扫描已经结束，TotalBytes 不再变化
+	Percent      float64       `json:"percent"`    // 预扫描结束前为 0
+	Speed        float64       `json:"speed"`      // 每秒处理的字节数
+	ETA          time.Duration `json:"eta"`        // 预计剩余时间，无法估计时为 0
+	Elapsed      time.Duration `json:"elapsed"`
+	Finished     bool          `json:"finished"` // Stop 之后的最后一次进度
+}
+
+// Callback 每隔 interval 和结束时收到一次进度
+type Callback func(snapshot Snapshot)
+
+// Progress 并发安全的字节级进度统计，计数都是原子操作，可以在任意协程中更新
+type Progress struct {
+	Name         string
+	interval     time.Duration
+	totalBytes   int64
+	doneBytes    int64
+	skippedBytes int64
+	totalFiles   int64
+	doneFiles    int64
+	scanned      atomic.Bool
+	startedAt    time.Time
+	callbacks    []Callback
+	channels     []chan Snapshot
+	stop         chan struct{}
+	stopOnce     sync.Once
+	wg           sync.WaitGroup
+	sync.Mutex
+}
+
+// New 新建进度统计，interval 为回调的间隔，小于等于 0 时为 3 秒
+func New(name string, interval time.Duration) *Progress {
+	if interval <= 0 {
+		interval = time.Second * 3
+	}
+	return &Progress{
+		Name:     name,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Default 新建每 3 秒输出一次到标准错误的进度
+func Default(name string) *Progress {
+	p := New(name, 0)
+	p.OnUpdate(Printer(os.Stderr))
+	return p
+}
+
+// OnUpdate 注册进度回调，需要在 Start 之前调用
+func (p *Progress) OnUpdate(callback Callback) {
+	p.Lock()
+	defer p.Unlock()
+	p.callbacks = append(p.callbacks, callback)
+}
+
+// Updates 返回接收进度的 channel，接收太慢时丢弃中间的进度，Stop 之后关闭。需要在 Start 之前调用
+func (p *Progress) Updates() <-chan Snapshot {
+	p.Lock()
+	defer p.Unlock()
+	channel := make(chan Snapshot, 1)
+	p.channels = append(p.channels, channel)
+	return channel
+}
+
+// Start 开始计时并定期回调，重复调用没有作用
+func (p *Progress) Start() {
+	p.Lock()
+	if !p.startedAt.IsZero() {
+		p.Unlock()
+		return
+	}
+	p.startedAt = time.Now()
+	p.Unlock()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.publish(p.Snapshot())
+			}
+		}
+	}()
+}
+
+// Begin 开始统计进度并在后台执行预扫描，scan 返回后标记扫描结束。
+// 返回的函数等待预扫描结束后调用 Stop
+func (p *Progress) Begin(scan func()) func() {
+	p.Start()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scan()
+		p.SetScanned()
+	}()
+	return func() {
+		<-done
+		p.Stop()
+	}
+}
+
+// Stop 停止定期回调，发送最后一次进度并关闭 Updates 返回的 channel，重复调用没有作用
+func (p *Progress) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+		snapshot := p.Snapshot()
+		snapshot.Finished = true
+		p.publish(snapshot)
+		p.Lock()
+		for _, channel := range p.channels {
+			close(channel)
+		}
+		p.channels = nil
+		p.Unlock()
+	})
+}
+
+func (p *Progress) publish(snapshot Snapshot) {
+	p.Lock()
+	callbacks := p.callbacks
+	channels := p.channels
+	p.Unlock()
+	for _, callback := range callbacks {
+		callback(snapshot)
+	}
+	for _, channel := range channels {
+		// 丢弃还没有被取走的旧进度，保证 channel 中总是最新的进度
+		select {
+		case <-channel:
+		default:
+		}
+		select {
+		case channel <- snapshot:
+		default:
+		}
+	}
+}
+
+// AddTotal 预扫描发现了新的文件
+func (p *Progress) AddTotal(bytes, files int64) {
+	atomic.AddInt64(&p.totalBytes, bytes)
+	atomic.AddInt64(&p.totalFiles, files)
+}
+
+// SetScanned 预扫描结束，之后才计算百分比和剩余时间
+func (p *Progress) SetScanned() {
+	p.scanned.Store(true)
+}
+
+// Add 处理了 bytes 字节，bytes 可以为负数，用于重新处理时回退进度
+func (p *Progress) Add(bytes int64) {
+	atomic.AddInt64(&p.doneBytes, bytes)
+}
+
+// Skip 跳过一个 bytes 字节的文件
+func (p *Progress) Skip(bytes int64) {
+	atomic.AddInt64(&p.skippedBytes, bytes)
+	atomic.AddInt64(&p.doneFiles, 1)
+}
+
+// FileDone 处理完成一个文件
+func (p *Progress) FileDone() {
+	atomic.AddInt64(&p.doneFiles, 1)
+}
+
+func (p *Progress) Snapshot() Snapshot {
+	p.Lock()
+	startedAt := p.startedAt
+	p.Unlock()
+	snapshot := Snapshot{
+		Name:         p.Name,
+		TotalBytes:   atomic.LoadInt64(&p.totalBytes),
+		DoneBytes:    atomic.LoadInt64(&p.doneBytes),
+		SkippedBytes: atomic.LoadInt64(&p.skippedBytes),
+		TotalFiles:   atomic.LoadInt64(&p.totalFiles),
+		DoneFiles:    atomic.LoadInt64(&p.doneFiles),
+		Scanned:      p.scanned.Load(),
+	}
+	if !startedAt.IsZero() {
+		snapshot.Elapsed = time.Since(startedAt)
+	}
+	if seconds := snapshot.Elapsed.Seconds(); seconds > 0 {
+		snapshot.Speed = float64(snapshot.DoneBytes) / seconds
+	}
+	if !snapshot.Scanned {
+		return snapshot
+	}
+	finished := snapshot.DoneBytes + snapshot.SkippedBytes
+	if snapshot.TotalBytes > 0 {
+		snapshot.Percent = float64(finished) * 100 / float64(snapshot.TotalBytes)
+		if snapshot.Percent > 100 {
+			snapshot.Percent = 100
+		}
+	} else if snapshot.DoneFiles >= snapshot.TotalFiles {
+		snapshot.Percent = 100
+	}
+	if left := snapshot.TotalBytes - finished; left > 0 && snapshot.Speed > 0 {
+		snapshot.ETA = time.Duration(float64(left) / snapshot.Speed * float64(time.Second))
+	}
+	return snapshot
+}
+
+// Tracker 记录一个文件已经计入总进度的字节数，文件重新处理时可以回退。
+// 上次运行已经处理的部分通过 Resume 计入跳过的字节数，不计入速度
+type Tracker struct {
+	progress *Progress
+	done     int64 // 本次运行处理的字节数
+	resumed  int64 // 文件开头上次运行已经处理的字节数
+	sync.Mutex
+}
+
+func (p *Progress) Track() *Tracker {
+	return &Tracker{progress: p}
+}
+
+// Add 文件又处理了 bytes 字节，可以在多个协程中同时调用
+func (t *Tracker) Add(bytes int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.done += bytes
+	t.progress.Add(bytes)
+}
+
+// Set 文件已经处理到 position 字节
+func (t *Tracker) Set(position int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.set(position)
+}
+
+// Resume 文件从上次运行的 position 继续处理。本次运行还没有处理过这个文件时，position 之前的字节计入跳过的字节数
+func (t *Tracker) Resume(position int64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.done == 0 && position > t.resumed {
+		atomic.AddInt64(&t.progress.skippedBytes, position-t.resumed)
+		t.resumed = position
+	}
+	t.set(position)
+}
+
+func (t *Tracker) set(position int64) {
+	if position < t.resumed {
+		// 重新从头处理，上次运行的部分也要重新计入速度
+		atomic.AddInt64(&t.progress.skippedBytes, position-t.resumed)
+		t.resumed = position
+	}
+	done := position - t.resumed
+	t.progress.Add(done - t.done)
+	t.done = done
+}
+
+// Reader 返回读取时把读到的字节数计入进度的 Reader
+func (t *Tracker) Reader(reader io.Reader) io.Reader {
+	return &trackReader{reader: reader, tracker: t}
+}
+
+type trackReader struct {
+	reader  io.Reader
+	tracker *Tracker
+}
+
+func (r *trackReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.tracker.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,197 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"go_tools/paths"
+	"go_tools/retry"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type FailType string
+
+const (
+	FailTypeVerify     FailType = "verify_mismatch"   // 复制完成但目标文件和源文件内容不一致
+	FailTypeConflict   FailType = "conflict"          // 目标已经存在，冲突策略为 fail
+	FailTypeCanceled   FailType = "canceled"          // 处理过程中被取消，复制的临时文件和进度保留到下次 resume
+	FailTypeNotFound   FailType = "not_found"         // 文件在处理过程中被删除
+	FailTypeChanged    FailType = "changed"           // 文件在读取过程中被修改
+	FailTypePermission FailType = "permission_denied" // 没有读取源文件或者写入目标的权限
+	FailTypeNoSpace    FailType = "no_space"          // 目标磁盘空间不足
+	FailTypeTransient  FailType = "transient"         // 网络文件系统的暂时性错误，重试到上限仍然失败
+	FailTypeIO         FailType = "io_error"          // 其他读写错误
+)
+
+// FailItem 一个处理失败的路径，Type 是失败原因的分类
+type FailItem struct {
+	Path     string   `json:"path"`
+	Reason   string   `json:"reason"`
+	Type     FailType `json:"type,omitempty"`
+	Attempts int      `json:"attempts,omitempty"` // 包括重试在内尝试的次数
+}
+
+// NewFailItem 根据 err 生成失败记录并对失败原因分类
+func NewFailItem(path string, err error) FailItem {
+	return FailItem{
+		Path:   path,
+		Reason: err.Error(),
+		Type:   Classify(err),
+	}
+}
+
+// Classify 根据错误链中的系统错误对失败原因分类
+func Classify(err error) FailType {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return FailTypeCanceled
+	case errors.Is(err, os.ErrNotExist):
+		return FailTypeNotFound
+	case errors.Is(err, paths.ErrFileChanged):
+		return FailTypeChanged
+	case errors.Is(err, os.ErrPermission):
+		return FailTypePermission
+	case errors.Is(err, syscall.ENOSPC):
+		return FailTypeNoSpace
+	case retry.IsTransient(err):
+		return FailTypeTransient
+	default:
+		return FailTypeIO
+	}
+}
+
+type Outcome string
+
+const (
+	OutcomeCopied     Outcome = "copied"
+	OutcomeSkipped    Outcome = "skipped" // 没有变化、已经完成或者因为冲突策略跳过
+	OutcomeLinked     Outcome = "linked"  // 创建了符号链接或硬链接
+	OutcomeDeleted    Outcome = "deleted" // 镜像模式下删除的多余目标
+	OutcomeMoved      Outcome = "moved"   // 移动后源文件已经删除
+	OutcomeDeduped    Outcome = "deduped" // 内容和已有的目标文件相同，链接到那个文件而没有复制
+	OutcomeCompressed Outcome = "compressed"
+	OutcomeExtracted  Outcome = "extracted"
+)
+
+// transferred 处理了文件内容的结果，字节数计入 Totals.Bytes
+func (o Outcome) transferred() bool {
+	return o == OutcomeCopied || o == OutcomeMoved || o == OutcomeCompressed || o == OutcomeExtracted
+}
+
+// FileItem 一个文件的处理结果，失败的文件记录在 Report.Failures 中
+type FileItem struct {
+	SourcePath string        `json:"source_path"`
+	TargetPath string        `json:"target_path,omitempty"`
+	Outcome    Outcome       `json:"outcome"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration"`
+	Strategy   string        `json:"strategy,omitempty"` // 复制使用的策略
+	Attempts   int           `json:"attempts,omitempty"` // 包括重试在内尝试的次数
+	// 读取过程中源文件被修改，按照 warn 策略保留了读取到的内容，可能不一致
+	Changed bool `json:"changed,omitempty"`
+}
+
+type Totals struct {
+	Files        int64              `json:"files"`         // 成功处理和跳过的文件数，不包括失败
+	Bytes        int64              `json:"bytes"`         // 实际复制、压缩或解压的字节数
+	SkippedBytes int64              `json:"skipped_bytes"` // 跳过的文件的字节数
+	DedupBytes   int64              `json:"dedup_bytes"`   // 重复内容链接到已有文件而节省的字节数
+	Failed       int64              `json:"failed"`
+	Retried      int64              `json:"retried"` // 重试过的文件数，包括重试后成功和失败的
+	Changed      int64              `json:"changed"` // 读取过程中被修改但是保留了结果的文件数
+	Outcomes     map[Outcome]int64  `json:"outcomes"`
+	Strategies   map[string]int64   `json:"strategies"`
+	FailTypes    map[FailType]int64 `json:"fail_types"`
+}
+
+// Report 一次复制、压缩或解压的结果报告，Add 可以在多个协程中同时调用。
+// nil 的 Report 不记录任何内容
+type Report struct {
+	Name       string        `json:"name"`
+	SourcePath string        `json:"source_path"`
+	TargetPath string        `json:"target_path"`
+	StartedAt  int64         `json:"started_at"`
+	FinishedAt int64         `json:"finished_at"`
+	Duration   time.Duration `json:"duration"`
+	Canceled   bool          `json:"canceled"`
+	Error      string        `json:"error,omitempty"` // 导致整体中止的错误
+	Totals     Totals        `json:"totals"`
+	Files      []FileItem    `json:"files"`
+	Failures   []FailItem    `json:"failures"`
+	startTime  time.Time
+	sync.Mutex
+}
+
+func New(name, sourcePath, targetPath string) *Report {
+	now := time.Now()
+	return &Report{
+		Name:       name,
+		SourcePath: sourcePath,
+		TargetPath: targetPath,
+		StartedAt:  now.Unix(),
+		Files:      []FileItem{},
+		Failures:   []FailItem{},
+		startTime:  now,
+	}
+}
+
+// Add 记录一个文件的处理结果
+func (r *Report) Add(item FileItem) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.Files = append(r.Files, item)
+}
+
+// Finish 记录所有失败和整体的错误，并统计总数
+func (r *Report) Finish(failures []FailItem, err error) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.FinishedAt = time.Now().Unix()
+	r.Duration = time.Since(r.startTime)
+	r.Failures = append([]FailItem{}, failures...)
+	if err != nil {
+		r.Canceled = Classify(err) == FailTypeCanceled
+		r.Error = err.Error()
+	}
+	totals := Totals{
+		Failed:     int64(len(r.Failures)),
+		Outcomes:   map[Outcome]int64{},
+		Strategies: map[string]int64{},
+		FailTypes:  map[FailType]int64{},
+	}
+	for _, item := range r.Files {
+		totals.Files += 1
+		totals.Outcomes[item.Outcome] += 1
+		if item.Outcome.transferred() {
+			totals.Bytes += item.Bytes
+		} else if item.Outcome == OutcomeSkipped {
+			totals.SkippedBytes += item.Bytes
+		} else if item.Outcome == OutcomeDeduped {
+			totals.DedupBytes += item.Bytes
+		}
+		if len(item.Strategy) > 0 {
+			totals.Strategies[item.Strategy] += 1
+		}
+		if item.Attempts > 1 {
+			totals.Retried += 1
+		}
+		if item.Changed {
+			totals.Changed += 1
+		}
+	}
+	for _, item := range r.Failures {
+		totals.FailTypes[item.Type] += 1
+		if item.Attempts > 1 {
+			totals.Retried += 1
+		}
+	}
+	r.Totals = totals
+}
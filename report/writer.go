@@ -0,0 +1,183 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"go_tools/units"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatCSV  Format = "csv"
+	FormatHTML Format = "html"
+)
+
+// FormatOf 根据文件扩展名判断报告格式
+func FormatOf(path string) (Format, error) {
+	switch ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), ".")); ext {
+	case "json":
+		return FormatJSON, nil
+	case "csv":
+		return FormatCSV, nil
+	case "html", "htm":
+		return FormatHTML, nil
+	default:
+		return "", fmt.Errorf("unsupported report format %q, use .json, .csv or .html", ext)
+	}
+}
+
+// Load 读取 JSON 格式的报告，用于重新处理其中失败的文件
+func Load(path string) (*Report, error) {
+	if format, err := FormatOf(path); err != nil {
+		return nil, err
+	} else if format != FormatJSON {
+		return nil, fmt.Errorf("only json report can be loaded: %v", path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read report file %v error", path)
+	}
+	var result Report
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, errors.Wrapf(err, "decode report file %v error", path)
+	}
+	return &result, nil
+}
+
+// Save 按照扩展名对应的格式保存报告
+func (r *Report) Save(path string) error {
+	format, err := FormatOf(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "create report file %v error", path)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Debug("close report file %v error: %v", path, err)
+		}
+	}()
+	return r.Write(file, format)
+}
+
+func (r *Report) Write(writer io.Writer, format Format) error {
+	r.Lock()
+	defer r.Unlock()
+	switch format {
+	case FormatJSON:
+		return r.writeJSON(writer)
+	case FormatCSV:
+		return r.writeCSV(writer)
+	case FormatHTML:
+		return r.writeHTML(writer)
+	default:
+		return fmt.Errorf("unsupported report format %q", format)
+	}
+}
+
+func (r *Report) writeJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// writeCSV 每个文件一行，失败的文件在最后，outcome 为 failed
+func (r *Report) writeCSV(writer io.Writer) error {
+	csvWriter := csv.NewWriter(writer)
+	_ = csvWriter.Write([]string{"source_path", "target_path", "outcome", "bytes", "duration_ms", "strategy", "attempts", "fail_type", "reason"})
+	for _, item := range r.Files {
+		_ = csvWriter.Write([]string{item.SourcePath, item.TargetPath, string(item.Outcome), strconv.FormatInt(item.Bytes, 10),
+			strconv.FormatInt(item.Duration.Milliseconds(), 10), item.Strategy, attempts(item.Attempts), "", changedReason(item.Changed)})
+	}
+	for _, item := range r.Failures {
+		_ = csvWriter.Write([]string{item.Path, "", "failed", "", "", "", attempts(item.Attempts), string(item.Type), item.Reason})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// changedReason 成功的文件只在读取过程中被修改时有原因
+func changedReason(changed bool) string {
+	if changed {
+		return paths.ErrFileChanged.Error()
+	}
+	return ""
+}
+
+// attempts 没有记录尝试次数的结果只尝试了一次
+func attempts(number int) string {
+	if number <= 0 {
+		number = 1
+	}
+	return strconv.Itoa(number)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"size":     units.FormatSize,
+	"duration": func(d time.Duration) time.Duration { return d.Round(time.Millisecond) },
+	"time":     func(unix int64) string { return time.Unix(unix, 0).Format("2006-01-02 15:04:05") },
+	"attempts": attempts,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} report</title>
+<style>
+body { font-family: sans-serif; margin: 24px; }
+table { border-collapse: collapse; margin-bottom: 24px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #eee; }
+.failed { color: #c00; }
+</style>
+</head>
+<body>
+<h1>{{.Name}} report</h1>
+<table>
+<tr><th>source</th><td>{{.SourcePath}}</td></tr>
+<tr><th>target</th><td>{{.TargetPath}}</td></tr>
+<tr><th>started</th><td>{{time .StartedAt}}</td></tr>
+<tr><th>finished</th><td>{{time .FinishedAt}}</td></tr>
+<tr><th>duration</th><td>{{duration .Duration}}</td></tr>
+{{if .Canceled}}<tr><th>canceled</th><td class="failed">{{.Error}}</td></tr>{{else if .Error}}<tr><th>error</th><td class="failed">{{.Error}}</td></tr>{{end}}
+<tr><th>files</th><td>{{.Totals.Files}}</td></tr>
+<tr><th>bytes</th><td>{{size .Totals.Bytes}}</td></tr>
+<tr><th>skipped bytes</th><td>{{size .Totals.SkippedBytes}}</td></tr>
+<tr><th>dedup bytes</th><td>{{size .Totals.DedupBytes}}</td></tr>
+<tr><th>failed</th><td{{if .Totals.Failed}} class="failed"{{end}}>{{.Totals.Failed}}</td></tr>
+<tr><th>retried</th><td>{{.Totals.Retried}}</td></tr>
+<tr><th>changed while reading</th><td>{{.Totals.Changed}}</td></tr>
+{{range $outcome, $number := .Totals.Outcomes}}<tr><th>{{$outcome}}</th><td>{{$number}}</td></tr>
+{{end}}{{range $strategy, $number := .Totals.Strategies}}<tr><th>strategy {{$strategy}}</th><td>{{$number}}</td></tr>
+{{end}}</table>
+{{if .Failures}}<h2>Failures</h2>
+<table>
+<tr><th>path</th><th>type</th><th>attempts</th><th>reason</th></tr>
+{{range .Failures}}<tr class="failed"><td>{{.Path}}</td><td>{{.Type}}</td><td>{{attempts .Attempts}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Files</h2>
+<table>
+<tr><th>source</th><th>target</th><th>outcome</th><th>size</th><th>duration</th><th>strategy</th><th>attempts</th></tr>
+{{range .Files}}<tr><td>{{.SourcePath}}</td><td>{{.TargetPath}}</td><td>{{.Outcome}}</td><td>{{size .Bytes}}</td><td>{{duration .Duration}}</td><td>{{.Strategy}}</td><td>{{attempts .Attempts}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (r *Report) writeHTML(writer io.Writer) error {
+	return htmlTemplate.Execute(writer, r)
+}
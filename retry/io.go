@@ -0,0 +1,72 @@
+package retry
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// Reader 读取遇到暂时性错误时退避后重新读取，适用于出错时不移动读取位置的文件
+type Reader struct {
+	ctx     context.Context
+	policy  *Policy
+	reader  io.Reader
+	retries int64
+}
+
+func (p *Policy) Reader(ctx context.Context, reader io.Reader) *Reader {
+	return &Reader{ctx: ctx, policy: p, reader: reader}
+}
+
+func (r *Reader) Read(buf []byte) (int, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := r.reader.Read(buf)
+		if !r.policy.retryable(attempt, err) {
+			return n, err
+		}
+		// 先返回已经读到的内容，下一次读取时再重试
+		if n > 0 {
+			return n, nil
+		}
+		atomic.AddInt64(&r.retries, 1)
+		if !r.policy.wait(r.ctx, attempt) {
+			return n, err
+		}
+	}
+}
+
+// Retries 已经重试的次数
+func (r *Reader) Retries() int64 {
+	return atomic.LoadInt64(&r.retries)
+}
+
+// Writer 写入遇到暂时性错误时退避后继续写入剩下的内容
+type Writer struct {
+	ctx     context.Context
+	policy  *Policy
+	writer  io.Writer
+	retries int64
+}
+
+func (p *Policy) Writer(ctx context.Context, writer io.Writer) *Writer {
+	return &Writer{ctx: ctx, policy: p, writer: writer}
+}
+
+func (w *Writer) Write(buf []byte) (int, error) {
+	var written int
+	for attempt := 1; ; attempt++ {
+		n, err := w.writer.Write(buf[written:])
+		written += n
+		if err == nil || !w.policy.retryable(attempt, err) {
+			return written, err
+		}
+		atomic.AddInt64(&w.retries, 1)
+		if !w.policy.wait(w.ctx, attempt) {
+			return written, err
+		}
+	}
+}
+
+func (w *Writer) Retries() int64 {
+	return atomic.LoadInt64(&w.retries)
+}
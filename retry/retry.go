@@ -0,0 +1,96 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"go_tools/log"
+	"math/rand"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Policy 暂时性错误的重试策略，nil 的 Policy 不重试
+type Policy struct {
+	Attempts  int           `json:"attempts"`   // 包括第一次在内总共尝试的次数，小于等于 1 时不重试
+	BaseDelay time.Duration `json:"base_delay"` // 第一次重试前等待的时间，之后每次翻倍
+	MaxDelay  time.Duration `json:"max_delay"`  // 等待时间的上限，为 0 时不限制
+}
+
+// transientErrors 网络文件系统上常见的、稍后重试可能成功的错误
+var transientErrors = []error{
+	syscall.EIO,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.ECONNRESET,
+	syscall.EBUSY,
+}
+
+// IsTransient err 是否是暂时性的错误，文件不存在、没有权限这类错误重试也不会成功
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if os.IsTimeout(err) {
+		return true
+	}
+	// 网络存储返回的 5xx、限流这类错误
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	for _, transient := range transientErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay 第 attempt 次重试前等待的时间，指数退避并在 [d/2, d] 之间随机抖动，避免同时失败的文件一起重试
+func (p *Policy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryable 第 attempt 次尝试返回 err 后是否还可以重试
+func (p *Policy) retryable(attempt int, err error) bool {
+	return p != nil && attempt < p.Attempts && IsTransient(err)
+}
+
+// wait 等待第 attempt 次重试，ctx 取消时返回 false
+func (p *Policy) wait(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(p.Delay(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Do 执行 fn，遇到暂时性错误时退避后重试，返回尝试的次数和最后一次的错误。attempt 从 1 开始
+func (p *Policy) Do(ctx context.Context, name string, fn func(attempt int) error) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if !p.retryable(attempt, err) {
+			return attempt, err
+		}
+		log.Warn("%v error: %v, retry %v/%v", name, err, attempt, p.Attempts-1)
+		if !p.wait(ctx, attempt) {
+			return attempt, err
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"go_tools/paths"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// FS 把 Storage 转换成只读的 fs.FS，"." 对应存储的根目录
+func FS(storage Storage) fs.FS {
+	return storageFS{storage: storage}
+}
+
+type storageFS struct {
+	storage Storage
+}
+
+// storagePath 把 fs.FS 中的路径转换成存储中的相对路径
+func storagePath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+func (f storageFS) Open(name string) (fs.File, error) {
+	relPath, err := storagePath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := f.storage.Stat(relPath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if fileInfo.IsDir {
+		return &storageDir{fs: f, name: name, info: statInfo{fileInfo}}, nil
+	}
+	reader, err := f.storage.Open(relPath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &storageFile{ReadCloser: reader, info: statInfo{fileInfo}}, nil
+}
+
+func (f storageFS) Stat(name string) (fs.FileInfo, error) {
+	relPath, err := storagePath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := f.storage.Stat(relPath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return statInfo{fileInfo}, nil
+}
+
+// RealPath 不支持符号链接的存储中路径本身就是真实路径
+func (f storageFS) RealPath(name string) (string, error) {
+	relPath, err := storagePath("realpath", name)
+	if err != nil {
+		return "", err
+	}
+	if symlinker, ok := f.storage.(Symlinker); ok {
+		return symlinker.RealPath(relPath)
+	}
+	return relPath, nil
+}
+
+func (f storageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	relPath, err := storagePath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	children, err := f.storage.List(relPath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	result := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		result = append(result, fs.FileInfoToDirEntry(statInfo{child}))
+	}
+	return result, nil
+}
+
+// statInfo 把 paths.FileInfo 转换成 fs.FileInfo
+type statInfo struct {
+	fileInfo *paths.FileInfo
+}
+
+func (s statInfo) Name() string {
+	return s.fileInfo.Name
+}
+
+func (s statInfo) Size() int64 {
+	return s.fileInfo.Size
+}
+
+func (s statInfo) Mode() fs.FileMode {
+	if s.fileInfo.IsDir {
+		return s.fileInfo.Mode | fs.ModeDir
+	}
+	return s.fileInfo.Mode
+}
+
+func (s statInfo) ModTime() time.Time {
+	return time.Unix(s.fileInfo.UpdatedAt, 0)
+}
+
+func (s statInfo) IsDir() bool {
+	return s.fileInfo.IsDir
+}
+
+func (s statInfo) Sys() any {
+	return nil
+}
+
+type storageFile struct {
+	io.ReadCloser
+	info statInfo
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// storageDir 目录只能列出子路径，第一次 ReadDir 时读取全部子路径
+type storageDir struct {
+	fs      storageFS
+	name    string
+	info    statInfo
+	entries []fs.DirEntry
+	loaded  bool
+}
+
+func (d *storageDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *storageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *storageDir) Close() error {
+	return nil
+}
+
+func (d *storageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.loaded = entries, true
+	}
+	if n <= 0 {
+		result := d.entries
+		d.entries = nil
+		return result, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	result := d.entries[:n]
+	d.entries = d.entries[n:]
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Local 本地文件系统中的一个目录或者文件
+type Local struct {
+	Root    string `json:"root"`
+	Durable bool   `json:"durable"` // 提交写入的文件时 rename 前后 fsync 文件和目录
+}
+
+func NewLocal(root string) (*Local, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get abs path of %v error", root)
+	}
+	return &Local{Root: root}, nil
+}
+
+func (l *Local) path(relPath string) string {
+	if len(relPath) == 0 {
+		return l.Root
+	}
+	return filepath.Join(l.Root, filepath.FromSlash(relPath))
+}
+
+func (l *Local) Stat(relPath string) (*paths.FileInfo, error) {
+	info, err := os.Stat(l.path(relPath))
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(relPath, info.Size(), info.IsDir(), info.Mode(), info.ModTime()), nil
+}
+
+func (l *Local) List(relPath string) ([]*paths.FileInfo, error) {
+	entries, err := os.ReadDir(l.path(relPath))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*paths.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// 跟随指向文件的符号链接，指向目录的链接可能形成循环，不跟随
+		fileInfo, err := l.Stat(Join(relPath, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if fileInfo.IsDir && entry.Type()&os.ModeSymlink != 0 {
+			log.Debug("skip symlink to directory %v", l.path(fileInfo.Path))
+			continue
+		}
+		result = append(result, fileInfo)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (l *Local) Open(relPath string) (io.ReadCloser, error) {
+	return os.Open(l.path(relPath))
+}
+
+// Create 写入同目录下的临时文件，Commit 时 rename 到目标路径
+func (l *Local) Create(relPath string) (Writer, error) {
+	path := l.path(relPath)
+	tempPath := paths.TempPath(path)
+	file, err := paths.CreateFile(tempPath)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: file, tempPath: tempPath, path: path, durable: l.Durable}, nil
+}
+
+func (l *Local) MkdirAll(relPath string) error {
+	return os.MkdirAll(l.path(relPath), os.ModePerm)
+}
+
+func (l *Local) Remove(relPath string) error {
+	return os.Remove(l.path(relPath))
+}
+
+func (l *Local) Rename(oldPath, newPath string) error {
+	return os.Rename(l.path(oldPath), l.path(newPath))
+}
+
+func (l *Local) SetMetadata(relPath string, mode os.FileMode, modTime time.Time) error {
+	path := l.path(relPath)
+	if mode != 0 {
+		if err := os.Chmod(path, mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !modTime.IsZero() {
+		return os.Chtimes(path, modTime, modTime)
+	}
+	return nil
+}
+
+func (l *Local) FreeSpace() (int64, error) {
+	return paths.FreeSpace(l.Root)
+}
+
+func (l *Local) Close() error {
+	return nil
+}
+
+func (l *Local) String() string {
+	return l.Root
+}
+
+type localWriter struct {
+	*os.File
+	tempPath string
+	path     string
+	durable  bool
+}
+
+func (w *localWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		w.remove()
+		return errors.Wrapf(err, "close %v error", w.tempPath)
+	}
+	if err := paths.CommitFile(w.tempPath, w.path, w.durable); err != nil {
+		w.remove()
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() error {
+	err := w.File.Close()
+	w.remove()
+	return err
+}
+
+func (w *localWriter) remove() {
+	if err := os.Remove(w.tempPath); err != nil {
+		log.Debug("remove temp file %v error: %v", w.tempPath, err)
+	}
+}
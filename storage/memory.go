@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bytes"
+	"go_tools/paths"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Memory 内存中的存储，不依赖本地文件系统，可以注入读写故障来测试出错的路径
+type Memory struct {
+	// 所有文件共享的第 FailReadAt 次 Read 返回 ReadErr，只失败一次，为 0 时不注入
+	FailReadAt int64
+	ReadErr    error // 默认 syscall.EIO
+	// 每次 Write 前等待的时间，模拟慢速存储
+	WriteDelay time.Duration
+	// 所有文件内容加上正在写入的内容的总大小上限，超过时 Write 返回 syscall.ENOSPC，为 0 时不限制
+	Capacity int64
+	reads    atomic.Int64
+	used     int64
+	nodes    map[string]*memoryNode
+	sync.Mutex
+}
+
+type memoryNode struct {
+	content []byte
+	isDir   bool
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{nodes: map[string]*memoryNode{
+		"": {isDir: true, mode: os.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+// WriteFile 直接写入一个文件，需要的上级目录自动创建
+func (m *Memory) WriteFile(relPath string, content []byte, modTime time.Time) error {
+	relPath = Join(relPath)
+	m.Lock()
+	defer m.Unlock()
+	if err := m.mkdirAll(path.Dir("/" + relPath)[1:]); err != nil {
+		return err
+	}
+	if node, ok := m.nodes[relPath]; ok {
+		if node.isDir {
+			return &fs.PathError{Op: "write", Path: relPath, Err: syscall.EISDIR}
+		}
+		m.used -= int64(len(node.content))
+	}
+	m.used += int64(len(content))
+	m.nodes[relPath] = &memoryNode{content: bytes.Clone(content), mode: 0644, modTime: modTime}
+	return nil
+}
+
+// ReadFile 读取一个文件的全部内容，不计入注入故障的读取次数
+func (m *Memory) ReadFile(relPath string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	node, err := m.file("read", Join(relPath))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(node.content), nil
+}
+
+func (m *Memory) node(op, relPath string) (*memoryNode, error) {
+	node, ok := m.nodes[relPath]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: relPath, Err: fs.ErrNotExist}
+	}
+	return node, nil
+}
+
+func (m *Memory) file(op, relPath string) (*memoryNode, error) {
+	node, err := m.node(op, relPath)
+	if err != nil {
+		return nil, err
+	}
+	if node.isDir {
+		return nil, &fs.PathError{Op: op, Path: relPath, Err: syscall.EISDIR}
+	}
+	return node, nil
+}
+
+func (m *Memory) Stat(relPath string) (*paths.FileInfo, error) {
+	relPath = Join(relPath)
+	m.Lock()
+	defer m.Unlock()
+	node, err := m.node("stat", relPath)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(relPath, int64(len(node.content)), node.isDir, node.mode, node.modTime), nil
+}
+
+func (m *Memory) List(relPath string) ([]*paths.FileInfo, error) {
+	relPath = Join(relPath)
+	m.Lock()
+	defer m.Unlock()
+	node, err := m.node("readdir", relPath)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: relPath, Err: syscall.ENOTDIR}
+	}
+	prefix := relPath
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	var result []*paths.FileInfo
+	for name, child := range m.nodes {
+		if len(name) == 0 || !strings.HasPrefix(name, prefix) || strings.Contains(name[len(prefix):], "/") {
+			continue
+		}
+		result = append(result, newFileInfo(name, int64(len(child.content)), child.isDir, child.mode, child.modTime))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (m *Memory) Open(relPath string) (io.ReadCloser, error) {
+	relPath = Join(relPath)
+	m.Lock()
+	defer m.Unlock()
+	node, err := m.file("open", relPath)
+	if err != nil {
+		return nil, err
+	}
+	// 读取的是打开时的内容，之后的写入不影响
+	return &memoryReader{Reader: bytes.NewReader(node.content), memory: m, path: relPath}, nil
+}
+
+func (m *Memory) Create(relPath string) (Writer, error) {
+	relPath = Join(relPath)
+	m.Lock()
+	defer m.Unlock()
+	if node, ok := m.nodes[relPath]; ok && node.isDir {
+		return nil, &fs.PathError{Op: "create", Path: relPath, Err: syscall.EISDIR}
+	}
+	if err := m.mkdirAll(path.Dir("/" + relPath)[1:]); err != nil {
+		return nil, err
+	}
+	return &memoryWriter{memory: m, path: relPath}, nil
+}
+
+func (m *Memory) MkdirAll(relPath string) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.mkdirAll(Join(relPath))
+}
+
+func (m *Memory) mkdirAll(relPath string) error {
+	if len(relPath) == 0 {
+		return nil
+	}
+	if node, ok := m.nodes[relPath]; ok {
+		if !node.isDir {
+			return &fs.PathError{Op: "mkdir", Path: relPath, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if err := m.mkdirAll(path.Dir("/" + relPath)[1:]); err != nil {
+		return err
+	}
+	m.nodes[relPath] = &memoryNode{isDir: true, mode: os.ModeDir | 0755, modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Remove(relPath string) error {
+	relPath = Join(relPath)
+	m.Lock()
+	defer m.Unlock()
+	node, err := m.node("remove", relPath)
+	if err != nil {
+		return err
+	}
+	if node.isDir {
+		for name := range m.nodes {
+			if strings.HasPrefix(name, relPath+"/") || len(relPath) == 0 && len(name) > 0 {
+				return &fs.PathError{Op: "remove", Path: relPath, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+	m.used -= int64(len(node.content))
+	delete(m.nodes, relPath)
+	return nil
+}
+
+// Rename 移动文件或者整个目录，newPath 已经是目录时返回错误
+func (m *Memory) Rename(oldPath, newPath string) error {
+	oldPath, newPath = Join(oldPath), Join(newPath)
+	m.Lock()
+	defer m.Unlock()
+	node, err := m.node("rename", oldPath)
+	if err != nil {
+		return err
+	}
+	if existing, ok := m.nodes[newPath]; ok {
+		if existing.isDir {
+			return &fs.PathError{Op: "rename", Path: newPath, Err: syscall.EEXIST}
+		}
+		m.used -= int64(len(existing.content))
+	}
+	if err := m.mkdirAll(path.Dir("/" + newPath)[1:]); err != nil {
+		return err
+	}
+	moved := map[string]*memoryNode{newPath: node}
+	delete(m.nodes, oldPath)
+	if node.isDir {
+		for name, child := range m.nodes {
+			if strings.HasPrefix(name, oldPath+"/") {
+				moved[newPath+name[len(oldPath):]] = child
+				delete(m.nodes, name)
+			}
+		}
+	}
+	for name, child := range moved {
+		m.nodes[name] = child
+	}
+	return nil
+}
+
+func (m *Memory) SetMetadata(relPath string, mode os.FileMode, modTime time.Time) error {
+	relPath = Join(relPath)
+	m.Lock()
+	defer m.Unlock()
+	node, err := m.node("chmod", relPath)
+	if err != nil {
+		return err
+	}
+	if mode != 0 {
+		node.mode = node.mode&os.ModeType | mode.Perm()
+	}
+	if !modTime.IsZero() {
+		node.modTime = modTime
+	}
+	return nil
+}
+
+// FreeSpace 没有设置 Capacity 时不限制空间
+func (m *Memory) FreeSpace() (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.Capacity == 0 {
+		return math.MaxInt64, nil
+	}
+	return m.Capacity - m.used, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) String() string {
+	return "memory://"
+}
+
+// reserve 为写入预留空间，超过 Capacity 时返回 false
+func (m *Memory) reserve(size int64) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.Capacity > 0 && m.used+size > m.Capacity {
+		return false
+	}
+	m.used += size
+	return true
+}
+
+func (m *Memory) release(size int64) {
+	m.Lock()
+	m.used -= size
+	m.Unlock()
+}
+
+type memoryReader struct {
+	*bytes.Reader
+	memory *Memory
+	path   string
+}
+
+func (r *memoryReader) Read(p []byte) (int, error) {
+	if failAt := r.memory.FailReadAt; failAt > 0 && r.memory.reads.Add(1) == failAt {
+		readErr := r.memory.ReadErr
+		if readErr == nil {
+			readErr = syscall.EIO
+		}
+		return 0, &fs.PathError{Op: "read", Path: r.path, Err: readErr}
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+// memoryWriter 写入的内容在 Commit 之前只占用空间，不可见
+type memoryWriter struct {
+	memory *Memory
+	path   string
+	buffer bytes.Buffer
+	done   bool
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, &fs.PathError{Op: "write", Path: w.path, Err: fs.ErrClosed}
+	}
+	if w.memory.WriteDelay > 0 {
+		time.Sleep(w.memory.WriteDelay)
+	}
+	if !w.memory.reserve(int64(len(p))) {
+		return 0, &fs.PathError{Op: "write", Path: w.path, Err: syscall.ENOSPC}
+	}
+	return w.buffer.Write(p)
+}
+
+func (w *memoryWriter) Commit() error {
+	if w.done {
+		return &fs.PathError{Op: "commit", Path: w.path, Err: fs.ErrClosed}
+	}
+	w.done = true
+	m := w.memory
+	m.Lock()
+	defer m.Unlock()
+	if node, ok := m.nodes[w.path]; ok {
+		if node.isDir {
+			m.used -= int64(w.buffer.Len())
+			return &fs.PathError{Op: "commit", Path: w.path, Err: syscall.EISDIR}
+		}
+		m.used -= int64(len(node.content))
+	}
+	m.nodes[w.path] = &memoryNode{content: w.buffer.Bytes(), mode: 0644, modTime: time.Now()}
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	if !w.done {
+		w.done = true
+		w.memory.release(int64(w.buffer.Len()))
+	}
+	return nil
+}
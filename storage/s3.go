@@ -0,0 +1,650 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"go_tools/log"
+	"go_tools/paths"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 S3 兼容对象存储中一个 bucket 下的前缀，使用 path-style 地址，支持 AWS S3、MinIO 等。
+// 对象存储没有目录，以 / 分隔的公共前缀作为目录，不支持修改权限，修改时间保存在对象的元数据中
+type S3 struct {
+	Endpoint     string       `json:"endpoint"`
+	Region       string       `json:"region"`
+	Bucket       string       `json:"bucket"`
+	Prefix       string       `json:"prefix"`
+	AccessKey    string       `json:"-"` // 为空时匿名访问
+	SecretKey    string       `json:"-"`
+	SessionToken string       `json:"-"`
+	Client       *http.Client `json:"-"`
+	// 分段上传时每段的大小，为 0 时使用 defaultPartSize。不超过一段的文件直接 PUT
+	PartSize int64 `json:"part_size"`
+}
+
+const (
+	defaultPartSize = 8 * 1024 * 1024
+	// 一个对象最多 10000 段，每上传这么多段后段的大小翻倍，未知长度的大文件也不会超过段数上限
+	partsPerSize = 1000
+)
+
+// NewS3FromURL 解析 s3://bucket/prefix?endpoint=http://host:9000&region=us-east-1，
+// endpoint 和 region 也可以通过 AWS_ENDPOINT_URL、AWS_REGION 设置，密钥来自 AWS_ACCESS_KEY_ID、AWS_SECRET_ACCESS_KEY 和 AWS_SESSION_TOKEN
+func NewS3FromURL(u *url.URL) (*S3, error) {
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("missing bucket in %v", u)
+	}
+	query := u.Query()
+	region := firstNonEmpty(query.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint := firstNonEmpty(query.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL"), "https://s3."+region+".amazonaws.com")
+	return &S3{
+		Endpoint:     strings.TrimSuffix(endpoint, "/"),
+		Region:       region,
+		Bucket:       u.Host,
+		Prefix:       strings.Trim(u.Path, "/"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Client:       http.DefaultClient,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+// s3Error 请求返回的错误，不存在和没有权限分别包含 os.ErrNotExist 和 os.ErrPermission，5xx 和限流是暂时性的错误
+type s3Error struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 %v %v error: %v %v %v", e.Method, e.Key, e.StatusCode, e.Code, e.Message)
+}
+
+func (e *s3Error) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	case http.StatusForbidden:
+		return os.ErrPermission
+	default:
+		return nil
+	}
+}
+
+func (e *s3Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+func (s *S3) key(relPath string) string {
+	return Join(s.Prefix, relPath)
+}
+
+func (s *S3) Stat(relPath string) (*paths.FileInfo, error) {
+	key := s.key(relPath)
+	if len(key) == 0 {
+		return newFileInfo(relPath, 0, true, os.ModeDir|0755, time.Time{}), nil
+	}
+	response, err := s.request(http.MethodHead, key, nil, nil, nil, 0)
+	if err == nil {
+		_ = response.Body.Close()
+		modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+		if mtime, ok := parseMtime(response.Header.Get(mtimeHeader)); ok {
+			modTime = mtime
+		}
+		return newFileInfo(relPath, response.ContentLength, false, 0644, modTime), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// 存在以 key/ 开头的对象时作为目录
+	result, listErr := s.list(key+"/", "", 1)
+	if listErr != nil {
+		return nil, listErr
+	}
+	if len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, err
+	}
+	return newFileInfo(relPath, 0, true, os.ModeDir|0755, time.Time{}), nil
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list 调用 ListObjectsV2 列出 prefix 下一层的对象和公共前缀
+func (s *S3) list(prefix, token string, maxKeys int) (*listResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if len(token) > 0 {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	response, err := s.request(http.MethodGet, "", query, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	var result listResult
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, errors.Wrapf(err, "decode list result of %v error", prefix)
+	}
+	return &result, nil
+}
+
+func (s *S3) List(relPath string) ([]*paths.FileInfo, error) {
+	prefix := s.key(relPath)
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	var result []*paths.FileInfo
+	token := ""
+	for {
+		page, err := s.list(prefix, token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(item.Prefix, prefix), "/")
+			result = append(result, newFileInfo(Join(relPath, name), 0, true, os.ModeDir|0755, time.Time{}))
+		}
+		for _, item := range page.Contents {
+			// 控制台创建的目录标记
+			if item.Key == prefix {
+				continue
+			}
+			result = append(result, newFileInfo(Join(relPath, strings.TrimPrefix(item.Key, prefix)), item.Size, false, 0644, item.LastModified))
+		}
+		if !page.IsTruncated || len(page.NextContinuationToken) == 0 {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (s *S3) Open(relPath string) (io.ReadCloser, error) {
+	response, err := s.request(http.MethodGet, s.key(relPath), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Create 流式上传，内容超过一段时使用分段上传，只在内存中缓存当前的一段。Commit 完成上传前对象不可见
+func (s *S3) Create(relPath string) (Writer, error) {
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	return &s3Writer{storage: s, key: s.key(relPath), partSize: partSize}, nil
+}
+
+// MkdirAll 对象存储不需要创建目录
+func (s *S3) MkdirAll(string) error {
+	return nil
+}
+
+func (s *S3) Remove(relPath string) error {
+	response, err := s.request(http.MethodDelete, s.key(relPath), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// SetMetadata 对象的修改时间是上传时间，不能修改，这里通过复制对象自身把修改时间保存在 x-amz-meta-mtime 中，
+// Stat 时优先使用。上传时已经通过 SetModTime 保存了相同的修改时间时不再复制。
+// 对象只能整体复制，不支持修改权限；目录没有对应的对象，忽略
+func (s *S3) SetMetadata(relPath string, _ os.FileMode, modTime time.Time) error {
+	if modTime.IsZero() {
+		return nil
+	}
+	key := s.key(relPath)
+	response, err := s.request(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	_ = response.Body.Close()
+	if mtime, ok := parseMtime(response.Header.Get(mtimeHeader)); ok && mtime.Equal(modTime) {
+		return nil
+	}
+	header := http.Header{}
+	header.Set("x-amz-metadata-directive", "REPLACE")
+	header.Set(mtimeHeader, formatMtime(modTime))
+	if err := s.copyObject(key, key, header); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Rename 对象存储没有移动操作，复制对象后删除原来的对象，目录需要逐个移动其中的对象
+func (s *S3) Rename(oldPath, newPath string) error {
+	fileInfo, err := s.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.IsDir {
+		return s.moveObject(oldPath, newPath)
+	}
+	var files []string
+	err = Walk(context.Background(), s, oldPath, nil, func(fileInfo *paths.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !fileInfo.IsDir {
+			files = append(files, fileInfo.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "list %v error", s.key(oldPath))
+	}
+	for _, file := range files {
+		if err := s.moveObject(file, Join(newPath, strings.TrimPrefix(file, oldPath+"/"))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) moveObject(oldPath, newPath string) error {
+	if err := s.copyObject(s.key(oldPath), s.key(newPath), nil); err != nil {
+		return err
+	}
+	return s.Remove(oldPath)
+}
+
+// copyObject 在服务端复制对象，header 为空时同时复制元数据。单个对象最大 5GB
+func (s *S3) copyObject(sourceKey, key string, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("x-amz-copy-source", "/"+uriEncode(s.Bucket, true)+"/"+uriEncode(sourceKey, false))
+	response, err := s.request(http.MethodPut, key, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	return bodyError(http.MethodPut, key, response.Body)
+}
+
+const mtimeHeader = "x-amz-meta-mtime"
+
+// formatMtime 把修改时间格式化成 <秒>.<纳秒>
+func formatMtime(modTime time.Time) string {
+	return fmt.Sprintf("%d.%09d", modTime.Unix(), modTime.Nanosecond())
+}
+
+// parseMtime 解析 <秒>.<纳秒> 格式的修改时间
+func parseMtime(value string) (time.Time, bool) {
+	secondsValue, nanosValue, _ := strings.Cut(value, ".")
+	seconds, err := strconv.ParseInt(secondsValue, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var nanos int64
+	if len(nanosValue) > 0 {
+		if len(nanosValue) > 9 {
+			nanosValue = nanosValue[:9]
+		}
+		if nanos, err = strconv.ParseInt(nanosValue+strings.Repeat("0", 9-len(nanosValue)), 10, 64); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return time.Unix(seconds, nanos), true
+}
+
+func (s *S3) Close() error {
+	return nil
+}
+
+func (s *S3) String() string {
+	return fmt.Sprintf("s3://%v/%v", s.Bucket, s.Prefix)
+}
+
+// request 发送签名后的请求，返回 2xx 以外的状态码时返回 s3Error
+func (s *S3) request(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	rawURL := s.Endpoint + "/" + uriEncode(s.Bucket, true)
+	if len(key) > 0 {
+		rawURL += "/" + uriEncode(key, false)
+	}
+	request, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "create request %v error", rawURL)
+	}
+	request.URL.RawQuery = canonicalQuery(query)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if body != nil {
+		request.ContentLength = size
+		if size == 0 {
+			// 长度为 0 的 Body 会按照未知长度分块发送
+			request.Body = http.NoBody
+		}
+	}
+	s.sign(request, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "s3 %v %v error", method, key)
+	}
+	if response.StatusCode < 300 {
+		return response, nil
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	result := &s3Error{Method: method, Key: key, StatusCode: response.StatusCode}
+	if content, err := io.ReadAll(response.Body); err == nil && len(content) > 0 {
+		_ = xml.Unmarshal(content, result)
+	}
+	return nil, result
+}
+
+const (
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// sign 使用 AWS Signature Version 4 签名，内容不参与签名
+func (s *S3) sign(request *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", unsignedPayload)
+	if len(s.SessionToken) > 0 {
+		request.Header.Set("x-amz-security-token", s.SessionToken)
+	}
+	if len(s.AccessKey) == 0 {
+		return
+	}
+	headers := map[string]string{"host": request.URL.Host}
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(request.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{request.Method, request.URL.EscapedPath(), request.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, unsignedPayload}, "\n")
+	scope := amzDate[:8] + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := signAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{amzDate[:8], s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		signAlgorithm, s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, content string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(content))
+	return h.Sum(nil)
+}
+
+func hexSHA256(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery 按照参数名排序并编码，同时作为请求的 query
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode 按照签名的要求只保留 RFC 3986 中的非保留字符
+func uriEncode(value string, encodeSlash bool) string {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
+}
+
+// s3Writer 缓存满一段后上传，第一段满时才开始分段上传
+type s3Writer struct {
+	storage  *S3
+	key      string
+	partSize int64
+	buffer   bytes.Buffer
+	uploadID string
+	parts    []completedPart
+	done     bool
+	// header 开始上传时随对象保存的元数据
+	header http.Header
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// SetModTime 修改时间保存在 x-amz-meta-mtime 中，需要在第一段上传之前设置
+func (w *s3Writer) SetModTime(modTime time.Time) {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	w.header.Set(mtimeHeader, formatMtime(modTime))
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.Errorf("write %v error: writer is closed", w.key)
+	}
+	written := 0
+	for len(p) > 0 {
+		size := int(w.partSize - int64(w.buffer.Len()))
+		if size > len(p) {
+			size = len(p)
+		}
+		w.buffer.Write(p[:size])
+		written += size
+		p = p[size:]
+		if int64(w.buffer.Len()) >= w.partSize {
+			if err := w.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// uploadPart 上传缓存中的一段，需要时先开始分段上传
+func (w *s3Writer) uploadPart() error {
+	if len(w.uploadID) == 0 {
+		uploadID, err := w.storage.createMultipartUpload(w.key, w.header)
+		if err != nil {
+			return err
+		}
+		w.uploadID = uploadID
+	}
+	partNumber := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {w.uploadID}}
+	response, err := w.storage.request(http.MethodPut, w.key, query, nil, bytes.NewReader(w.buffer.Bytes()), int64(w.buffer.Len()))
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	w.parts = append(w.parts, completedPart{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+	w.buffer.Reset()
+	if len(w.parts)%partsPerSize == 0 {
+		w.partSize *= 2
+	}
+	return nil
+}
+
+// Commit 没有开始分段上传时直接 PUT，否则上传最后一段后完成分段上传
+func (w *s3Writer) Commit() error {
+	if w.done {
+		return errors.Errorf("commit %v error: writer is closed", w.key)
+	}
+	w.done = true
+	if len(w.uploadID) == 0 {
+		response, err := w.storage.request(http.MethodPut, w.key, nil, w.header, bytes.NewReader(w.buffer.Bytes()), int64(w.buffer.Len()))
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+	if w.buffer.Len() > 0 {
+		if err := w.uploadPart(); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	if err := w.storage.completeMultipartUpload(w.key, w.uploadID, w.parts); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+// Abort 放弃分段上传，服务端删除已经上传的段
+func (w *s3Writer) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.buffer.Reset()
+	if len(w.uploadID) == 0 {
+		return nil
+	}
+	return w.abort()
+}
+
+func (w *s3Writer) abort() error {
+	response, err := w.storage.request(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil, 0)
+	if err != nil {
+		log.Debug("abort multipart upload of %v error: %v", w.key, err)
+		return err
+	}
+	return response.Body.Close()
+}
+
+// createMultipartUpload 开始分段上传，header 中的元数据保存到合并后的对象，返回 UploadId
+func (s *S3) createMultipartUpload(key string, header http.Header) (string, error) {
+	response, err := s.request(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil || len(result.UploadID) == 0 {
+		return "", errors.Errorf("decode multipart upload of %v error: %v", key, err)
+	}
+	return result.UploadID, nil
+}
+
+// completeMultipartUpload 按照段号合并已经上传的段
+func (s *S3) completeMultipartUpload(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return errors.Wrap(err, "encode complete multipart upload error")
+	}
+	response, err := s.request(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	return bodyError(http.MethodPost, key, response.Body)
+}
+
+// bodyError 复制对象和完成分段上传可能在返回 200 之后才在内容中返回错误
+func bodyError(method, key string, body io.Reader) error {
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return errors.Wrapf(err, "read s3 %v %v result error", method, key)
+	}
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(content, &result); err == nil && result.XMLName.Local == "Error" {
+		return &s3Error{Method: method, Key: key, StatusCode: http.StatusInternalServerError, Code: result.Code, Message: result.Message}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package throttle
+
+import (
+	"fmt"
+	"go_tools/units"
+	"io"
+	"sync"
+	"time"
+)
+
+// Throttle 限制读写带宽和每秒处理的文件数，所有并行的协程共享同一个 Throttle，先到先得。
+// nil 的 Throttle 不做任何限制，限制可以在运行时通过 Set 系列方法调整
+type Throttle struct {
+	read  bucket
+	write bucket
+	files bucket
+}
+
+// New 新建限速，参数为每秒读写的字节数和文件数，小于等于 0 表示不限制
+func New(readBytes, writeBytes, files int64) *Throttle {
+	t := &Throttle{}
+	t.SetRead(readBytes)
+	t.SetWrite(writeBytes)
+	t.SetFiles(files)
+	return t
+}
+
+func (t *Throttle) SetRead(bytesPerSecond int64) {
+	t.read.setRate(bytesPerSecond)
+}
+
+func (t *Throttle) SetWrite(bytesPerSecond int64) {
+	t.write.setRate(bytesPerSecond)
+}
+
+func (t *Throttle) SetFiles(filesPerSecond int64) {
+	t.files.setRate(filesPerSecond)
+}
+
+// LimitsBytes 是否限制了读或写的带宽
+func (t *Throttle) LimitsBytes() bool {
+	return t != nil && (t.read.getRate() > 0 || t.write.getRate() > 0)
+}
+
+// WaitFile 开始处理一个文件前调用，超过每秒文件数限制时等待
+func (t *Throttle) WaitFile() {
+	if t != nil {
+		t.files.wait(1)
+	}
+}
+
+// Reader 返回读取时受读带宽限制的 Reader
+func (t *Throttle) Reader(reader io.Reader) io.Reader {
+	if t == nil {
+		return reader
+	}
+	return &limitReader{reader: reader, bucket: &t.read}
+}
+
+// Writer 返回写入时受写带宽限制的 Writer
+func (t *Throttle) Writer(writer io.Writer) io.Writer {
+	if t == nil {
+		return writer
+	}
+	return &limitWriter{writer: writer, bucket: &t.write}
+}
+
+func (t *Throttle) String() string {
+	if t == nil {
+		return "unlimited"
+	}
+	return fmt.Sprintf("read: %v, write: %v, files: %v/s",
+		formatRate(t.read.getRate()), formatRate(t.write.getRate()), t.files.getRate())
+}
+
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return units.FormatSize(rate) + "/s"
+}
+
+// bucket 令牌桶，最多积累一秒的令牌。一次请求超过剩余令牌时先透支，由请求者等待令牌恢复，
+// 后来的请求需要等前面透支的部分恢复，所以多个协程按照请求的顺序公平分配带宽
+type bucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.rate = rate
+	b.last = time.Now()
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+func (b *bucket) getRate() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.rate
+}
+
+func (b *bucket) wait(n int64) {
+	b.Lock()
+	if b.rate <= 0 {
+		b.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// maxRequest 每次读写最多请求的字节数，避免大缓冲区一次透支太多导致速度忽快忽慢
+const maxRequest = 64 * 1024
+
+type limitReader struct {
+	reader io.Reader
+	bucket *bucket
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if len(p) > maxRequest {
+		p = p[:maxRequest]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.bucket.wait(int64(n))
+	}
+	return n, err
+}
+
+type limitWriter struct {
+	writer io.Writer
+	bucket *bucket
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		size := len(p)
+		if size > maxRequest {
+			size = maxRequest
+		}
+		w.bucket.wait(int64(size))
+		n, err := w.writer.Write(p[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[size:]
+	}
+	return written, nil
+}
@@ -0,0 +1,58 @@
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	KB int64 = 1 << (10 * (iota + 1))
+	MB
+	GB
+	TB
+)
+
+// ParseSize 解析 512、64K、50M、1.5G、2T 这样的大小，单位不区分大小写，可以带 B 或 iB 后缀
+func ParseSize(value string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(value))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "B"), "I")
+	if len(text) == 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	unit := int64(1)
+	switch text[len(text)-1] {
+	case 'K':
+		unit = KB
+	case 'M':
+		unit = MB
+	case 'G':
+		unit = GB
+	case 'T':
+		unit = TB
+	}
+	if unit > 1 {
+		text = text[:len(text)-1]
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	return int64(number * float64(unit)), nil
+}
+
+// FormatSize 把字节数格式化成方便阅读的大小
+func FormatSize(size int64) string {
+	switch {
+	case size >= TB:
+		return fmt.Sprintf("%.2fT", float64(size)/float64(TB))
+	case size >= GB:
+		return fmt.Sprintf("%.2fG", float64(size)/float64(GB))
+	case size >= MB:
+		return fmt.Sprintf("%.2fM", float64(size)/float64(MB))
+	case size >= KB:
+		return fmt.Sprintf("%.2fK", float64(size)/float64(KB))
+	default:
+		return fmt.Sprintf("%vB", size)
+	}
+}